@@ -16,6 +16,7 @@ require (
 	github.com/huandu/go-clone v1.6.0
 	github.com/huaweicloud/huaweicloud-sdk-go-obs v3.23.9+incompatible
 	github.com/json-iterator/go v1.1.12
+	github.com/klauspost/compress v1.17.0
 	github.com/nats-io/nats.go v1.30.2
 	github.com/petermattis/goid v0.0.0-20230808133559-b036b712a89b
 	github.com/pkg/sftp v1.13.5
@@ -24,6 +25,7 @@ require (
 	github.com/stretchr/testify v1.8.4
 	golang.org/x/crypto v0.13.0
 	golang.org/x/net v0.15.0
+	golang.org/x/sys v0.12.0
 	google.golang.org/grpc v1.58.2
 	gorm.io/driver/mysql v1.5.0
 	gorm.io/gorm v1.25.1
@@ -33,7 +35,6 @@ require (
 	github.com/995933447/simpletrace v0.0.0-20230217061256-c25a914bd376 // indirect
 	github.com/fsnotify/fsnotify v1.6.0 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
-	github.com/klauspost/compress v1.17.0 // indirect
 	github.com/magiconair/properties v1.8.7 // indirect
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/pelletier/go-toml/v2 v2.1.0 // indirect
@@ -80,7 +81,6 @@ require (
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.9.0 // indirect
 	go.uber.org/zap v1.24.0 // indirect
-	golang.org/x/sys v0.12.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
 	google.golang.org/genproto v0.0.0-20230913181813-007df8e322eb // indirect
 	google.golang.org/protobuf v1.31.0 // indirect
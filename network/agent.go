@@ -1,6 +1,81 @@
 package network
 
+import (
+	"context"
+)
+
 type Agent interface {
 	Run()
 	OnClose()
 }
+
+// ShutdownAgent is told by Shutdown of the servers before its conn is closed,
+// the messages written in OnShutdown are flushed before the conn is closed,
+// the agents are told concurrently and the conns of the ones still in OnShutdown when ctx is done are destroyed
+type ShutdownAgent interface {
+	Agent
+	OnShutdown()
+}
+
+// AgentV2 is told the context and the close reason of its conn, NewAgent returns it by WrapAgentV2.
+// the context is canceled when the server shuts down or closes, the client closes, or the conn is closed for good,
+// by Destroy in particular, so the goroutines of the agent may end with its conn
+type AgentV2 interface {
+	Run(ctx context.Context)
+	OnClose(reason CloseReason)
+}
+
+// WrapAgentV2 returns the Agent driving a, the servers and the clients detect it,
+// run a with the context of the conn and tell a the close reason,
+// elsewhere a runs with a background context and is closed with CloseUnknown.
+// a is told OnShutdown if it implements it as ShutdownAgent does
+func WrapAgentV2(a AgentV2) Agent {
+	return agentV2{a}
+}
+
+type agentV2 struct {
+	v2 AgentV2
+}
+
+func (a agentV2) Run() {
+	a.v2.Run(context.Background())
+}
+
+func (a agentV2) OnClose() {
+	a.v2.OnClose(CloseUnknown)
+}
+
+func (a agentV2) OnShutdown() {
+	if s, ok := a.v2.(interface{ OnShutdown() }); ok {
+		s.OnShutdown()
+	}
+}
+
+// runAgent runs agent, an AgentV2 with a context of ctx canceled once done is closed
+func runAgent(ctx context.Context, agent Agent, done <-chan struct{}) {
+	a, ok := agent.(agentV2)
+	if !ok {
+		agent.Run()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	a.v2.Run(ctx)
+}
+
+// closeAgent tells agent its conn is closed, an AgentV2 is told why
+func closeAgent(agent Agent, reason CloseReason) {
+	if a, ok := agent.(agentV2); ok {
+		a.v2.OnClose(reason)
+		return
+	}
+	agent.OnClose()
+}
@@ -0,0 +1,126 @@
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type v2TestAgent struct {
+	conn     Conn
+	ctxDone  chan struct{}
+	reasons  chan CloseReason
+	shutdown chan struct{}
+}
+
+func newV2TestAgent(conn Conn) *v2TestAgent {
+	return &v2TestAgent{
+		conn:     conn,
+		ctxDone:  make(chan struct{}),
+		reasons:  make(chan CloseReason, 1),
+		shutdown: make(chan struct{}, 1),
+	}
+}
+
+// Run waits for the context only, the conn is left to the server
+func (a *v2TestAgent) Run(ctx context.Context) {
+	<-ctx.Done()
+	close(a.ctxDone)
+}
+
+func (a *v2TestAgent) OnClose(reason CloseReason) {
+	a.reasons <- reason
+}
+
+func (a *v2TestAgent) OnShutdown() {
+	a.shutdown <- struct{}{}
+}
+
+func newV2TestServer() (*TCPServer, *PipeListener, chan *v2TestAgent) {
+	agents := make(chan *v2TestAgent, 1)
+	ln := NewPipeListener()
+	server := &TCPServer{
+		Listener: ln,
+		NewAgent: func(conn *TCPConn) Agent {
+			agent := newV2TestAgent(conn)
+			agents <- agent
+			return WrapAgentV2(agent)
+		},
+	}
+	server.Start()
+	return server, ln, agents
+}
+
+func expectReason(t *testing.T, agent *v2TestAgent, want CloseReason) {
+	t.Helper()
+	select {
+	case <-agent.ctxDone:
+	case <-time.After(time.Second):
+		t.Fatal("context not canceled")
+	}
+	select {
+	case reason := <-agent.reasons:
+		if reason != want {
+			t.Fatalf("reason %v, want %v", reason, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not closed")
+	}
+}
+
+func TestAgentV2_Destroy(t *testing.T) {
+	server, ln, agents := newV2TestServer()
+	defer server.Close()
+
+	conn, _ := ln.Dial()
+	defer conn.Close()
+	agent := <-agents
+	agent.conn.Destroy()
+	expectReason(t, agent, CloseDestroy)
+}
+
+func TestAgentV2_Shutdown(t *testing.T) {
+	server, ln, agents := newV2TestServer()
+
+	conn, _ := ln.Dial()
+	defer conn.Close()
+	agent := <-agents
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-agent.shutdown:
+	default:
+		t.Fatal("not told to shut down")
+	}
+	expectReason(t, agent, CloseLocal)
+}
+
+func TestAgentV2_Client(t *testing.T) {
+	server, ln := newPipeEchoServer()
+	defer server.Close()
+
+	agents := make(chan *v2TestAgent, 1)
+	client := &TCPClient{
+		Dial: ln.DialContext,
+		NewAgent: func(conn *TCPConn) Agent {
+			agent := newV2TestAgent(conn)
+			agents <- agent
+			return WrapAgentV2(agent)
+		},
+	}
+	client.Start()
+	agent := <-agents
+	client.Close()
+	expectReason(t, agent, CloseLocal)
+
+	// elsewhere it is closed as a plain agent
+	agent = newV2TestAgent(nil)
+	WrapAgentV2(agent).OnClose()
+	if reason := <-agent.reasons; reason != CloseUnknown {
+		t.Fatalf("reason %v", reason)
+	}
+}
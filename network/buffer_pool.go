@@ -0,0 +1,44 @@
+package network
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// the buffers are pooled by size classes of powers of 2 from 64B to 64KB, the larger ones are not pooled
+const (
+	minBufferShift = 6
+	maxBufferShift = 16
+)
+
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+func bufferClass(n int) int {
+	if n <= 1<<minBufferShift {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minBufferShift
+}
+
+// GetBuffer returns a buffer of len n, it may be given back by PutBuffer once no longer used
+func GetBuffer(n int) []byte {
+	c := bufferClass(n)
+	if c >= len(bufferPools) {
+		return make([]byte, n)
+	}
+	if p, ok := bufferPools[c].Get().(*[]byte); ok {
+		return (*p)[:n]
+	}
+	return make([]byte, n, 1<<(c+minBufferShift))
+}
+
+// PutBuffer gives b back to the pool, neither the caller nor anyone holding b may use it after.
+// the buffers not from GetBuffer are dropped unless their cap happens to be a size class
+func PutBuffer(b []byte) {
+	c := bufferClass(cap(b))
+	if c >= len(bufferPools) || cap(b) != 1<<(c+minBufferShift) {
+		return
+	}
+	b = b[:0]
+	bufferPools[c].Put(&b)
+}
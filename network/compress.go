@@ -0,0 +1,268 @@
+package network
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+var ErrDecompressTooLong = errors.New("decompressed message too long")
+
+// Compressor compresses the payload of frames, the name is what peers negotiate
+type Compressor interface {
+	Name() string
+	// must goroutine safe
+	Compress(src []byte) ([]byte, error)
+	// must goroutine safe, fails with ErrDecompressTooLong if the result exceeds maxLen
+	Decompress(src []byte, maxLen int) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = make(map[string]Compressor)
+)
+
+func init() {
+	RegisterCompressor(snappyCompressor{})
+	RegisterCompressor(gzipCompressor{})
+	RegisterCompressor(newZstdCompressor())
+}
+
+// RegisterCompressor makes a compressor negotiable by its name, it replaces the one of the same name
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[c.Name()] = c
+}
+
+func GetCompressor(name string) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[name]
+	return c, ok
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string {
+	return "snappy"
+}
+
+func (snappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCompressor) Decompress(src []byte, maxLen int) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxLen {
+		return nil, ErrDecompressTooLong
+	}
+	return snappy.Decode(nil, src)
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (gzipCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(src []byte, maxLen int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readAllLimited(r, maxLen)
+}
+
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+	// DecodeAll is goroutine safe, the decoded size is limited to the cap of dst
+	decoder *zstd.Decoder
+}
+
+func newZstdCompressor() *zstdCompressor {
+	// never fail with these options
+	encoder, _ := zstd.NewWriter(nil)
+	decoder, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecodeAllCapLimit(true))
+	return &zstdCompressor{encoder: encoder, decoder: decoder}
+}
+
+func (*zstdCompressor) Name() string {
+	return "zstd"
+}
+
+func (c *zstdCompressor) Compress(src []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(src, nil), nil
+}
+
+func (c *zstdCompressor) Decompress(src []byte, maxLen int) ([]byte, error) {
+	// the frames of EncodeAll carry their size, the others may take up to maxLen
+	size := maxLen
+	var h zstd.Header
+	if err := h.Decode(src); err != nil {
+		return nil, err
+	}
+	if h.HasFCS {
+		if h.FrameContentSize > uint64(maxLen) {
+			return nil, ErrDecompressTooLong
+		}
+		size = int(h.FrameContentSize)
+	}
+
+	b, err := c.decoder.DecodeAll(src, make([]byte, 0, size))
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return nil, ErrDecompressTooLong
+	}
+	return b, err
+}
+
+func readAllLimited(r io.Reader, maxLen int) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, int64(maxLen)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxLen {
+		return nil, ErrDecompressTooLong
+	}
+	return b, nil
+}
+
+type CompressionStats struct {
+	Compressor string
+	// outbound, raw bytes only count the compressed frames
+	FramesOut           uint64
+	CompressedFramesOut uint64
+	RawBytesOut         uint64
+	CompressedBytesOut  uint64
+	// inbound
+	FramesIn           uint64
+	CompressedFramesIn uint64
+	RawBytesIn         uint64
+	CompressedBytesIn  uint64
+}
+
+// Ratio is the compressed size to the raw size of the compressed frames in both directions, 1 if none
+func (s CompressionStats) Ratio() float64 {
+	raw := s.RawBytesOut + s.RawBytesIn
+	if raw == 0 {
+		return 1
+	}
+	return float64(s.CompressedBytesOut+s.CompressedBytesIn) / float64(raw)
+}
+
+// frameCompressor compresses the frames of one conn and counts them
+type frameCompressor struct {
+	comp      Compressor
+	threshold int
+	maxLen    int
+
+	framesOut, compressedFramesOut, rawBytesOut, compressedBytesOut atomic.Uint64
+	framesIn, compressedFramesIn, rawBytesIn, compressedBytesIn     atomic.Uint64
+}
+
+func newFrameCompressor(comp Compressor, threshold int, maxLen int) *frameCompressor {
+	if threshold <= 0 {
+		threshold = 256
+	}
+	return &frameCompressor{
+		comp:      comp,
+		threshold: threshold,
+		maxLen:    maxLen,
+	}
+}
+
+// compress returns args itself if they are below the threshold or don't shrink
+func (fc *frameCompressor) compress(args [][]byte) ([][]byte, bool) {
+	fc.framesOut.Add(1)
+	if int(argsLen(args)) < fc.threshold {
+		return args, false
+	}
+	raw := joinArgs(args)
+	b, err := fc.comp.Compress(raw)
+	if err != nil || len(b) >= len(raw) {
+		return args, false
+	}
+
+	fc.compressedFramesOut.Add(1)
+	fc.rawBytesOut.Add(uint64(len(raw)))
+	fc.compressedBytesOut.Add(uint64(len(b)))
+	return [][]byte{b}, true
+}
+
+func (fc *frameCompressor) decompress(b []byte, compressed bool) ([]byte, error) {
+	fc.framesIn.Add(1)
+	if !compressed {
+		return b, nil
+	}
+	raw, err := fc.comp.Decompress(b, fc.maxLen)
+	if err != nil {
+		return nil, err
+	}
+
+	fc.compressedFramesIn.Add(1)
+	fc.rawBytesIn.Add(uint64(len(raw)))
+	fc.compressedBytesIn.Add(uint64(len(b)))
+	return raw, nil
+}
+
+func (fc *frameCompressor) stats() CompressionStats {
+	return CompressionStats{
+		Compressor:          fc.comp.Name(),
+		FramesOut:           fc.framesOut.Load(),
+		CompressedFramesOut: fc.compressedFramesOut.Load(),
+		RawBytesOut:         fc.rawBytesOut.Load(),
+		CompressedBytesOut:  fc.compressedBytesOut.Load(),
+		FramesIn:            fc.framesIn.Load(),
+		CompressedFramesIn:  fc.compressedFramesIn.Load(),
+		RawBytesIn:          fc.rawBytesIn.Load(),
+		CompressedBytesIn:   fc.compressedBytesIn.Load(),
+	}
+}
+
+// negotiateCompressor picks the first offered compressor which is also accepted
+func negotiateCompressor(offered []string, accepted []string) (Compressor, bool) {
+	for _, name := range offered {
+		for _, a := range accepted {
+			if a != name {
+				continue
+			}
+			if c, ok := GetCompressor(name); ok {
+				return c, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func joinArgs(args [][]byte) []byte {
+	if len(args) == 1 {
+		return args[0]
+	}
+	b := make([]byte, 0, argsLen(args))
+	for _, arg := range args {
+		b = append(b, arg...)
+	}
+	return b
+}
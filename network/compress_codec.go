@@ -0,0 +1,218 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// compressCodec compresses the payload of the wrapped codec, the compressed frames are marked with
+// FlagCompressed if the wrapped codec carries the header, otherwise by a flag byte leading the payload,
+// the flag byte counts in the max msg len of the wrapped codec
+type compressCodec struct {
+	codec      FrameCodec
+	fc         *frameCompressor
+	headerFlag bool
+}
+
+func newCompressCodec(codec FrameCodec, fc *frameCompressor) *compressCodec {
+	return &compressCodec{
+		codec:      codec,
+		fc:         fc,
+		headerFlag: carriesHeader(codec),
+	}
+}
+
+func (c *compressCodec) Unwrap() FrameCodec {
+	return c.codec
+}
+
+func (c *compressCodec) CarriesHeader() bool {
+	return c.headerFlag
+}
+
+// goroutine safe
+func (c *compressCodec) ReadFrame(r io.Reader) (*FrameHeader, []byte, error) {
+	h, b, err := c.codec.ReadFrame(r)
+	if err != nil || (h != nil && h.Flags&FlagHeartbeat != 0) {
+		return h, b, err
+	}
+
+	var compressed bool
+	if c.headerFlag {
+		compressed = h != nil && h.Flags&FlagCompressed != 0
+		if h != nil {
+			h.Flags &^= FlagCompressed
+		}
+	} else {
+		if len(b) < 1 {
+			return nil, nil, errors.New("compress flag missing")
+		}
+		compressed = b[0] != 0
+		b = b[1:]
+	}
+
+	b, err = c.fc.decompress(b, compressed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, b, nil
+}
+
+// goroutine safe
+func (c *compressCodec) PackFrame(h *FrameHeader, args ...[]byte) ([]byte, error) {
+	args, compressed := c.fc.compress(args)
+	if c.headerFlag {
+		if compressed {
+			var nh FrameHeader
+			if h != nil {
+				nh = *h
+			}
+			nh.Flags |= FlagCompressed
+			h = &nh
+		}
+		return c.codec.PackFrame(h, args...)
+	}
+
+	flag := []byte{0}
+	if compressed {
+		flag[0] = 1
+	}
+	return c.codec.PackFrame(h, append([][]byte{flag}, args...)...)
+}
+
+func (c *compressCodec) PackHeartbeat() ([]byte, error) {
+	heartbeatCodec, ok := c.codec.(HeartbeatCodec)
+	if !ok {
+		return nil, errors.New("codec does not support heartbeat")
+	}
+	return heartbeatCodec.PackHeartbeat()
+}
+
+func (c *compressCodec) stats() CompressionStats {
+	return c.fc.stats()
+}
+
+func compressionStats(codec FrameCodec) (CompressionStats, bool) {
+	c := findCodec(codec, func(codec FrameCodec) bool {
+		_, ok := codec.(*compressCodec)
+		return ok
+	})
+	if c == nil {
+		return CompressionStats{}, false
+	}
+	return c.(*compressCodec).stats(), true
+}
+
+var compressMagic = [2]byte{'S', 'C'}
+
+// CompressionHandshake negotiates the compressor of a conn, the client offers
+// | magic(2) | count(1) | name len(1) | name | ... | and the server answers | magic(2) | name len(1) | name |,
+// the first offered name the server accepts wins and an empty name turns the compression off.
+// The codecs without the frame header, e.g. MsgParser, mark the compressed frames by a flag byte,
+// so their messages are 1 byte shorter than the max msg len, the encryption takes more, see EncryptionHandshake.
+type CompressionHandshake struct {
+	// Compressors are the registered names in order of preference, snappy if empty
+	Compressors []string
+	// Threshold is the min payload size to compress, 256 if zero
+	Threshold int
+	// MaxMsgLen bounds the decompressed payload, 64K if zero
+	MaxMsgLen int
+}
+
+func (ch *CompressionHandshake) compressors() []string {
+	if len(ch.Compressors) == 0 {
+		return []string{"snappy"}
+	}
+	return ch.Compressors
+}
+
+func (ch *CompressionHandshake) newFrameCompressor(comp Compressor) *frameCompressor {
+	maxMsgLen := ch.MaxMsgLen
+	if maxMsgLen <= 0 {
+		maxMsgLen = 64 * 1024
+	}
+	return newFrameCompressor(comp, ch.Threshold, maxMsgLen)
+}
+
+func (ch *CompressionHandshake) Handshake(conn net.Conn, codec FrameCodec, isServer bool) (FrameCodec, error) {
+	if isServer {
+		var header [3]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return nil, err
+		}
+		if header[0] != compressMagic[0] || header[1] != compressMagic[1] {
+			return nil, errors.New("bad compression handshake")
+		}
+		offered := make([]string, 0, header[2])
+		for i := 0; i < int(header[2]); i++ {
+			name, err := readShortString(conn)
+			if err != nil {
+				return nil, err
+			}
+			offered = append(offered, name)
+		}
+
+		comp, ok := negotiateCompressor(offered, ch.compressors())
+		var name string
+		if ok {
+			name = comp.Name()
+		}
+		resp := append([]byte{compressMagic[0], compressMagic[1], byte(len(name))}, name...)
+		if _, err := conn.Write(resp); err != nil {
+			return nil, err
+		}
+		if !ok {
+			return codec, nil
+		}
+		return newCompressCodec(codec, ch.newFrameCompressor(comp)), nil
+	}
+
+	names := ch.compressors()
+	if len(names) > 0xff {
+		return nil, errors.New("too many compressors")
+	}
+	req := []byte{compressMagic[0], compressMagic[1], byte(len(names))}
+	for _, name := range names {
+		if len(name) > 0xff {
+			return nil, errors.New("compressor name too long")
+		}
+		req = append(req, byte(len(name)))
+		req = append(req, name...)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	var magic [2]byte
+	if _, err := io.ReadFull(conn, magic[:]); err != nil {
+		return nil, err
+	}
+	if magic != compressMagic {
+		return nil, errors.New("bad compression handshake")
+	}
+	name, err := readShortString(conn)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return codec, nil
+	}
+	comp, ok := negotiateCompressor([]string{name}, names)
+	if !ok {
+		return nil, errors.New("server chose an unknown compressor")
+	}
+	return newCompressCodec(codec, ch.newFrameCompressor(comp)), nil
+}
+
+func readShortString(r io.Reader) (string, error) {
+	var l [1]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, l[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
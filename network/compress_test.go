@@ -0,0 +1,82 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressionHandshake(t *testing.T) {
+	for _, codec := range []FrameCodec{NewMsgParser(), NewVersionedCodec()} {
+		c, s := net.Pipe()
+
+		done := make(chan FrameCodec, 1)
+		go func() {
+			codec, err := (&CompressionHandshake{Compressors: []string{"zstd", "snappy"}}).Handshake(s, codec, true)
+			if err != nil {
+				t.Error(err)
+			}
+			done <- codec
+		}()
+		clientCodec, err := (&CompressionHandshake{Compressors: []string{"gzip", "snappy"}}).Handshake(c, codec, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverCodec := <-done
+		c.Close()
+		s.Close()
+
+		msg := bytes.Repeat([]byte("compress me "), 100)
+		buf, err := clientCodec.PackFrame(nil, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf) >= len(msg) {
+			t.Fatalf("frame of %d bytes not compressed", len(buf))
+		}
+		_, data, err := serverCodec.ReadFrame(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, msg) {
+			t.Fatal("unexpected decompressed data")
+		}
+
+		stats, ok := compressionStats(serverCodec)
+		if !ok || stats.Compressor != "snappy" || stats.CompressedFramesIn != 1 || stats.Ratio() >= 1 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+	}
+}
+
+func TestCompressor_MaxLen(t *testing.T) {
+	raw := bytes.Repeat([]byte("srvlib"), 1000)
+	for _, name := range []string{"snappy", "gzip", "zstd"} {
+		c, _ := GetCompressor(name)
+		b, err := c.Compress(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := c.Decompress(b, len(raw)); err != nil || !bytes.Equal(got, raw) {
+			t.Fatalf("%v: unexpected decompressed %v", name, err)
+		}
+		if _, err := c.Decompress(b, len(raw)-1); err != ErrDecompressTooLong {
+			t.Fatalf("%v: unexpected error %v", name, err)
+		}
+	}
+
+	// a zstd frame without its size
+	var buf bytes.Buffer
+	w, _ := zstd.NewWriter(&buf)
+	w.Write(raw)
+	w.Close()
+	c, _ := GetCompressor("zstd")
+	if got, err := c.Decompress(buf.Bytes(), len(raw)); err != nil || !bytes.Equal(got, raw) {
+		t.Fatalf("unexpected decompressed %v", err)
+	}
+	if _, err := c.Decompress(buf.Bytes(), len(raw)-1); err != ErrDecompressTooLong {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -12,4 +12,5 @@ type Conn interface {
 	Close()
 	Destroy()
 	RemoteAddrWithoutPort() string
+	Stats() ConnStats
 }
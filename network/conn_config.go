@@ -0,0 +1,73 @@
+package network
+
+import (
+	"io"
+	"time"
+)
+
+// connConfig holds the per conn options servers and clients pass to their conns
+type connConfig struct {
+	isServer bool
+
+	// write queue
+	pendingWriteNum int
+	overflowPolicy  OverflowPolicy
+	overflowTimeout time.Duration
+	coalesceBytes   int
+	onOverflow      func(conn Conn, policy OverflowPolicy)
+
+	// io, the tcp writer writes up to writeBatch queued messages at once, a negative readBufferSize reads unbuffered
+	writeBatch     int
+	readBufferSize int
+
+	// websocket, text frames instead of binary ones
+	textMessage bool
+
+	// idle
+	readIdleTimeout   time.Duration
+	writeIdleTimeout  time.Duration
+	idleTimeout       time.Duration
+	heartbeatInterval time.Duration
+	onIdle            func(conn Conn, kind IdleKind) bool
+
+	// rate limit
+	msgRate         float64
+	msgBurst        int
+	byteRate        float64
+	byteBurst       int
+	rateLimitAction RateLimitAction
+	onRateLimit     func(conn Conn, action RateLimitAction)
+
+	// record returns where the messages of a conn are recorded, nil records nothing
+	record func(conn Conn) io.WriteCloser
+
+	metrics *Metrics
+}
+
+func (cfg *connConfig) init() *connConfig {
+	if cfg.overflowPolicy == OverflowBlock && cfg.overflowTimeout <= 0 {
+		cfg.overflowTimeout = time.Second
+	}
+	if cfg.overflowPolicy == OverflowCoalesce && cfg.coalesceBytes <= 0 {
+		cfg.coalesceBytes = 64 * 1024
+	}
+	if cfg.writeBatch <= 0 {
+		cfg.writeBatch = 128
+	}
+	if cfg.readBufferSize == 0 {
+		cfg.readBufferSize = 4096
+	}
+	return cfg
+}
+
+func (cfg *connConfig) overflow(conn Conn) {
+	if cfg.onOverflow != nil {
+		cfg.onOverflow(conn, cfg.overflowPolicy)
+	}
+}
+
+func (cfg *connConfig) rateLimited(conn Conn) {
+	if cfg.onRateLimit != nil {
+		cfg.onRateLimit(conn, cfg.rateLimitAction)
+	}
+}
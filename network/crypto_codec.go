@@ -0,0 +1,309 @@
+package network
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	CipherAESGCM   = "aes-256-gcm"
+	CipherChaCha20 = "chacha20-poly1305"
+)
+
+var ErrReplayedFrame = errors.New("replayed or too old frame")
+
+const replayWindowSize = 64
+
+// replayWindow accepts every counter once, counters older than the window are rejected
+type replayWindow struct {
+	mu     sync.Mutex
+	max    uint64
+	bitmap uint64
+}
+
+func (w *replayWindow) check(n uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if n == 0 {
+		return false
+	}
+	if n > w.max {
+		return true
+	}
+	if w.max-n >= replayWindowSize {
+		return false
+	}
+	return w.bitmap&(1<<(w.max-n)) == 0
+}
+
+func (w *replayWindow) accept(n uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if n > w.max {
+		if shift := n - w.max; shift >= replayWindowSize {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.max = n
+		return
+	}
+	w.bitmap |= 1 << (w.max - n)
+}
+
+// cryptoCodec encrypts the payload of the wrapped codec as | counter(8) | sealed data |, the counter is
+// the nonce and every peer uses its own key, the frames are marked with FlagEncrypted if the wrapped
+// codec carries the header, heartbeats are not encrypted
+type cryptoCodec struct {
+	codec      FrameCodec
+	seal       cipher.AEAD
+	open       cipher.AEAD
+	counter    atomic.Uint64
+	window     replayWindow
+	headerFlag bool
+}
+
+func (c *cryptoCodec) Unwrap() FrameCodec {
+	return c.codec
+}
+
+func (c *cryptoCodec) CarriesHeader() bool {
+	return c.headerFlag
+}
+
+func (c *cryptoCodec) nonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+// goroutine safe
+func (c *cryptoCodec) ReadFrame(r io.Reader) (*FrameHeader, []byte, error) {
+	h, b, err := c.codec.ReadFrame(r)
+	if err != nil || (h != nil && h.Flags&FlagHeartbeat != 0) {
+		return h, b, err
+	}
+	if len(b) < 8+c.open.Overhead() {
+		return nil, nil, errors.New("encrypted frame too short")
+	}
+
+	counter := binary.BigEndian.Uint64(b)
+	if !c.window.check(counter) {
+		return nil, nil, ErrReplayedFrame
+	}
+	data, err := c.open.Open(nil, c.nonce(c.open, counter), b[8:], nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.window.accept(counter)
+
+	if h != nil {
+		h.Flags &^= FlagEncrypted
+	}
+	return h, data, nil
+}
+
+// goroutine safe, the frames must be written in the order they are packed, see sealsInOrder
+func (c *cryptoCodec) PackFrame(h *FrameHeader, args ...[]byte) ([]byte, error) {
+	counter := c.counter.Add(1)
+	b := make([]byte, 8, 8+int(argsLen(args))+c.seal.Overhead())
+	binary.BigEndian.PutUint64(b, counter)
+	b = c.seal.Seal(b, c.nonce(c.seal, counter), joinArgs(args), nil)
+
+	if c.headerFlag {
+		var nh FrameHeader
+		if h != nil {
+			nh = *h
+		}
+		nh.Flags |= FlagEncrypted
+		h = &nh
+	}
+	return c.codec.PackFrame(h, b)
+}
+
+// sealsInOrder reports whether codec encrypts, the peer rejects the frames too far out of order
+// so the conns pack and queue them in one go
+func sealsInOrder(codec FrameCodec) bool {
+	return findCodec(codec, func(codec FrameCodec) bool {
+		_, ok := codec.(*cryptoCodec)
+		return ok
+	}) != nil
+}
+
+func (c *cryptoCodec) PackHeartbeat() ([]byte, error) {
+	heartbeatCodec, ok := c.codec.(HeartbeatCodec)
+	if !ok {
+		return nil, errors.New("codec does not support heartbeat")
+	}
+	return heartbeatCodec.PackHeartbeat()
+}
+
+func newAEAD(name string, key []byte) (cipher.AEAD, error) {
+	switch name {
+	case CipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20:
+		return chacha20poly1305.New(key)
+	}
+	return nil, errors.New("unknown cipher " + name)
+}
+
+var encryptMagic = [2]byte{'S', 'E'}
+
+// EncryptionHandshake exchanges X25519 keys and encrypts the frames with AES-GCM or ChaCha20-Poly1305,
+// the client sends | magic(2) | public key(32) | count(1) | name len(1) | cipher name | ... |
+// and the server answers | magic(2) | public key(32) | name len(1) | cipher name |.
+// The peers are not authenticated so it only defeats passive eavesdropping, use TLS if that matters.
+// Wrap it inside CompressionHandshake, ChainHandshakers(&EncryptionHandshake{}, &CompressionHandshake{}),
+// so that the frames are compressed before being encrypted.
+// The counter and the tag of a frame take 24 bytes of the max msg len of the codec, the messages must be shorter by that.
+type EncryptionHandshake struct {
+	// Ciphers in order of preference, both ciphers if empty
+	Ciphers []string
+}
+
+func (eh *EncryptionHandshake) ciphers() []string {
+	if len(eh.Ciphers) == 0 {
+		return []string{CipherAESGCM, CipherChaCha20}
+	}
+	return eh.Ciphers
+}
+
+func (eh *EncryptionHandshake) Handshake(conn net.Conn, codec FrameCodec, isServer bool) (FrameCodec, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pub := key.PublicKey().Bytes()
+
+	var (
+		peerPub    []byte
+		cipherName string
+	)
+	if isServer {
+		var header [2 + 32 + 1]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return nil, err
+		}
+		if header[0] != encryptMagic[0] || header[1] != encryptMagic[1] {
+			return nil, errors.New("bad encryption handshake")
+		}
+		peerPub = header[2:34]
+		for i := 0; i < int(header[34]); i++ {
+			name, err := readShortString(conn)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range eh.ciphers() {
+				if cipherName == "" && c == name {
+					cipherName = name
+				}
+			}
+		}
+		if cipherName == "" {
+			return nil, errors.New("no cipher in common")
+		}
+
+		resp := append([]byte{encryptMagic[0], encryptMagic[1]}, pub...)
+		resp = append(resp, byte(len(cipherName)))
+		resp = append(resp, cipherName...)
+		if _, err := conn.Write(resp); err != nil {
+			return nil, err
+		}
+	} else {
+		names := eh.ciphers()
+		req := append([]byte{encryptMagic[0], encryptMagic[1]}, pub...)
+		req = append(req, byte(len(names)))
+		for _, name := range names {
+			req = append(req, byte(len(name)))
+			req = append(req, name...)
+		}
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		var header [2 + 32]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return nil, err
+		}
+		if header[0] != encryptMagic[0] || header[1] != encryptMagic[1] {
+			return nil, errors.New("bad encryption handshake")
+		}
+		peerPub = header[2:]
+		if cipherName, err = readShortString(conn); err != nil {
+			return nil, err
+		}
+		offered := false
+		for _, name := range names {
+			offered = offered || name == cipherName
+		}
+		if !offered {
+			return nil, errors.New("server chose a cipher not offered")
+		}
+	}
+
+	peerKey, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := key.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// the salt is the client key followed by the server key, each direction has its own key
+	clientPub, serverPub := pub, peerPub
+	if isServer {
+		clientPub, serverPub = peerPub, pub
+	}
+	salt := append(append([]byte{}, clientPub...), serverPub...)
+	clientKey, serverKey := make([]byte, 32), make([]byte, 32)
+	kdf := hkdf.New(sha256.New, secret, salt, []byte("srvlib frame encryption"))
+	if _, err := io.ReadFull(kdf, clientKey); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(kdf, serverKey); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(clientPub, serverPub) {
+		return nil, errors.New("bad encryption handshake")
+	}
+
+	sealKey, openKey := clientKey, serverKey
+	if isServer {
+		sealKey, openKey = serverKey, clientKey
+	}
+	seal, err := newAEAD(cipherName, sealKey)
+	if err != nil {
+		return nil, err
+	}
+	open, err := newAEAD(cipherName, openKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cryptoCodec{
+		codec:      codec,
+		seal:       seal,
+		open:       open,
+		headerFlag: carriesHeader(codec),
+	}, nil
+}
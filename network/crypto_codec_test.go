@@ -0,0 +1,117 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestEncryptionHandshake(t *testing.T) {
+	for _, codec := range []FrameCodec{NewMsgParser(), NewVersionedCodec()} {
+		c, s := net.Pipe()
+
+		done := make(chan FrameCodec, 1)
+		go func() {
+			codec, err := (&EncryptionHandshake{Ciphers: []string{CipherChaCha20, CipherAESGCM}}).Handshake(s, codec, true)
+			if err != nil {
+				t.Error(err)
+			}
+			done <- codec
+		}()
+		clientCodec, err := (&EncryptionHandshake{}).Handshake(c, codec, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverCodec := <-done
+		c.Close()
+		s.Close()
+
+		msg := []byte("secret message")
+		buf, err := clientCodec.PackFrame(nil, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(buf, msg) {
+			t.Fatal("frame not encrypted")
+		}
+		_, data, err := serverCodec.ReadFrame(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, msg) {
+			t.Fatal("unexpected decrypted data")
+		}
+
+		// the same frame again is a replay
+		if _, _, err := serverCodec.ReadFrame(bytes.NewReader(buf)); err != ErrReplayedFrame {
+			t.Fatalf("replayed frame, got error %v", err)
+		}
+
+		// frames of the server are sealed with another key
+		buf, err = serverCodec.PackFrame(nil, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := serverCodec.ReadFrame(bytes.NewReader(buf)); err == nil {
+			t.Fatal("reflected frame accepted")
+		}
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, n := range []uint64{1, 3, 2, 70} {
+		if !w.check(n) {
+			t.Fatalf("counter %d rejected", n)
+		}
+		w.accept(n)
+	}
+	for _, n := range []uint64{0, 1, 2, 3, 70} {
+		if w.check(n) {
+			t.Fatalf("counter %d accepted twice", n)
+		}
+	}
+	if !w.check(69) {
+		t.Fatal("counter 69 rejected")
+	}
+}
+
+func TestEncryptionHandshake_ConcurrentWriters(t *testing.T) {
+	c, s := net.Pipe()
+	done := make(chan FrameCodec, 1)
+	go func() {
+		codec, err := (&EncryptionHandshake{}).Handshake(s, NewMsgParser(), true)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- codec
+	}()
+	clientCodec, err := (&EncryptionHandshake{}).Handshake(c, NewMsgParser(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	// more writers than the replay window, the frames must reach the peer in the counter order
+	const writers, msgs = 4 * replayWindowSize, 10
+	conn := newTCPConn(c, (&connConfig{pendingWriteNum: writers * msgs}).init(), clientCodec)
+	defer conn.Destroy()
+	for i := 0; i < writers; i++ {
+		go func() {
+			for j := 0; j < msgs; j++ {
+				conn.WriteMsg(bytes.Repeat([]byte("secret"), 500))
+			}
+		}()
+	}
+	parser := NewMsgParser()
+	for i := 1; i <= writers*msgs; i++ {
+		b, err := parser.Read(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counter := binary.BigEndian.Uint64(b); counter != uint64(i) {
+			t.Fatalf("frame %d has counter %d", i, counter)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+)
+
+// FakeClient is a scripted client for testing agents, it writes and expects framed messages on a conn,
+// mostly one dialed from a PipeListener, with faults injected.
+// the expectations fail after Timeout, 5s by default
+// goroutine not safe
+type FakeClient struct {
+	Timeout time.Duration
+	conn    net.Conn
+	codec   FrameCodec
+}
+
+// NewFakeClient frames by codec, nil frames like a TCPClient by default
+func NewFakeClient(conn net.Conn, codec FrameCodec, faults Faults) *FakeClient {
+	if codec == nil {
+		codec = NewMsgParser()
+	}
+	return &FakeClient{
+		Timeout: 5 * time.Second,
+		conn:    NewFaultConn(conn, faults),
+		codec:   codec,
+	}
+}
+
+func (c *FakeClient) Conn() net.Conn {
+	return c.conn
+}
+
+func (c *FakeClient) Send(args ...[]byte) error {
+	return c.SendFrame(nil, args...)
+}
+
+func (c *FakeClient) SendFrame(h *FrameHeader, args ...[]byte) error {
+	b, err := c.codec.PackFrame(h, args...)
+	if err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	_, err = c.conn.Write(b)
+	return err
+}
+
+// Recv reads the next message, the heartbeats are skipped
+func (c *FakeClient) Recv() ([]byte, error) {
+	_, msg, err := c.RecvFrame()
+	return msg, err
+}
+
+func (c *FakeClient) RecvFrame() (*FrameHeader, []byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	for {
+		h, msg, err := c.codec.ReadFrame(c.conn)
+		if err != nil {
+			return nil, nil, err
+		}
+		if h != nil && h.Flags&FlagHeartbeat != 0 {
+			continue
+		}
+		return h, msg, nil
+	}
+}
+
+// Expect reads the next message and fails unless it is want
+func (c *FakeClient) Expect(want []byte) error {
+	msg, err := c.Recv()
+	if err != nil {
+		return fmt.Errorf("expect %q: %w", want, err)
+	}
+	if !bytes.Equal(msg, want) {
+		return fmt.Errorf("expect %q, received %q", want, msg)
+	}
+	return nil
+}
+
+// Roundtrip sends msg and expects want
+func (c *FakeClient) Roundtrip(msg, want []byte) error {
+	if err := c.Send(msg); err != nil {
+		return err
+	}
+	return c.Expect(want)
+}
+
+// ExpectClosed fails unless the peer closes the conn before Timeout, the messages before are skipped
+func (c *FakeClient) ExpectClosed() error {
+	c.conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	for {
+		_, _, err := c.codec.ReadFrame(c.conn)
+		if err == nil {
+			continue
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return fmt.Errorf("expect closed: %w", err)
+		}
+		return nil
+	}
+}
+
+// Abort closes the conn abruptly
+func (c *FakeClient) Abort() error {
+	return abortConn(c.conn)
+}
+
+func (c *FakeClient) Close() error {
+	return c.conn.Close()
+}
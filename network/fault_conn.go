@@ -0,0 +1,84 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Faults are injected into the io of a conn by NewFaultConn, the zero value injects none
+type Faults struct {
+	// Latency delays every write
+	Latency time.Duration
+	// Fragment writes one byte at a time
+	Fragment bool
+	// ReadDelay delays every read like a slow reader
+	ReadDelay time.Duration
+	// CloseAfter closes the conn abruptly once that many bytes are written, 0 never
+	CloseAfter int
+}
+
+type faultConn struct {
+	net.Conn
+	faults  Faults
+	mu      sync.Mutex
+	written int
+}
+
+// NewFaultConn returns conn with faults injected
+func NewFaultConn(conn net.Conn, faults Faults) net.Conn {
+	return &faultConn{Conn: conn, faults: faults}
+}
+
+func (c *faultConn) Read(b []byte) (int, error) {
+	if c.faults.ReadDelay > 0 {
+		time.Sleep(c.faults.ReadDelay)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.faults.Latency > 0 {
+		time.Sleep(c.faults.Latency)
+	}
+
+	closing := false
+	if c.faults.CloseAfter > 0 && c.written+len(b) >= c.faults.CloseAfter {
+		b = b[:c.faults.CloseAfter-c.written]
+		closing = true
+	}
+
+	var n int
+	for n < len(b) {
+		end := len(b)
+		if c.faults.Fragment {
+			end = n + 1
+		}
+		m, err := c.Conn.Write(b[n:end])
+		n += m
+		if err != nil {
+			c.written += n
+			return n, err
+		}
+	}
+	c.written += n
+
+	if closing {
+		abortConn(c.Conn)
+		return n, net.ErrClosed
+	}
+	return n, nil
+}
+
+func (c *faultConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// abortConn closes conn without the graceful tcp close
+func abortConn(conn net.Conn) error {
+	setLinger0(conn)
+	return conn.Close()
+}
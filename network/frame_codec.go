@@ -0,0 +1,107 @@
+package network
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrTraceUnsupported = errors.New("codec does not support trace")
+	// the message is out of the length limits of the codec
+	ErrMsgTooLong  = errors.New("message too long")
+	ErrMsgTooShort = errors.New("message too short")
+	// the trace header does not fit the frame or the trace id is over 255 bytes
+	ErrBadTraceHeader = errors.New("bad trace header")
+	// the frame version is 0 or newer than FrameVersionLatest
+	ErrUnsupportedVersion = errors.New("unsupported frame version")
+	// the meta does not fit the frame
+	ErrBadMetaHeader = errors.New("bad meta header")
+	// a meta value or the whole meta is over 65535 bytes
+	ErrMetaTooLong = errors.New("meta too long")
+)
+
+// frame flags, only codecs which carry a header keep them on the wire
+const (
+	FlagCompressed uint16 = 1 << iota
+	FlagEncrypted
+	FlagTrace
+	FlagMeta
+	FlagHeartbeat
+)
+
+// FrameHeader is the optional per frame header, codecs without header return nil on reading
+// and ignore it on packing
+type FrameHeader struct {
+	MsgId   uint32
+	Flags   uint16
+	Seq     uint32
+	Version uint8
+	TraceId string
+	Meta    FrameMeta
+}
+
+// FrameMeta is the TLV metadata section of a versioned frame
+type FrameMeta map[uint8][]byte
+
+// FrameCodec splits the byte stream of a connection into frames
+type FrameCodec interface {
+	// must goroutine safe
+	ReadFrame(r io.Reader) (*FrameHeader, []byte, error)
+	// must goroutine safe, h may be nil, the frame returned belongs to the caller,
+	// TCPConn puts it back by PutBuffer once written so it must not be kept by the codec
+	PackFrame(h *FrameHeader, args ...[]byte) ([]byte, error)
+}
+
+// TraceCodec is implemented by codecs which can carry the trace id of the current goroutine
+type TraceCodec interface {
+	ReadWithTrace(r io.Reader) ([]byte, error)
+	PackMsgWithTrace(args ...[]byte) ([]byte, error)
+}
+
+// traceFrameReader reads the trace frames with the heartbeats kept, so the conn can answer them
+type traceFrameReader interface {
+	readTraceFrame(r io.Reader) (*FrameHeader, []byte, error)
+}
+
+func readSkipHeartbeats(r io.Reader, read func(r io.Reader) (*FrameHeader, []byte, error)) ([]byte, error) {
+	for {
+		h, b, err := read(r)
+		if err != nil {
+			return nil, err
+		}
+		if h == nil || h.Flags&FlagHeartbeat == 0 {
+			return b, nil
+		}
+	}
+}
+
+// HeartbeatCodec is implemented by codecs which can tell heartbeat frames apart from messages,
+// ReadFrame returns heartbeat frames with FlagHeartbeat set
+type HeartbeatCodec interface {
+	PackHeartbeat() ([]byte, error)
+}
+
+// HeaderCarrier is implemented by codecs which keep the FrameHeader on the wire
+type HeaderCarrier interface {
+	CarriesHeader() bool
+}
+
+func carriesHeader(codec FrameCodec) bool {
+	hc, ok := codec.(HeaderCarrier)
+	return ok && hc.CarriesHeader()
+}
+
+// findCodec returns the first codec matched in the chain of wrapped codecs
+func findCodec(codec FrameCodec, match func(codec FrameCodec) bool) FrameCodec {
+	for codec != nil {
+		if match(codec) {
+			return codec
+		}
+		u, ok := codec.(interface{ Unwrap() FrameCodec })
+		if !ok {
+			return nil
+		}
+		codec = u.Unwrap()
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestFrameCodec_RoundTrip(t *testing.T) {
+	codecs := map[string]FrameCodec{
+		"len":    NewMsgParser(),
+		"varint": NewVarintCodec(),
+		"header": NewHeaderCodec(),
+		"ver":    NewVersionedCodec(),
+	}
+	for name, codec := range codecs {
+		h := &FrameHeader{MsgId: 101, Flags: FlagTrace, Seq: 7}
+		buf, err := codec.PackFrame(h, []byte("hello "), []byte("world"))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		rh, data, err := codec.ReadFrame(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(data) != "hello world" {
+			t.Fatalf("%s: unexpected data %q", name, data)
+		}
+		if _, ok := codec.(*HeaderCodec); ok && (rh.MsgId != h.MsgId || rh.Flags != h.Flags || rh.Seq != h.Seq) {
+			t.Fatalf("%s: unexpected header %+v", name, rh)
+		}
+	}
+}
+
+func TestFrameCodec_Heartbeat(t *testing.T) {
+	for name, codec := range map[string]interface {
+		FrameCodec
+		HeartbeatCodec
+		SetHeartbeat(enabled bool)
+	}{
+		"len":    NewMsgParser(),
+		"varint": NewVarintCodec(),
+	} {
+		hb, err := codec.PackHeartbeat()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, _, err := codec.ReadFrame(bytes.NewReader(hb)); !errors.Is(err, ErrMsgTooShort) {
+			t.Fatalf("%s: zero len without heartbeats: %v", name, err)
+		}
+		codec.SetHeartbeat(true)
+		if h, _, err := codec.ReadFrame(bytes.NewReader(hb)); err != nil || h == nil || h.Flags&FlagHeartbeat == 0 {
+			t.Fatalf("%s: heartbeat read as %+v: %v", name, h, err)
+		}
+	}
+
+	// the trace path skips the heartbeats too
+	codec := NewVersionedCodec()
+	hb, _ := codec.PackHeartbeat()
+	msg, _ := codec.PackMsgWithTrace([]byte("data"))
+	data, err := codec.ReadWithTrace(bytes.NewReader(append(hb, msg...)))
+	if err != nil || string(data) != "data" {
+		t.Fatalf("read %q: %v", data, err)
+	}
+}
+
+func TestVersionedCodec_Meta(t *testing.T) {
+	codec := NewVersionedCodec()
+	meta := FrameMeta{1: []byte("uid"), 9: []byte{}}
+	buf, err := codec.PackFrame(&FrameHeader{Flags: FlagCompressed, TraceId: "t-1", Meta: meta}, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, data, err := codec.ReadFrame(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "data" || h.TraceId != "t-1" || h.Version != FrameVersionLatest {
+		t.Fatalf("unexpected frame %+v %q", h, data)
+	}
+	if h.Flags != FlagCompressed|FlagTrace|FlagMeta || string(h.Meta[1]) != "uid" || len(h.Meta) != 2 {
+		t.Fatalf("unexpected header %+v", h)
+	}
+}
+
+func TestVersionedCodec_Errors(t *testing.T) {
+	codec := NewVersionedCodec()
+	for _, tc := range []struct {
+		name    string
+		frame   []byte
+		wantErr error
+	}{
+		{"too short", []byte{0, 0, 0, 2, 1, 0}, ErrMsgTooShort},
+		{"version 0", []byte{0, 0, 0, 3, 0, 0, 0}, ErrUnsupportedVersion},
+		{"newer version", []byte{0, 0, 0, 3, FrameVersionLatest + 1, 0, 0}, ErrUnsupportedVersion},
+		{"meta over frame", []byte{0, 0, 0, 5, 1, 0, 8, 0, 5}, ErrBadMetaHeader},
+		{"meta value over meta", []byte{0, 0, 0, 8, 1, 0, 8, 0, 3, 1, 0, 9}, ErrBadMetaHeader},
+	} {
+		if _, _, err := codec.ReadFrame(bytes.NewReader(tc.frame)); !errors.Is(err, tc.wantErr) {
+			t.Fatalf("%s: got %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+
+	h := &FrameHeader{Meta: FrameMeta{1: make([]byte, 0x10000)}}
+	if _, err := codec.PackFrame(h, nil); !errors.Is(err, ErrMetaTooLong) {
+		t.Fatalf("pack long meta value: %v", err)
+	}
+	meta := FrameMeta{}
+	for i := 0; i < 3; i++ {
+		meta[uint8(i)] = make([]byte, 0x8000)
+	}
+	if _, err := codec.PackFrame(&FrameHeader{Meta: meta}, nil); !errors.Is(err, ErrMetaTooLong) {
+		t.Fatalf("pack long meta: %v", err)
+	}
+}
+
+func TestVersionHandshake(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := (&VersionHandshake{}).Handshake(s, NewVersionedCodec(), true)
+		done <- err
+	}()
+
+	codec, err := (&VersionHandshake{}).Handshake(c, NewVersionedCodec(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if codec.(*VersionedCodec).Version() != FrameVersionLatest {
+		t.Fatalf("unexpected version %d", codec.(*VersionedCodec).Version())
+	}
+}
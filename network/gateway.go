@@ -0,0 +1,595 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gzjjyz/logger"
+)
+
+var (
+	ErrNoBackend            = errors.New("no backend connected")
+	ErrGatewaySessionClosed = errors.New("gateway session closed")
+	errGatewayFrame         = errors.New("invalid gateway frame")
+)
+
+// the frames on the links between a gateway and its backends
+// --------------------------------------------
+// | kind(1) | session id(8) | payload |
+// | kind(1) | count(2) | session ids(8 each) | payload |  multicast
+// | kind(1) | payload |                                   broadcast
+// --------------------------------------------
+const (
+	// gateway -> backend, the payload is the client ip
+	gatewayOpen byte = iota
+	gatewayData
+	// the gateway tells the client left or the backend kicks the session
+	gatewayClose
+	// backend -> gateway
+	gatewayMulticast
+	gatewayBroadcast
+)
+
+const (
+	gatewayHeaderLen     = 9
+	gatewayMulticastMax  = 0xffff
+	gatewayMulticastHead = 3
+)
+
+func gatewayHeader(kind byte, id uint64) []byte {
+	b := make([]byte, gatewayHeaderLen)
+	b[0] = kind
+	binary.BigEndian.PutUint64(b[1:], id)
+	return b
+}
+
+type gatewaySession struct {
+	id   uint64
+	conn Conn
+	link *TCPConn
+}
+
+// Gateway relays the client conns of TCPServer or WSServer to the backends, each client session is bound to a backend
+// by Route and the sessions share a few links to every backend, tagged by their session ids.
+// the backends serve the sessions by GatewayBackend, a client leaving closes its session on the backend,
+// a backend closing a session or its link closes the client conns
+// goroutine safe
+type Gateway struct {
+	Backends []string
+	// NewClient returns the client of the links to a backend, its NewAgent is set by the gateway,
+	// nil connects one link with AutoReconnect
+	NewClient func(addr string) *TCPClient
+	// Route picks the backend of a new client session among the connected ones, nil spreads the sessions by id
+	Route func(conn Conn, backends []string) string
+
+	mu       sync.Mutex
+	clients  []*TCPClient
+	links    map[string][]*TCPConn
+	sessions map[uint64]*gatewaySession
+	nextId   atomic.Uint64
+}
+
+func (gw *Gateway) Start() {
+	gw.mu.Lock()
+	gw.links = make(map[string][]*TCPConn)
+	gw.sessions = make(map[uint64]*gatewaySession)
+	gw.mu.Unlock()
+
+	for _, addr := range gw.Backends {
+		var client *TCPClient
+		if gw.NewClient != nil {
+			client = gw.NewClient(addr)
+		} else {
+			client = &TCPClient{Addr: addr, AutoReconnect: true}
+		}
+		backend := addr
+		client.NewAgent = func(conn *TCPConn) Agent {
+			return &gatewayLinkAgent{gw: gw, backend: backend, conn: conn}
+		}
+		gw.clients = append(gw.clients, client)
+		client.Start()
+	}
+}
+
+// NewAgent returns the agent of a client conn, it is the NewAgent of the servers
+func (gw *Gateway) NewAgent(conn Conn) Agent {
+	return &gatewayClientAgent{gw: gw, conn: conn}
+}
+
+// Count returns how many client sessions are relayed
+func (gw *Gateway) Count() int {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return len(gw.sessions)
+}
+
+// Close closes the links, which closes the client sessions
+func (gw *Gateway) Close() {
+	for _, client := range gw.clients {
+		client.Close()
+	}
+}
+
+func (gw *Gateway) open(conn Conn) (*gatewaySession, error) {
+	id := gw.nextId.Add(1)
+
+	gw.mu.Lock()
+	backends := make([]string, 0, len(gw.links))
+	for _, addr := range gw.Backends {
+		if len(gw.links[addr]) > 0 {
+			backends = append(backends, addr)
+		}
+	}
+	if len(backends) == 0 {
+		gw.mu.Unlock()
+		return nil, ErrNoBackend
+	}
+	backend := backends[id%uint64(len(backends))]
+	if gw.Route != nil {
+		backend = gw.Route(conn, backends)
+	}
+	links := gw.links[backend]
+	if len(links) == 0 {
+		gw.mu.Unlock()
+		return nil, ErrNoBackend
+	}
+	s := &gatewaySession{id: id, conn: conn, link: links[id%uint64(len(links))]}
+	gw.sessions[id] = s
+	gw.mu.Unlock()
+
+	return s, s.link.WriteMsg(gatewayHeader(gatewayOpen, id), []byte(addrHost(conn.RemoteAddrWithoutPort())))
+}
+
+// remove reports whether s was relayed
+func (gw *Gateway) remove(s *gatewaySession) bool {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	if gw.sessions[s.id] != s {
+		return false
+	}
+	delete(gw.sessions, s.id)
+	return true
+}
+
+func (gw *Gateway) addLink(backend string, link *TCPConn) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	gw.links[backend] = append(gw.links[backend], link)
+}
+
+// removeLink closes the client sessions relayed by link
+func (gw *Gateway) removeLink(backend string, link *TCPConn) {
+	gw.mu.Lock()
+	links := gw.links[backend]
+	for i, l := range links {
+		if l == link {
+			gw.links[backend] = append(links[:i:i], links[i+1:]...)
+			break
+		}
+	}
+	var sessions []*gatewaySession
+	for id, s := range gw.sessions {
+		if s.link == link {
+			sessions = append(sessions, s)
+			delete(gw.sessions, id)
+		}
+	}
+	gw.mu.Unlock()
+
+	for _, s := range sessions {
+		s.conn.Close()
+	}
+}
+
+func (gw *Gateway) session(id uint64) *gatewaySession {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.sessions[id]
+}
+
+// handle relays a frame of the backend
+func (gw *Gateway) handle(link *TCPConn, b []byte) error {
+	if len(b) < 1 {
+		return errGatewayFrame
+	}
+	switch b[0] {
+	case gatewayData, gatewayClose:
+		if len(b) < gatewayHeaderLen {
+			return errGatewayFrame
+		}
+		s := gw.session(binary.BigEndian.Uint64(b[1:]))
+		if s == nil || s.link != link {
+			return nil
+		}
+		if b[0] == gatewayData {
+			s.conn.WriteMsg(b[gatewayHeaderLen:])
+		} else if gw.remove(s) {
+			s.conn.Close()
+		}
+	case gatewayMulticast:
+		if len(b) < gatewayMulticastHead {
+			return errGatewayFrame
+		}
+		n := int(binary.BigEndian.Uint16(b[1:]))
+		payload := gatewayMulticastHead + 8*n
+		if len(b) < payload {
+			return errGatewayFrame
+		}
+		for i := 0; i < n; i++ {
+			s := gw.session(binary.BigEndian.Uint64(b[gatewayMulticastHead+8*i:]))
+			if s != nil && s.link == link {
+				s.conn.WriteMsg(b[payload:])
+			}
+		}
+	case gatewayBroadcast:
+		gw.mu.Lock()
+		conns := make([]Conn, 0, len(gw.sessions))
+		for _, s := range gw.sessions {
+			if s.link == link {
+				conns = append(conns, s.conn)
+			}
+		}
+		gw.mu.Unlock()
+		for _, conn := range conns {
+			conn.WriteMsg(b[1:])
+		}
+	default:
+		return errGatewayFrame
+	}
+	return nil
+}
+
+type gatewayClientAgent struct {
+	gw      *Gateway
+	conn    Conn
+	session *gatewaySession
+}
+
+func (a *gatewayClientAgent) Run() {
+	s, err := a.gw.open(a.conn)
+	if s != nil {
+		a.session = s
+	}
+	if err != nil {
+		logger.LogDebug("gateway open session of %v error: %v", a.conn.RemoteAddr(), err)
+		return
+	}
+
+	for {
+		msg, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		if err := s.link.WriteMsg(gatewayHeader(gatewayData, s.id), msg); err != nil {
+			logger.LogDebug("gateway relay error: %v", err)
+			return
+		}
+	}
+}
+
+func (a *gatewayClientAgent) OnClose() {
+	if s := a.session; s != nil && a.gw.remove(s) {
+		s.link.WriteMsg(gatewayHeader(gatewayClose, s.id))
+	}
+}
+
+type gatewayLinkAgent struct {
+	gw      *Gateway
+	backend string
+	conn    *TCPConn
+}
+
+func (a *gatewayLinkAgent) Run() {
+	a.gw.addLink(a.backend, a.conn)
+	for {
+		b, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		if err := a.gw.handle(a.conn, b); err != nil {
+			logger.LogError("gateway link to %v error: %v", a.backend, err)
+			return
+		}
+	}
+}
+
+func (a *gatewayLinkAgent) OnClose() {
+	a.gw.removeLink(a.backend, a.conn)
+}
+
+type gatewayAddr string
+
+func (a gatewayAddr) Network() string {
+	return "gateway"
+}
+
+func (a gatewayAddr) String() string {
+	return string(a)
+}
+
+// GatewayConn is a client session relayed by a gateway, as seen by the backend
+type GatewayConn struct {
+	id uint64
+	// gwId tags the session on the link, the ids of the gateways overlap
+	gwId      uint64
+	link      *TCPConn
+	ip        string
+	inbox     chan []byte
+	die       chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+	reason    CloseReason
+}
+
+// Id is the session id given by the backend, unique among the sessions of all the gateways
+func (c *GatewayConn) Id() uint64 {
+	return c.id
+}
+
+// goroutine not safe
+func (c *GatewayConn) ReadMsg() ([]byte, error) {
+	select {
+	case b := <-c.inbox:
+		return b, nil
+	case <-c.die:
+		return nil, ErrGatewaySessionClosed
+	}
+}
+
+func (c *GatewayConn) WriteMsg(args ...[]byte) error {
+	select {
+	case <-c.die:
+		return ErrGatewaySessionClosed
+	default:
+	}
+	return c.link.WriteMsg(append([][]byte{gatewayHeader(gatewayData, c.gwId)}, args...)...)
+}
+
+func (c *GatewayConn) LocalAddr() net.Addr {
+	return c.link.LocalAddr()
+}
+
+// RemoteAddr is the client ip the gateway tells
+func (c *GatewayConn) RemoteAddr() net.Addr {
+	return gatewayAddr(c.ip)
+}
+
+func (c *GatewayConn) RemoteAddrWithoutPort() string {
+	return c.ip
+}
+
+// Stats are the ones of the link the session is relayed by
+func (c *GatewayConn) Stats() ConnStats {
+	return c.link.Stats()
+}
+
+// Close closes the client conn on the gateway
+func (c *GatewayConn) Close() {
+	c.end(CloseLocal)
+}
+
+func (c *GatewayConn) Destroy() {
+	c.end(CloseDestroy)
+}
+
+// end tells the gateway unless the gateway ended the session, because the client left or the link is gone
+func (c *GatewayConn) end(reason CloseReason) {
+	c.closeOnce.Do(func() {
+		c.reason = reason
+		close(c.die)
+		if reason == CloseLocal || reason == CloseDestroy {
+			c.link.WriteMsg(gatewayHeader(gatewayClose, c.gwId))
+		}
+		c.onClose()
+	})
+}
+
+// GatewayBackend serves the client sessions a Gateway relays, its link agents serve the conns of the TCPServer
+// the gateway connects to, and every session is a GatewayConn served by its own agent in its own goroutine.
+// a slow session holds up the others of its link
+// goroutine safe
+type GatewayBackend struct {
+	NewAgent func(*GatewayConn) Agent
+
+	mu       sync.Mutex
+	sessions map[uint64]*GatewayConn
+	nextId   uint64
+	wg       sync.WaitGroup
+}
+
+func NewGatewayBackend(newAgent func(*GatewayConn) Agent) *GatewayBackend {
+	return &GatewayBackend{
+		NewAgent: newAgent,
+		sessions: make(map[uint64]*GatewayConn),
+	}
+}
+
+// NewLinkAgent returns the agent of a link from a gateway, it is the NewAgent of the TCPServer
+func (b *GatewayBackend) NewLinkAgent(conn *TCPConn) Agent {
+	return &gatewayBackendAgent{backend: b, link: conn, sessions: make(map[uint64]*GatewayConn)}
+}
+
+func (b *GatewayBackend) Get(id uint64) (*GatewayConn, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.sessions[id]
+	return c, ok
+}
+
+func (b *GatewayBackend) Count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.sessions)
+}
+
+// Multicast writes to the sessions of ids, a frame per link, the unknown ids are skipped
+func (b *GatewayBackend) Multicast(ids []uint64, args ...[]byte) error {
+	byLink := make(map[*TCPConn][]uint64)
+	b.mu.Lock()
+	for _, id := range ids {
+		if c, ok := b.sessions[id]; ok {
+			byLink[c.link] = append(byLink[c.link], c.gwId)
+		}
+	}
+	b.mu.Unlock()
+
+	for link, ids := range byLink {
+		for len(ids) > 0 {
+			n := len(ids)
+			if n > gatewayMulticastMax {
+				n = gatewayMulticastMax
+			}
+			head := make([]byte, gatewayMulticastHead+8*n)
+			head[0] = gatewayMulticast
+			binary.BigEndian.PutUint16(head[1:], uint16(n))
+			for i, id := range ids[:n] {
+				binary.BigEndian.PutUint64(head[gatewayMulticastHead+8*i:], id)
+			}
+			if err := link.WriteMsg(append([][]byte{head}, args...)...); err != nil {
+				return err
+			}
+			ids = ids[n:]
+		}
+	}
+	return nil
+}
+
+// Broadcast writes to all the sessions, a frame per link
+func (b *GatewayBackend) Broadcast(args ...[]byte) error {
+	links := make(map[*TCPConn]struct{})
+	b.mu.Lock()
+	for _, c := range b.sessions {
+		links[c.link] = struct{}{}
+	}
+	b.mu.Unlock()
+
+	for link := range links {
+		if err := link.WriteMsg(append([][]byte{{gatewayBroadcast}}, args...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the sessions and waits for their agents
+func (b *GatewayBackend) Close() {
+	b.mu.Lock()
+	sessions := make([]*GatewayConn, 0, len(b.sessions))
+	for _, c := range b.sessions {
+		sessions = append(sessions, c)
+	}
+	b.mu.Unlock()
+
+	for _, c := range sessions {
+		c.Close()
+	}
+	b.wg.Wait()
+}
+
+type gatewayBackendAgent struct {
+	backend *GatewayBackend
+	link    *TCPConn
+	// the sessions of the link by the ids of the gateway, they are removed by the session agents
+	mu       sync.Mutex
+	sessions map[uint64]*GatewayConn
+}
+
+func (a *gatewayBackendAgent) Run() {
+	for {
+		b, err := a.link.ReadMsg()
+		if err != nil {
+			return
+		}
+		if len(b) < gatewayHeaderLen {
+			logger.LogError("gateway link from %v error: %v", a.link.RemoteAddr(), errGatewayFrame)
+			return
+		}
+		id := binary.BigEndian.Uint64(b[1:])
+		switch b[0] {
+		case gatewayOpen:
+			a.open(id, string(b[gatewayHeaderLen:]))
+		case gatewayData:
+			if c, ok := a.session(id); ok {
+				select {
+				case c.inbox <- b[gatewayHeaderLen:]:
+				case <-c.die:
+				}
+			}
+		case gatewayClose:
+			if c, ok := a.session(id); ok {
+				c.end(ClosePeerEOF)
+			}
+		default:
+			logger.LogError("gateway link from %v error: %v", a.link.RemoteAddr(), errGatewayFrame)
+			return
+		}
+	}
+}
+
+func (a *gatewayBackendAgent) session(gwId uint64) (*GatewayConn, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.sessions[gwId]
+	return c, ok
+}
+
+func (a *gatewayBackendAgent) open(gwId uint64, ip string) {
+	b := a.backend
+	b.mu.Lock()
+	b.nextId++
+	id := b.nextId
+	b.mu.Unlock()
+
+	c := &GatewayConn{
+		id:    id,
+		gwId:  gwId,
+		link:  a.link,
+		ip:    ip,
+		inbox: make(chan []byte, 64),
+		die:   make(chan struct{}),
+	}
+	// by the link agent or the session agent, whichever ends the session
+	c.onClose = func() {
+		a.mu.Lock()
+		if a.sessions[gwId] == c {
+			delete(a.sessions, gwId)
+		}
+		a.mu.Unlock()
+		b.mu.Lock()
+		delete(b.sessions, id)
+		b.mu.Unlock()
+	}
+	a.mu.Lock()
+	a.sessions[gwId] = c
+	a.mu.Unlock()
+	b.mu.Lock()
+	b.sessions[id] = c
+	b.mu.Unlock()
+
+	agent := b.NewAgent(c)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		runAgent(context.Background(), agent, c.die)
+		c.Close()
+		closeAgent(agent, c.reason)
+	}()
+}
+
+// OnClose ends the sessions of the link
+func (a *gatewayBackendAgent) OnClose() {
+	a.mu.Lock()
+	sessions := make([]*GatewayConn, 0, len(a.sessions))
+	for _, c := range a.sessions {
+		sessions = append(sessions, c)
+	}
+	a.mu.Unlock()
+
+	for _, c := range sessions {
+		c.end(CloseError)
+	}
+}
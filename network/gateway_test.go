@@ -0,0 +1,271 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+type gatewayEchoAgent struct {
+	backend *GatewayBackend
+	conn    *GatewayConn
+}
+
+func (a *gatewayEchoAgent) Run() {
+	for {
+		msg, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		switch s := string(msg); {
+		case s == "kick":
+			return
+		case strings.HasPrefix(s, "all:"):
+			a.backend.Broadcast(msg[4:])
+		case strings.HasPrefix(s, "group:"):
+			a.backend.Multicast([]uint64{a.conn.Id()}, msg[6:])
+		default:
+			a.conn.WriteMsg(msg)
+		}
+	}
+}
+
+func (a *gatewayEchoAgent) OnClose() {}
+
+func newGatewayTest(t *testing.T) (*Gateway, *GatewayBackend, *PipeListener, func()) {
+	backend, backendLn, stopBackend := newGatewayTestBackend()
+	gw, ln, stopGateway := newGatewayTestFront(t, backendLn)
+	return gw, backend, ln, func() {
+		stopGateway()
+		stopBackend()
+	}
+}
+
+func newGatewayTestBackend() (*GatewayBackend, *PipeListener, func()) {
+	backendLn := NewPipeListener()
+	backend := NewGatewayBackend(nil)
+	backend.NewAgent = func(conn *GatewayConn) Agent {
+		return &gatewayEchoAgent{backend: backend, conn: conn}
+	}
+	backendServer := &TCPServer{
+		Listener: backendLn,
+		NewAgent: func(conn *TCPConn) Agent {
+			return backend.NewLinkAgent(conn)
+		},
+	}
+	backendServer.Start()
+
+	return backend, backendLn, func() {
+		backend.Close()
+		backendServer.Close()
+	}
+}
+
+func newGatewayTestFront(t *testing.T, backendLn *PipeListener) (*Gateway, *PipeListener, func()) {
+	var clients []*TCPClient
+	gw := &Gateway{
+		Backends: []string{"backend"},
+		NewClient: func(addr string) *TCPClient {
+			client := &TCPClient{Addr: addr, ConnNum: 2, AutoReconnect: true, Dial: backendLn.DialContext}
+			clients = append(clients, client)
+			return client
+		},
+	}
+	gw.Start()
+	for _, client := range clients {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := client.Ready(ctx); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+	}
+	// both links are served
+	time.Sleep(20 * time.Millisecond)
+
+	ln := NewPipeListener()
+	server := &TCPServer{
+		Listener: ln,
+		NewAgent: func(conn *TCPConn) Agent {
+			return gw.NewAgent(conn)
+		},
+	}
+	server.Start()
+
+	return gw, ln, func() {
+		server.Close()
+		gw.Close()
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
+
+func TestGateway_Relay(t *testing.T) {
+	gw, backend, ln, stop := newGatewayTest(t)
+	defer stop()
+
+	var clients []*FakeClient
+	for i := 0; i < 4; i++ {
+		conn, err := ln.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := NewFakeClient(conn, nil, Faults{})
+		if err := c.Roundtrip([]byte("hello"), []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+	}
+	if gw.Count() != 4 || backend.Count() != 4 {
+		t.Fatalf("sessions %v %v", gw.Count(), backend.Count())
+	}
+
+	// a session gets only its own messages
+	if err := clients[1].Roundtrip([]byte("group:one"), []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+
+	// broadcast reaches the sessions over both links
+	if err := clients[0].Send([]byte("all:news")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range clients {
+		if err := c.Expect([]byte("news")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the backend kicks a session
+	if err := clients[2].Send([]byte("kick")); err != nil {
+		t.Fatal(err)
+	}
+	if err := clients[2].ExpectClosed(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a client leaving closes its session on the backend
+	clients[3].Close()
+	waitFor(t, func() bool { return gw.Count() == 2 && backend.Count() == 2 })
+
+	if err := clients[0].Roundtrip([]byte("still"), []byte("still")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGateway_BackendDown(t *testing.T) {
+	gw, backend, ln, stop := newGatewayTest(t)
+	defer stop()
+
+	conn, _ := ln.Dial()
+	c := NewFakeClient(conn, nil, Faults{})
+	if err := c.Roundtrip([]byte("hello"), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the links going down close the client sessions they relay
+	gw.Close()
+	if err := c.ExpectClosed(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return backend.Count() == 0 })
+
+	conn, _ = ln.Dial()
+	c = NewFakeClient(conn, nil, Faults{})
+	if err := c.ExpectClosed(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGateway_TwoGateways(t *testing.T) {
+	backend, backendLn, stopBackend := newGatewayTestBackend()
+	defer stopBackend()
+	_, ln1, stop1 := newGatewayTestFront(t, backendLn)
+	defer stop1()
+	_, ln2, stop2 := newGatewayTestFront(t, backendLn)
+	defer stop2()
+
+	// both gateways number their sessions from 1
+	var clients []*FakeClient
+	for _, ln := range []*PipeListener{ln1, ln2} {
+		conn, err := ln.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := NewFakeClient(conn, nil, Faults{})
+		if err := c.Roundtrip([]byte("hello"), []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+	}
+	if n := backend.Count(); n != 2 {
+		t.Fatalf("%d sessions", n)
+	}
+	for i, c := range clients {
+		msg := []byte(fmt.Sprint("to", i))
+		if err := c.Roundtrip(append([]byte("group:"), msg...), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a session leaving keeps the other one
+	clients[0].Close()
+	waitFor(t, func() bool { return backend.Count() == 1 })
+	if err := clients[1].Roundtrip([]byte("still"), []byte("still")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGateway_LinkSessionsRemoved(t *testing.T) {
+	backendLn := NewPipeListener()
+	backend := NewGatewayBackend(nil)
+	backend.NewAgent = func(conn *GatewayConn) Agent {
+		return &gatewayEchoAgent{backend: backend, conn: conn}
+	}
+	links := make(chan *gatewayBackendAgent, 2)
+	backendServer := &TCPServer{
+		Listener: backendLn,
+		NewAgent: func(conn *TCPConn) Agent {
+			agent := backend.NewLinkAgent(conn)
+			links <- agent.(*gatewayBackendAgent)
+			return agent
+		},
+	}
+	backendServer.Start()
+	defer backendServer.Close()
+	defer backend.Close()
+	_, ln, stop := newGatewayTestFront(t, backendLn)
+	defer stop()
+
+	for i := 0; i < 4; i++ {
+		conn, _ := ln.Dial()
+		c := NewFakeClient(conn, nil, Faults{})
+		if err := c.Send([]byte("kick")); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.ExpectClosed(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return backend.Count() == 0 })
+
+	// the ended sessions are dropped by their links too
+	for i := 0; i < 2; i++ {
+		link := <-links
+		link.mu.Lock()
+		n := len(link.sessions)
+		link.mu.Unlock()
+		if n != 0 {
+			t.Fatalf("%d sessions left on a link", n)
+		}
+	}
+}
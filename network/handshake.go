@@ -0,0 +1,125 @@
+package network
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Handshaker negotiates the options of a connection before its agent is created,
+// it returns the codec the connection uses from then on
+type Handshaker interface {
+	Handshake(conn net.Conn, codec FrameCodec, isServer bool) (FrameCodec, error)
+}
+
+type HandshakerFunc func(conn net.Conn, codec FrameCodec, isServer bool) (FrameCodec, error)
+
+func (f HandshakerFunc) Handshake(conn net.Conn, codec FrameCodec, isServer bool) (FrameCodec, error) {
+	return f(conn, codec, isServer)
+}
+
+// ChainHandshakers runs the handshakers in order, each one receives the codec returned by the previous one
+func ChainHandshakers(handshakers ...Handshaker) Handshaker {
+	return HandshakerFunc(func(conn net.Conn, codec FrameCodec, isServer bool) (FrameCodec, error) {
+		var err error
+		for _, h := range handshakers {
+			codec, err = h.Handshake(conn, codec, isServer)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return codec, nil
+	})
+}
+
+// handshake also finishes the tls handshake of the accepted conns within the timeout
+func handshake(conn net.Conn, h Handshaker, codec FrameCodec, isServer bool, timeout time.Duration) (FrameCodec, error) {
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if h == nil && !isTLS {
+		return codec, nil
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if isTLS {
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+	}
+	if h == nil {
+		return codec, nil
+	}
+	return h.Handshake(conn, codec, isServer)
+}
+
+var versionMagic = [2]byte{'S', 'V'}
+
+// VersionHandshake negotiates the frame version of a VersionedCodec,
+// the client sends | magic(2) | min version | max version | and the server answers | magic(2) | version |,
+// version 0 means there is no version both peers support
+type VersionHandshake struct {
+	MinVersion uint8
+	MaxVersion uint8
+}
+
+func (vh *VersionHandshake) versions() (uint8, uint8) {
+	min, max := vh.MinVersion, vh.MaxVersion
+	if min == 0 {
+		min = FrameVersion1
+	}
+	if max == 0 || max > FrameVersionLatest {
+		max = FrameVersionLatest
+	}
+	return min, max
+}
+
+func (vh *VersionHandshake) Handshake(conn net.Conn, codec FrameCodec, isServer bool) (FrameCodec, error) {
+	versionedCodec, ok := codec.(*VersionedCodec)
+	if !ok {
+		return nil, errors.New("version handshake requires a VersionedCodec")
+	}
+
+	min, max := vh.versions()
+	if isServer {
+		var req [4]byte
+		if _, err := io.ReadFull(conn, req[:]); err != nil {
+			return nil, err
+		}
+		if req[0] != versionMagic[0] || req[1] != versionMagic[1] {
+			return nil, errors.New("bad version handshake")
+		}
+
+		version := max
+		if req[3] < version {
+			version = req[3]
+		}
+		if version < min || version < req[2] {
+			version = 0
+		}
+		if _, err := conn.Write([]byte{versionMagic[0], versionMagic[1], version}); err != nil {
+			return nil, err
+		}
+		if version == 0 {
+			return nil, errors.New("no frame version in common")
+		}
+		return versionedCodec.WithVersion(version), nil
+	}
+
+	if _, err := conn.Write([]byte{versionMagic[0], versionMagic[1], min, max}); err != nil {
+		return nil, err
+	}
+	var resp [3]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return nil, err
+	}
+	if resp[0] != versionMagic[0] || resp[1] != versionMagic[1] {
+		return nil, errors.New("bad version handshake")
+	}
+	if resp[2] == 0 || resp[2] < min || resp[2] > max {
+		return nil, errors.New("no frame version in common")
+	}
+	return versionedCodec.WithVersion(resp[2]), nil
+}
@@ -0,0 +1,90 @@
+package network
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const frameHeaderLen = 10
+
+// ------------------------------------------------
+// | len | msg id(4) | flags(2) | seq(4) | data |
+// ------------------------------------------------
+// len counts the header and the data
+type HeaderCodec struct {
+	parser       *MsgParser
+	littleEndian bool
+}
+
+func NewHeaderCodec() *HeaderCodec {
+	c := new(HeaderCodec)
+	c.parser = NewMsgParser()
+	c.parser.SetMsgLen(0, frameHeaderLen, 4096+frameHeaderLen)
+
+	return c
+}
+
+// It's dangerous to call the method on reading or writing, the min and max len don't count the header
+func (c *HeaderCodec) SetMsgLen(lenMsgLen int, minMsgLen uint32, maxMsgLen uint32) {
+	if minMsgLen != 0 {
+		minMsgLen += frameHeaderLen
+	}
+	if maxMsgLen != 0 {
+		maxMsgLen += frameHeaderLen
+		if maxMsgLen < frameHeaderLen {
+			maxMsgLen = ^uint32(0)
+		}
+	}
+	c.parser.SetMsgLen(lenMsgLen, minMsgLen, maxMsgLen)
+}
+
+// It's dangerous to call the method on reading or writing
+func (c *HeaderCodec) SetByteOrder(littleEndian bool) {
+	c.parser.SetByteOrder(littleEndian)
+	c.littleEndian = littleEndian
+}
+
+func (c *HeaderCodec) byteOrder() binary.ByteOrder {
+	if c.littleEndian {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// goroutine safe
+func (c *HeaderCodec) ReadFrame(r io.Reader) (*FrameHeader, []byte, error) {
+	msg, err := c.parser.Read(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the parser keeps the min len at frameHeaderLen at least
+	order := c.byteOrder()
+	h := &FrameHeader{
+		MsgId: order.Uint32(msg),
+		Flags: order.Uint16(msg[4:]),
+		Seq:   order.Uint32(msg[6:]),
+	}
+
+	return h, msg[frameHeaderLen:], nil
+}
+
+// goroutine safe
+func (c *HeaderCodec) PackFrame(h *FrameHeader, args ...[]byte) ([]byte, error) {
+	var header [frameHeaderLen]byte
+	if h != nil {
+		order := c.byteOrder()
+		order.PutUint32(header[:], h.MsgId)
+		order.PutUint16(header[4:], h.Flags)
+		order.PutUint32(header[6:], h.Seq)
+	}
+
+	return c.parser.PackMsg(append([][]byte{header[:]}, args...)...)
+}
+
+func (c *HeaderCodec) PackHeartbeat() ([]byte, error) {
+	return c.PackFrame(&FrameHeader{Flags: FlagHeartbeat})
+}
+
+func (c *HeaderCodec) CarriesHeader() bool {
+	return true
+}
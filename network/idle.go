@@ -0,0 +1,145 @@
+package network
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type IdleKind int
+
+const (
+	// IdleRead nothing was read for ReadIdleTimeout
+	IdleRead IdleKind = iota
+	// IdleWrite nothing was written for WriteIdleTimeout
+	IdleWrite
+	// IdleAll nothing was read or written for IdleTimeout
+	IdleAll
+)
+
+func (k IdleKind) String() string {
+	switch k {
+	case IdleRead:
+		return "read idle"
+	case IdleWrite:
+		return "write idle"
+	case IdleAll:
+		return "idle"
+	}
+	return "unknown"
+}
+
+// idleWatcher tracks the last io of a conn, fires the idle events and sends the heartbeats
+type idleWatcher struct {
+	cfg       *connConfig
+	lastRead  atomic.Int64
+	lastWrite atomic.Int64
+	done      chan struct{}
+}
+
+func newIdleWatcher(cfg *connConfig) *idleWatcher {
+	w := &idleWatcher{
+		cfg:  cfg,
+		done: make(chan struct{}),
+	}
+	now := time.Now().UnixNano()
+	w.lastRead.Store(now)
+	w.lastWrite.Store(now)
+	return w
+}
+
+func (w *idleWatcher) touchRead() {
+	w.lastRead.Store(time.Now().UnixNano())
+}
+
+func (w *idleWatcher) touchWrite() {
+	w.lastWrite.Store(time.Now().UnixNano())
+}
+
+// stop must be called once, when the conn is closed
+func (w *idleWatcher) stop() {
+	close(w.done)
+}
+
+func (w *idleWatcher) checkInterval() time.Duration {
+	var interval time.Duration
+	for _, d := range []time.Duration{w.cfg.readIdleTimeout, w.cfg.writeIdleTimeout, w.cfg.idleTimeout, w.cfg.heartbeatInterval} {
+		if d > 0 && (interval == 0 || d < interval) {
+			interval = d
+		}
+	}
+	interval /= 2
+	if interval > 0 && interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	return interval
+}
+
+func (w *idleWatcher) run(conn Conn, ping func()) {
+	interval := w.checkInterval()
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// an event fires once per timeout, the marks hold the time it fired last
+	var readMark, writeMark, allMark int64
+	since := func(last int64, mark int64, now int64) time.Duration {
+		if mark > last {
+			last = mark
+		}
+		return time.Duration(now - last)
+	}
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case t := <-ticker.C:
+			now := t.UnixNano()
+			lastRead, lastWrite := w.lastRead.Load(), w.lastWrite.Load()
+
+			if w.cfg.heartbeatInterval > 0 && time.Duration(now-lastWrite) >= w.cfg.heartbeatInterval {
+				ping()
+			}
+
+			lastIo := lastRead
+			if lastWrite > lastIo {
+				lastIo = lastWrite
+			}
+			if w.cfg.idleTimeout > 0 && since(lastIo, allMark, now) >= w.cfg.idleTimeout {
+				allMark = now
+				if w.fire(conn, IdleAll) {
+					return
+				}
+			}
+			if w.cfg.readIdleTimeout > 0 && since(lastRead, readMark, now) >= w.cfg.readIdleTimeout {
+				readMark = now
+				if w.fire(conn, IdleRead) {
+					return
+				}
+			}
+			if w.cfg.writeIdleTimeout > 0 && since(lastWrite, writeMark, now) >= w.cfg.writeIdleTimeout {
+				writeMark = now
+				if w.fire(conn, IdleWrite) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// fire reports whether the conn was destroyed
+func (w *idleWatcher) fire(conn Conn, kind IdleKind) bool {
+	var kick bool
+	if w.cfg.onIdle != nil {
+		kick = w.cfg.onIdle(conn, kind)
+	} else {
+		kick = kind != IdleWrite
+	}
+	if kick {
+		destroyWithReason(conn, CloseTimeout)
+	}
+	return kick
+}
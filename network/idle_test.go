@@ -0,0 +1,100 @@
+package network
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type idleTestAgent struct {
+	conn   *TCPConn
+	closed chan struct{}
+}
+
+func (a *idleTestAgent) Run() {
+	for {
+		if _, err := a.conn.ReadMsg(); err != nil {
+			return
+		}
+	}
+}
+
+func (a *idleTestAgent) OnClose() {
+	close(a.closed)
+}
+
+func TestIdle_Heartbeat(t *testing.T) {
+	kicked := make(chan IdleKind, 1)
+	server := &TCPServer{
+		Addr:            "127.0.0.1:0",
+		ReadIdleTimeout: 100 * time.Millisecond,
+		// takes the zero len frames as heartbeats, pings only after the idle kick
+		HeartbeatInterval: time.Second,
+		OnIdle: func(conn Conn, kind IdleKind) bool {
+			kicked <- kind
+			return true
+		},
+		NewAgent: func(conn *TCPConn) Agent {
+			return &idleTestAgent{conn: conn, closed: make(chan struct{})}
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	dial := func(heartbeat time.Duration) *idleTestAgent {
+		agent := &idleTestAgent{closed: make(chan struct{})}
+		client := &TCPClient{
+			Addr:              server.lns[0].Addr().String(),
+			HeartbeatInterval: heartbeat,
+			NewAgent: func(conn *TCPConn) Agent {
+				agent.conn = conn
+				return agent
+			},
+		}
+		client.Start()
+		t.Cleanup(client.Close)
+		return agent
+	}
+
+	alive := dial(30 * time.Millisecond)
+	select {
+	case <-alive.closed:
+		t.Fatal("conn with heartbeat was kicked")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	idle := dial(0)
+	select {
+	case <-idle.closed:
+	case <-time.After(time.Second):
+		t.Fatal("idle conn was not kicked")
+	}
+	if kind := <-kicked; kind != IdleRead {
+		t.Fatalf("unexpected idle kind %v", kind)
+	}
+}
+
+func TestIdle_ZeroLenWithoutHeartbeat(t *testing.T) {
+	server := &TCPServer{
+		Addr: "127.0.0.1:0",
+		NewAgent: func(conn *TCPConn) Agent {
+			return &idleTestAgent{conn: conn, closed: make(chan struct{})}
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.lns[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0, 0})
+
+	// the frame is too short, the conn is closed without a ping back
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(make([]byte, 2)); err != io.EOF {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+}
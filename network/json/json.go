@@ -0,0 +1,151 @@
+package json
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/gzjjyz/logger"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// ----------------------------------
+// | {"id": msg id, "data": {...}} |
+// ----------------------------------
+type Processor struct {
+	msgInfo map[uint32]*MsgInfo
+	msgId   map[reflect.Type]uint32
+}
+
+type MsgInfo struct {
+	msgType    reflect.Type
+	msgHandler MsgHandler
+	msgSender  MsgSender
+}
+
+type MsgHandler func(msg interface{}, userData interface{})
+
+// MsgSender is satisfied by worker.Worker and worker/v2.Worker, the routed message is sent with
+// the msg id and the params msg, userData
+type MsgSender interface {
+	SendMsg(id uint32, params ...interface{})
+}
+
+type envelope struct {
+	Id   uint32              `json:"id"`
+	Data jsoniter.RawMessage `json:"data"`
+}
+
+func NewProcessor() *Processor {
+	p := new(Processor)
+	p.msgInfo = make(map[uint32]*MsgInfo)
+	p.msgId = make(map[reflect.Type]uint32)
+	return p
+}
+
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) Register(id uint32, msg interface{}) {
+	msgType := reflect.TypeOf(msg)
+	if msgType == nil || msgType.Kind() != reflect.Ptr {
+		logger.LogFatal("json message pointer required")
+	}
+	if _, ok := p.msgInfo[id]; ok {
+		logger.LogFatal("message id %v is already registered", id)
+	}
+	if _, ok := p.msgId[msgType]; ok {
+		logger.LogFatal("message %s is already registered", msgType)
+	}
+
+	p.msgInfo[id] = &MsgInfo{msgType: msgType}
+	p.msgId[msgType] = id
+}
+
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) SetHandler(id uint32, msgHandler MsgHandler) {
+	i, ok := p.msgInfo[id]
+	if !ok {
+		logger.LogFatal("message id %v not registered", id)
+	}
+
+	i.msgHandler = msgHandler
+}
+
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) SetWorker(id uint32, msgSender MsgSender) {
+	i, ok := p.msgInfo[id]
+	if !ok {
+		logger.LogFatal("message id %v not registered", id)
+	}
+
+	i.msgSender = msgSender
+}
+
+// MsgId returns the registered id of the message
+func (p *Processor) MsgId(msg interface{}) (uint32, error) {
+	msgType := reflect.TypeOf(msg)
+	id, ok := p.msgId[msgType]
+	if !ok {
+		return 0, fmt.Errorf("message %s not registered", msgType)
+	}
+	return id, nil
+}
+
+// goroutine safe
+func (p *Processor) Route(msg interface{}, userData interface{}) error {
+	id, err := p.MsgId(msg)
+	if err != nil {
+		return err
+	}
+
+	i := p.msgInfo[id]
+	if i.msgHandler != nil {
+		i.msgHandler(msg, userData)
+	}
+	if i.msgSender != nil {
+		i.msgSender.SendMsg(id, msg, userData)
+	}
+	return nil
+}
+
+// goroutine safe
+func (p *Processor) Unmarshal(data []byte) (interface{}, error) {
+	var e envelope
+	if err := jsoniter.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+
+	i, ok := p.msgInfo[e.Id]
+	if !ok {
+		return nil, fmt.Errorf("message id %v not registered", e.Id)
+	}
+	msg := reflect.New(i.msgType.Elem()).Interface()
+	if len(e.Data) == 0 {
+		return msg, nil
+	}
+	return msg, jsoniter.Unmarshal(e.Data, msg)
+}
+
+// goroutine safe
+func (p *Processor) Marshal(msg interface{}) ([][]byte, error) {
+	id, err := p.MsgId(msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil || reflect.ValueOf(msg).IsNil() {
+		return nil, errors.New("json message must not be nil")
+	}
+
+	data, err := jsoniter.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	b, err := jsoniter.Marshal(&envelope{Id: id, Data: data})
+	return [][]byte{b}, err
+}
+
+// goroutine safe
+func (p *Processor) Range(f func(id uint32, t reflect.Type)) {
+	for id, i := range p.msgInfo {
+		f(id, i.msgType)
+	}
+}
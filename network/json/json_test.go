@@ -0,0 +1,83 @@
+package json
+
+import (
+	"testing"
+)
+
+type pingReq struct {
+	Seq int `json:"seq"`
+}
+
+type loginReq struct {
+	Name string `json:"name"`
+}
+
+type testSender struct {
+	id     uint32
+	params []interface{}
+}
+
+func (s *testSender) SendMsg(id uint32, params ...interface{}) {
+	s.id, s.params = id, params
+}
+
+func TestProcessor(t *testing.T) {
+	p := NewProcessor()
+	p.Register(1, &pingReq{})
+	p.Register(2, &loginReq{})
+
+	var handled *loginReq
+	p.SetHandler(2, func(msg interface{}, userData interface{}) {
+		handled = msg.(*loginReq)
+	})
+	sender := &testSender{}
+	p.SetWorker(2, sender)
+
+	data, err := p.Marshal(&loginReq{Name: "tom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[0]) != `{"id":2,"data":{"name":"tom"}}` {
+		t.Fatalf("unexpected data %s", data[0])
+	}
+	msg, err := p.Unmarshal(data[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Route(msg, "agent"); err != nil {
+		t.Fatal(err)
+	}
+	if handled == nil || handled.Name != "tom" {
+		t.Fatalf("unexpected handled msg %v", handled)
+	}
+	if sender.id != 2 || sender.params[1] != "agent" {
+		t.Fatalf("unexpected worker msg %d %v", sender.id, sender.params)
+	}
+
+	// no data is the zero message
+	msg, err = p.Unmarshal([]byte(`{"id":1}`))
+	if err != nil || *msg.(*pingReq) != (pingReq{}) {
+		t.Fatalf("unexpected msg %v %v", msg, err)
+	}
+}
+
+func TestProcessor_Errors(t *testing.T) {
+	p := NewProcessor()
+	p.Register(1, &pingReq{})
+
+	if _, err := p.Unmarshal([]byte(`{"id":9,"data":{}}`)); err == nil {
+		t.Fatal("unregistered id unmarshaled")
+	}
+	if _, err := p.Unmarshal([]byte(`{"id":`)); err == nil {
+		t.Fatal("invalid json unmarshaled")
+	}
+	if _, err := p.Marshal(&loginReq{}); err == nil {
+		t.Fatal("unregistered message marshaled")
+	}
+	if _, err := p.Marshal((*pingReq)(nil)); err == nil {
+		t.Fatal("nil message marshaled")
+	}
+	if err := p.Route(&loginReq{}, nil); err == nil {
+		t.Fatal("unregistered message routed")
+	}
+}
@@ -0,0 +1,911 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// kcp segment
+// -----------------------------------------------------------------------------------
+// | conv(4) | cmd(1) | frg(1) | wnd(2) | ts(4) | sn(4) | una(4) | len(4) | data(len) |
+// -----------------------------------------------------------------------------------
+// a udp packet carries as many segments as its mtu allows, the integers are little endian,
+// the sessions are in the stream mode, frg is 0 on sending and the fragments received are read as a stream
+const kcpHeaderLen = 24
+
+// fin and reset extend kcp, the standard kcp peers drop them and time the sessions out instead,
+// fin is sequenced and acked as push, reset tells at once that the session is gone
+const (
+	kcpCmdPush  uint8 = 81
+	kcpCmdAck   uint8 = 82
+	kcpCmdWask  uint8 = 83
+	kcpCmdWins  uint8 = 84
+	kcpCmdFin   uint8 = 85
+	kcpCmdReset uint8 = 86
+)
+
+const (
+	kcpInitRTO    = 200
+	kcpMaxRTO     = 60000
+	kcpThreshInit = 2
+	kcpThreshMin  = 2
+)
+
+var (
+	errKCPDeadLink       = errors.New("kcp: dead link")
+	errKCPRefused        = errors.New("kcp: connection refused")
+	errKCPConnectTimeout = errors.New("kcp: connect timeout")
+)
+
+// kcpConfig tunes the arq, the windows are in segments
+type kcpConfig struct {
+	interval       time.Duration
+	sndWnd         int
+	rcvWnd         int
+	mtu            int
+	minRTO         time.Duration
+	fastResend     int
+	deadLink       int
+	closeTimeout   time.Duration
+	connectTimeout time.Duration
+}
+
+func (cfg *kcpConfig) init() *kcpConfig {
+	if cfg.interval <= 0 {
+		cfg.interval = 10 * time.Millisecond
+	}
+	if cfg.sndWnd <= 0 {
+		cfg.sndWnd = 128
+	}
+	if cfg.rcvWnd <= 0 {
+		cfg.rcvWnd = 128
+	}
+	if cfg.mtu <= kcpHeaderLen {
+		cfg.mtu = 1400
+	}
+	if cfg.minRTO <= 0 {
+		cfg.minRTO = 30 * time.Millisecond
+	}
+	if cfg.fastResend <= 0 {
+		cfg.fastResend = 2
+	}
+	if cfg.deadLink <= 0 {
+		cfg.deadLink = 20
+	}
+	if cfg.closeTimeout <= 0 {
+		cfg.closeTimeout = 5 * time.Second
+	}
+	if cfg.connectTimeout <= 0 {
+		cfg.connectTimeout = 5 * time.Second
+	}
+	return cfg
+}
+
+func (cfg *kcpConfig) mss() int {
+	return cfg.mtu - kcpHeaderLen
+}
+
+func appendKCPSegment(b []byte, conv uint32, cmd uint8, wnd uint16, ts, sn, una uint32, data []byte) []byte {
+	var h [kcpHeaderLen]byte
+	binary.LittleEndian.PutUint32(h[0:], conv)
+	h[4] = cmd
+	binary.LittleEndian.PutUint16(h[6:], wnd)
+	binary.LittleEndian.PutUint32(h[8:], ts)
+	binary.LittleEndian.PutUint32(h[12:], sn)
+	binary.LittleEndian.PutUint32(h[16:], una)
+	binary.LittleEndian.PutUint32(h[20:], uint32(len(data)))
+	b = append(b, h[:]...)
+	return append(b, data...)
+}
+
+// seqBefore compares the sequence numbers across the wrap around
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+type kcpSegment struct {
+	cmd      uint8
+	sn       uint32
+	ts       uint32
+	resendts uint32
+	rto      uint32
+	xmit     int
+	fastack  int
+	data     []byte
+}
+
+type kcpAck struct {
+	sn uint32
+	ts uint32
+}
+
+// kcpSession is a kcp session in the stream mode with the selective and fast retransmission and the congestion control of kcp,
+// it flushes every interval and releases itself once it is closed and the data sent is acked
+type kcpSession struct {
+	mu        sync.Mutex
+	conv      uint32
+	cfg       *kcpConfig
+	local     net.Addr
+	remote    net.Addr
+	output    func(b []byte) error
+	onRelease func()
+	start     time.Time
+	buf       []byte
+
+	// send
+	sndQueue [][]byte
+	sndBuf   []*kcpSegment
+	sndNxt   uint32
+	rmtWnd   int
+	cwnd     int
+	ssthresh int
+	incr     int
+	srtt     uint32
+	rttvar   uint32
+	rto      uint32
+
+	// receive
+	rcvBuf  map[uint32]*kcpSegment
+	rcvNxt  uint32
+	rcvData [][]byte
+	acks    []kcpAck
+	// probeTell answers the window ask of the peer
+	probeTell bool
+
+	// established is closed on the first segment of the peer
+	established chan struct{}
+	gotSegment  bool
+
+	closed        bool
+	closedAt      time.Time
+	linger0       bool
+	finQueued     bool
+	remoteClosed  bool
+	released      bool
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readEvent     chan struct{}
+	writeEvent    chan struct{}
+	die           chan struct{}
+}
+
+func newKCPSession(conv uint32, cfg *kcpConfig, local, remote net.Addr, output func(b []byte) error) *kcpSession {
+	s := &kcpSession{
+		conv:        conv,
+		cfg:         cfg,
+		local:       local,
+		remote:      remote,
+		output:      output,
+		start:       time.Now(),
+		buf:         make([]byte, 0, cfg.mtu),
+		rmtWnd:      cfg.rcvWnd,
+		cwnd:        1,
+		ssthresh:    kcpThreshInit,
+		incr:        cfg.mss(),
+		rto:         kcpInitRTO,
+		established: make(chan struct{}),
+		rcvBuf:      make(map[uint32]*kcpSegment),
+		readEvent:   make(chan struct{}, 1),
+		writeEvent:  make(chan struct{}, 1),
+		die:         make(chan struct{}),
+	}
+	go s.update()
+	return s
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (s *kcpSession) now() uint32 {
+	return uint32(time.Since(s.start) / time.Millisecond)
+}
+
+func (s *kcpSession) Conv() uint32 {
+	return s.conv
+}
+
+func (s *kcpSession) LocalAddr() net.Addr {
+	return s.local
+}
+
+func (s *kcpSession) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func (s *kcpSession) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	for {
+		if len(s.rcvData) > 0 {
+			n := 0
+			for n < len(b) && len(s.rcvData) > 0 {
+				c := copy(b[n:], s.rcvData[0])
+				n += c
+				if c < len(s.rcvData[0]) {
+					s.rcvData[0] = s.rcvData[0][c:]
+				} else {
+					s.rcvData = s.rcvData[1:]
+				}
+			}
+			s.moveReady()
+			s.mu.Unlock()
+			return n, nil
+		}
+
+		var err error
+		switch {
+		case s.closed:
+			err = net.ErrClosed
+		case s.err != nil:
+			err = s.err
+		case s.remoteClosed:
+			err = io.EOF
+		}
+		deadline := s.readDeadline
+		s.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if err := s.wait(s.readEvent, deadline); err != nil {
+			return 0, err
+		}
+		s.mu.Lock()
+	}
+}
+
+// Write blocks while the queued segments are twice the send window
+func (s *kcpSession) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	for {
+		var err error
+		switch {
+		case s.closed:
+			err = net.ErrClosed
+		case s.err != nil:
+			err = s.err
+		case s.remoteClosed:
+			err = io.ErrClosedPipe
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return 0, err
+		}
+		if len(s.sndQueue)+len(s.sndBuf) < 2*s.cfg.sndWnd {
+			break
+		}
+
+		deadline := s.writeDeadline
+		s.mu.Unlock()
+		if err := s.wait(s.writeEvent, deadline); err != nil {
+			return 0, err
+		}
+		s.mu.Lock()
+	}
+	defer s.mu.Unlock()
+
+	n := len(b)
+	mss := s.cfg.mss()
+	// fill up the last segment first
+	if last := len(s.sndQueue) - 1; last >= 0 && len(s.sndQueue[last]) < mss {
+		c := mss - len(s.sndQueue[last])
+		if c > len(b) {
+			c = len(b)
+		}
+		s.sndQueue[last] = append(s.sndQueue[last], b[:c]...)
+		b = b[c:]
+	}
+	for len(b) > 0 {
+		c := len(b)
+		if c > mss {
+			c = mss
+		}
+		s.sndQueue = append(s.sndQueue, append([]byte(nil), b[:c]...))
+		b = b[c:]
+	}
+	s.flush()
+	return n, nil
+}
+
+func (s *kcpSession) wait(event chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-event:
+	case <-s.die:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// Close sends the data queued before the fin
+func (s *kcpSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	s.closedAt = time.Now()
+	notify(s.readEvent)
+	notify(s.writeEvent)
+	return nil
+}
+
+// SetLinger(0) drops the unsent data on Close
+func (s *kcpSession) SetLinger(sec int) error {
+	s.mu.Lock()
+	s.linger0 = sec == 0
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *kcpSession) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	s.SetWriteDeadline(t)
+	return nil
+}
+
+func (s *kcpSession) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	notify(s.readEvent)
+	return nil
+}
+
+func (s *kcpSession) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	notify(s.writeEvent)
+	return nil
+}
+
+// input handles a udp packet from the peer
+func (s *kcpSession) input(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return
+	}
+
+	current := s.now()
+	prevUna := s.sndUna()
+	for len(data) >= kcpHeaderLen {
+		conv := binary.LittleEndian.Uint32(data[0:])
+		cmd := data[4]
+		wnd := binary.LittleEndian.Uint16(data[6:])
+		ts := binary.LittleEndian.Uint32(data[8:])
+		sn := binary.LittleEndian.Uint32(data[12:])
+		una := binary.LittleEndian.Uint32(data[16:])
+		n := binary.LittleEndian.Uint32(data[20:])
+		data = data[kcpHeaderLen:]
+		if conv != s.conv || uint64(n) > uint64(len(data)) {
+			break
+		}
+		payload := data[:n]
+		data = data[n:]
+
+		if !s.gotSegment {
+			s.gotSegment = true
+			close(s.established)
+		}
+		s.rmtWnd = int(wnd)
+		s.ackUna(una)
+		switch cmd {
+		case kcpCmdAck:
+			if rtt := current - ts; int32(rtt) >= 0 {
+				s.updateRTT(rtt)
+			}
+			s.ackSn(sn)
+		case kcpCmdPush, kcpCmdFin:
+			if seqBefore(sn, s.rcvNxt+uint32(s.cfg.rcvWnd)) {
+				s.acks = append(s.acks, kcpAck{sn: sn, ts: ts})
+				if !seqBefore(sn, s.rcvNxt) {
+					if _, ok := s.rcvBuf[sn]; !ok {
+						s.rcvBuf[sn] = &kcpSegment{cmd: cmd, sn: sn, data: append([]byte(nil), payload...)}
+					}
+				}
+			}
+		case kcpCmdWask:
+			s.probeTell = true
+		case kcpCmdReset:
+			s.peerClosed()
+		}
+	}
+	if seqBefore(prevUna, s.sndUna()) {
+		s.growCwnd()
+	}
+
+	s.moveReady()
+	notify(s.readEvent)
+	notify(s.writeEvent)
+}
+
+func (s *kcpSession) updateRTT(rtt uint32) {
+	if s.srtt == 0 {
+		s.srtt = rtt
+		s.rttvar = rtt / 2
+	} else {
+		delta := int32(rtt - s.srtt)
+		if delta < 0 {
+			delta = -delta
+		}
+		s.rttvar = (3*s.rttvar + uint32(delta)) / 4
+		s.srtt = (7*s.srtt + rtt) / 8
+		if s.srtt < 1 {
+			s.srtt = 1
+		}
+	}
+
+	interval := uint32(s.cfg.interval / time.Millisecond)
+	if v := 4 * s.rttvar; v > interval {
+		interval = v
+	}
+	s.rto = s.srtt + interval
+	if minRTO := uint32(s.cfg.minRTO / time.Millisecond); s.rto < minRTO {
+		s.rto = minRTO
+	}
+	if s.rto > kcpMaxRTO {
+		s.rto = kcpMaxRTO
+	}
+}
+
+// sndUna is the first sn the peer has not acked
+func (s *kcpSession) sndUna() uint32 {
+	if len(s.sndBuf) > 0 {
+		return s.sndBuf[0].sn
+	}
+	return s.sndNxt
+}
+
+// growCwnd opens the congestion window on the acks, slow start below ssthresh and congestion avoidance above
+func (s *kcpSession) growCwnd() {
+	if s.cwnd >= s.rmtWnd {
+		return
+	}
+	mss := s.cfg.mss()
+	if s.cwnd < s.ssthresh {
+		s.cwnd++
+		s.incr += mss
+	} else {
+		if s.incr < mss {
+			s.incr = mss
+		}
+		s.incr += mss*mss/s.incr + mss/16
+		if (s.cwnd+1)*mss <= s.incr {
+			s.cwnd = (s.incr + mss - 1) / mss
+		}
+	}
+	if s.cwnd > s.rmtWnd {
+		s.cwnd = s.rmtWnd
+		s.incr = s.rmtWnd * mss
+	}
+}
+
+// ackUna drops the segments the peer has received all before
+func (s *kcpSession) ackUna(una uint32) {
+	i := 0
+	for i < len(s.sndBuf) && seqBefore(s.sndBuf[i].sn, una) {
+		i++
+	}
+	s.sndBuf = s.sndBuf[i:]
+}
+
+func (s *kcpSession) ackSn(sn uint32) {
+	for i, seg := range s.sndBuf {
+		if seg.sn == sn {
+			s.sndBuf = append(s.sndBuf[:i], s.sndBuf[i+1:]...)
+			return
+		}
+		if seqBefore(seg.sn, sn) {
+			seg.fastack++
+		}
+	}
+}
+
+// moveReady moves the segments received in order to the read data while the receive window allows
+func (s *kcpSession) moveReady() {
+	for len(s.rcvData) < s.cfg.rcvWnd && !s.remoteClosed {
+		seg, ok := s.rcvBuf[s.rcvNxt]
+		if !ok {
+			return
+		}
+		delete(s.rcvBuf, s.rcvNxt)
+		s.rcvNxt++
+		if seg.cmd == kcpCmdFin {
+			s.peerClosed()
+			return
+		}
+		s.rcvData = append(s.rcvData, seg.data)
+	}
+}
+
+// peerClosed drops what the peer has not acked, it will not read it
+func (s *kcpSession) peerClosed() {
+	s.remoteClosed = true
+	s.sndQueue = nil
+	s.sndBuf = nil
+}
+
+// flush sends the acks, the new segments the windows allow and the segments to retransmit
+func (s *kcpSession) flush() {
+	current := s.now()
+	wnd := s.cfg.rcvWnd - len(s.rcvData)
+	if wnd < 0 {
+		wnd = 0
+	}
+
+	buf := s.buf[:0]
+	put := func(cmd uint8, ts, sn uint32, data []byte) {
+		if len(buf)+kcpHeaderLen+len(data) > s.cfg.mtu {
+			s.output(buf)
+			buf = buf[:0]
+		}
+		buf = appendKCPSegment(buf, s.conv, cmd, uint16(wnd), ts, sn, s.rcvNxt, data)
+	}
+
+	for _, ack := range s.acks {
+		put(kcpCmdAck, ack.ts, ack.sn, nil)
+	}
+	s.acks = s.acks[:0]
+	if s.probeTell {
+		put(kcpCmdWins, 0, 0, nil)
+		s.probeTell = false
+	}
+
+	// a window of at least one segment probes the peer with a closed window
+	cwnd := s.cfg.sndWnd
+	if s.rmtWnd < cwnd {
+		cwnd = s.rmtWnd
+	}
+	if s.cwnd < cwnd {
+		cwnd = s.cwnd
+	}
+	if cwnd < 1 {
+		cwnd = 1
+	}
+	for len(s.sndQueue) > 0 {
+		if int(s.sndNxt-s.sndUna()) >= cwnd {
+			break
+		}
+		s.sndBuf = append(s.sndBuf, &kcpSegment{cmd: kcpCmdPush, sn: s.sndNxt, data: s.sndQueue[0]})
+		s.sndQueue[0] = nil
+		s.sndQueue = s.sndQueue[1:]
+		s.sndNxt++
+	}
+
+	// the fin follows the data
+	if s.closed && !s.finQueued && len(s.sndQueue) == 0 {
+		s.sndBuf = append(s.sndBuf, &kcpSegment{cmd: kcpCmdFin, sn: s.sndNxt})
+		s.sndNxt++
+		s.finQueued = true
+	}
+
+	var lost, change bool
+	for _, seg := range s.sndBuf {
+		send := false
+		switch {
+		case seg.xmit == 0:
+			send = true
+			seg.rto = s.rto
+		case int32(current-seg.resendts) >= 0:
+			send = true
+			lost = true
+			seg.rto += seg.rto / 2
+			if seg.rto > kcpMaxRTO {
+				seg.rto = kcpMaxRTO
+			}
+		case seg.fastack >= s.cfg.fastResend:
+			send = true
+			change = true
+			seg.fastack = 0
+		}
+		if !send {
+			continue
+		}
+
+		seg.xmit++
+		seg.ts = current
+		seg.resendts = current + seg.rto
+		put(seg.cmd, seg.ts, seg.sn, seg.data)
+		if seg.xmit >= s.cfg.deadLink {
+			s.err = errKCPDeadLink
+		}
+	}
+
+	if len(buf) > 0 {
+		s.output(buf)
+	}
+	s.buf = buf
+
+	// the fast retransmission halves the window, a timeout shrinks it to one segment
+	mss := s.cfg.mss()
+	if change {
+		s.ssthresh = int(s.sndNxt-s.sndUna()) / 2
+		if s.ssthresh < kcpThreshMin {
+			s.ssthresh = kcpThreshMin
+		}
+		s.cwnd = s.ssthresh + s.cfg.fastResend
+		s.incr = s.cwnd * mss
+	}
+	if lost {
+		s.ssthresh = cwnd / 2
+		if s.ssthresh < kcpThreshMin {
+			s.ssthresh = kcpThreshMin
+		}
+		s.cwnd = 1
+		s.incr = mss
+	}
+}
+
+// connect asks the peer for its window until it answers, a kcp peer answers the ask of a new session as well
+func (s *kcpSession) connect(ctx context.Context) error {
+	timeout := time.NewTimer(s.cfg.connectTimeout)
+	defer timeout.Stop()
+	resend := time.NewTicker(kcpInitRTO * time.Millisecond)
+	defer resend.Stop()
+
+	for {
+		s.mu.Lock()
+		s.output(appendKCPSegment(s.buf[:0], s.conv, kcpCmdWask, uint16(s.cfg.rcvWnd), s.now(), 0, 0, nil))
+		s.mu.Unlock()
+
+		select {
+		case <-s.established:
+			s.mu.Lock()
+			refused := s.remoteClosed
+			s.mu.Unlock()
+			if refused {
+				return errKCPRefused
+			}
+			return nil
+		case <-resend.C:
+		case <-timeout.C:
+			return errKCPConnectTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *kcpSession) update() {
+	ticker := time.NewTicker(s.cfg.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.Lock()
+		var release bool
+		if s.closed && s.linger0 {
+			s.output(appendKCPSegment(s.buf[:0], s.conv, kcpCmdReset, 0, 0, 0, 0, nil))
+			release = true
+		} else {
+			// the peer closed first may be gone before it acks the fin
+			s.flush()
+			release = s.err != nil || s.closed && (s.finQueued && (len(s.sndBuf) == 0 || s.remoteClosed) ||
+				time.Since(s.closedAt) > s.cfg.closeTimeout)
+		}
+		if release {
+			s.released = true
+			close(s.die)
+		}
+		s.mu.Unlock()
+
+		if release {
+			if s.onRelease != nil {
+				s.onRelease()
+			}
+			return
+		}
+	}
+}
+
+// kcpListener accepts the kcp sessions of a udp socket, the sessions are told apart by the remote address and conv,
+// a session starts with the window ask of a dial or any push of the receive window the peer sent before it got anything,
+// so a lost or reordered first packet is buffered until the peer retransmits it,
+// the other packets of an unknown session are answered with a reset,
+// the socket is closed when the listener and all its sessions are closed
+type kcpListener struct {
+	mu       sync.Mutex
+	conn     net.PacketConn
+	cfg      *kcpConfig
+	sessions map[kcpSessionKey]*kcpSession
+	accepts  chan *kcpSession
+	closed   bool
+	die      chan struct{}
+}
+
+type kcpSessionKey struct {
+	addr string
+	conv uint32
+}
+
+func listenKCP(addr string, cfg *kcpConfig) (*kcpListener, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &kcpListener{
+		conn:     conn,
+		cfg:      cfg,
+		sessions: make(map[kcpSessionKey]*kcpSession),
+		accepts:  make(chan *kcpSession, 128),
+		die:      make(chan struct{}),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+func (l *kcpListener) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		l.handle(buf[:n], addr)
+	}
+}
+
+func (l *kcpListener) handle(b []byte, addr net.Addr) {
+	if len(b) < kcpHeaderLen {
+		return
+	}
+
+	conv := binary.LittleEndian.Uint32(b[0:])
+	key := kcpSessionKey{addr: addr.String(), conv: conv}
+	l.mu.Lock()
+	s := l.sessions[key]
+	if s == nil {
+		cmd := b[4]
+		sn := binary.LittleEndian.Uint32(b[12:])
+		una := binary.LittleEndian.Uint32(b[16:])
+		// a session the peer has got nothing of yet, the ones released still being retransmitted are reset
+		start := una == 0 && (cmd == kcpCmdWask || cmd == kcpCmdPush && sn < uint32(l.cfg.rcvWnd))
+		if l.closed || !start {
+			l.mu.Unlock()
+			if cmd != kcpCmdReset {
+				l.conn.WriteTo(appendKCPSegment(nil, conv, kcpCmdReset, 0, 0, 0, 0, nil), addr)
+			}
+			return
+		}
+		if len(l.accepts) == cap(l.accepts) {
+			// the peer retransmits
+			l.mu.Unlock()
+			return
+		}
+
+		s = newKCPSession(conv, l.cfg, l.conn.LocalAddr(), addr, func(p []byte) error {
+			_, err := l.conn.WriteTo(p, addr)
+			return err
+		})
+		session := s
+		s.onRelease = func() {
+			l.remove(key, session)
+		}
+		l.sessions[key] = s
+		l.accepts <- s
+	}
+	l.mu.Unlock()
+
+	s.input(b)
+}
+
+func (l *kcpListener) remove(key kcpSessionKey, s *kcpSession) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sessions[key] == s {
+		delete(l.sessions, key)
+	}
+	if l.closed && len(l.sessions) == 0 {
+		l.conn.Close()
+	}
+}
+
+func (l *kcpListener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.accepts:
+		return s, nil
+	case <-l.die:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting, the sessions accepted still work
+func (l *kcpListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+
+	l.closed = true
+	close(l.die)
+drain:
+	for {
+		select {
+		case s := <-l.accepts:
+			s.Close()
+		default:
+			break drain
+		}
+	}
+	if len(l.sessions) == 0 {
+		l.conn.Close()
+	}
+	return nil
+}
+
+func (l *kcpListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// dialKCP starts a session to addr and waits for the peer to answer, conv 0 picks a random one
+func dialKCP(ctx context.Context, addr string, conv uint32, cfg *kcpConfig) (*kcpSession, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	for conv == 0 {
+		conv = rand.Uint32()
+	}
+
+	s := newKCPSession(conv, cfg, conn.LocalAddr(), conn.RemoteAddr(), func(p []byte) error {
+		_, err := conn.Write(p)
+		return err
+	})
+	s.onRelease = func() {
+		conn.Close()
+	}
+
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				// icmp unreachable of a connected udp socket
+				continue
+			}
+			s.input(buf[:n])
+		}
+	}()
+
+	if err := s.connect(ctx); err != nil {
+		// resets the peer which may have started the session
+		s.SetLinger(0)
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,140 @@
+package network
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// KCPClient connects the agents over kcp, see KCPServer
+type KCPClient struct {
+	Addr            string
+	ConnNum         int
+	ConnectInterval time.Duration
+	PendingWriteNum int
+	AutoReconnect   bool
+	NewAgent        func(*KCPConn) Agent
+	Metrics         *Metrics // nil creates one named by Addr
+	// Conv is the conversation id of the sessions, 0 picks a random one for each session
+	Conv   uint32
+	client *TCPClient
+
+	// reconnect, see TCPClient
+	MaxConnectInterval time.Duration
+	ConnectJitter      float64
+	MaxAttempts        int
+	OnConnected        func(conn Conn)
+	OnDisconnected     func(conn Conn, reason CloseReason)
+	OnGiveUp           func(err error)
+
+	// msg parser
+	LenMsgLen    int
+	MinMsgLen    uint32
+	MaxMsgLen    uint32
+	LittleEndian bool
+	// Codec takes precedence over the msg parser options above
+	Codec FrameCodec
+
+	// handshake
+	Handshaker       Handshaker
+	HandshakeTimeout time.Duration
+
+	// write queue overflow
+	OverflowPolicy  OverflowPolicy
+	OverflowTimeout time.Duration
+	CoalesceBytes   int
+	OnOverflow      func(conn Conn, policy OverflowPolicy)
+
+	// idle
+	ReadIdleTimeout   time.Duration
+	WriteIdleTimeout  time.Duration
+	IdleTimeout       time.Duration
+	HeartbeatInterval time.Duration
+	// OnIdle returns whether to destroy the conn, nil destroys on read and total idle
+	OnIdle func(conn Conn, kind IdleKind) bool
+
+	// kcp, the unset ones are defaulted
+	// the conns flush and retransmit every Interval, the windows are in segments of MTU bytes
+	Interval time.Duration
+	SndWnd   int
+	RcvWnd   int
+	MTU      int
+	MinRTO   time.Duration
+	// ConnectTimeout bounds a dial waiting for the server to answer, 5s if unset
+	ConnectTimeout time.Duration
+}
+
+func (client *KCPClient) Start() {
+	client.StartContext(context.Background())
+}
+
+// StartContext starts the client, the pending dials are canceled and the conns are closed when ctx is done
+func (client *KCPClient) StartContext(ctx context.Context) {
+	cfg := (&kcpConfig{
+		interval:       client.Interval,
+		sndWnd:         client.SndWnd,
+		rcvWnd:         client.RcvWnd,
+		mtu:            client.MTU,
+		minRTO:         client.MinRTO,
+		connectTimeout: client.ConnectTimeout,
+	}).init()
+
+	client.client = &TCPClient{
+		Addr:              client.Addr,
+		ConnNum:           client.ConnNum,
+		ConnectInterval:   client.ConnectInterval,
+		PendingWriteNum:   client.PendingWriteNum,
+		AutoReconnect:     client.AutoReconnect,
+		LenMsgLen:         client.LenMsgLen,
+		MinMsgLen:         client.MinMsgLen,
+		MaxMsgLen:         client.MaxMsgLen,
+		LittleEndian:      client.LittleEndian,
+		Codec:             client.Codec,
+		Handshaker:        client.Handshaker,
+		HandshakeTimeout:  client.HandshakeTimeout,
+		OverflowPolicy:    client.OverflowPolicy,
+		OverflowTimeout:   client.OverflowTimeout,
+		CoalesceBytes:     client.CoalesceBytes,
+		OnOverflow:        client.OnOverflow,
+		ReadIdleTimeout:   client.ReadIdleTimeout,
+		WriteIdleTimeout:  client.WriteIdleTimeout,
+		IdleTimeout:       client.IdleTimeout,
+		HeartbeatInterval: client.HeartbeatInterval,
+		OnIdle:            client.OnIdle,
+		Metrics:           client.Metrics,
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			return dialKCP(ctx, client.Addr, client.Conv, cfg)
+		},
+		MaxConnectInterval: client.MaxConnectInterval,
+		ConnectJitter:      client.ConnectJitter,
+		MaxAttempts:        client.MaxAttempts,
+		OnGiveUp:           client.OnGiveUp,
+	}
+	// a nil NewAgent is left to TCPClient to report
+	if client.NewAgent != nil {
+		client.client.NewAgent = func(conn *TCPConn) Agent {
+			return client.NewAgent(newKCPConn(conn))
+		}
+	}
+	if client.OnConnected != nil {
+		client.client.OnConnected = func(conn Conn) {
+			client.OnConnected(newKCPConn(conn.(*TCPConn)))
+		}
+	}
+	if client.OnDisconnected != nil {
+		client.client.OnDisconnected = func(conn Conn, reason CloseReason) {
+			client.OnDisconnected(newKCPConn(conn.(*TCPConn)), reason)
+		}
+	}
+	client.client.StartContext(ctx)
+	client.Metrics = client.client.Metrics
+}
+
+// Ready waits until a conn is connected, see TCPClient
+func (client *KCPClient) Ready(ctx context.Context) error {
+	return client.client.Ready(ctx)
+}
+
+func (client *KCPClient) Close() {
+	client.client.Close()
+}
@@ -0,0 +1,154 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// KCPConn is a TCPConn over a kcp session
+type KCPConn struct {
+	*TCPConn
+	session *kcpSession
+}
+
+func newKCPConn(conn *TCPConn) *KCPConn {
+	return &KCPConn{TCPConn: conn, session: conn.conn.(*kcpSession)}
+}
+
+// Conv returns the conversation id of the session
+func (kcpConn *KCPConn) Conv() uint32 {
+	return kcpConn.session.Conv()
+}
+
+// KCPServer serves the agents over kcp, a reliable protocol over udp with lower latency than tcp on lossy networks,
+// the conns frame the messages and queue the writes the same way as TCPServer,
+// the sessions are kcp in the stream mode so the standard kcp clients can connect, a KCPClient dial waits for the server to answer,
+// the PROXY protocol is not supported since the udp proxies send the header in each datagram, not at the stream start
+type KCPServer struct {
+	Addr            string
+	MaxConnNum      int
+	PendingWriteNum int
+	NewAgent        func(*KCPConn) Agent
+	Sessions        *SessionManager
+	Metrics         *Metrics // nil creates one named by Addr
+	server          *TCPServer
+
+	// msg parser
+	LenMsgLen    int
+	MinMsgLen    uint32
+	MaxMsgLen    uint32
+	LittleEndian bool
+	// Codec takes precedence over the msg parser options above
+	Codec FrameCodec
+
+	// handshake
+	Handshaker       Handshaker
+	HandshakeTimeout time.Duration
+
+	// write queue overflow
+	OverflowPolicy  OverflowPolicy
+	OverflowTimeout time.Duration
+	CoalesceBytes   int
+	OnOverflow      func(conn Conn, policy OverflowPolicy)
+
+	// idle
+	ReadIdleTimeout   time.Duration
+	WriteIdleTimeout  time.Duration
+	IdleTimeout       time.Duration
+	HeartbeatInterval time.Duration
+	// OnIdle returns whether to destroy the conn, nil destroys on read and total idle
+	OnIdle func(conn Conn, kind IdleKind) bool
+
+	// limits, see TCPServer, the peers are told apart by their udp address
+	IPFilter        *IPFilter
+	MaxConnPerIP    int
+	AcceptRate      float64
+	AcceptBurst     int
+	MsgRate         float64
+	MsgBurst        int
+	ByteRate        float64
+	ByteBurst       int
+	RateLimitAction RateLimitAction
+	OnRateLimit     func(conn Conn, action RateLimitAction)
+
+	// kcp, the unset ones are defaulted
+	// the conns flush and retransmit every Interval, the windows are in segments of MTU bytes
+	Interval time.Duration
+	SndWnd   int
+	RcvWnd   int
+	MTU      int
+	MinRTO   time.Duration
+}
+
+func (server *KCPServer) Start() error {
+	if server.NewAgent == nil {
+		return errors.New("NewAgent must not be nil")
+	}
+
+	ln, err := listenKCP(server.Addr, (&kcpConfig{
+		interval: server.Interval,
+		sndWnd:   server.SndWnd,
+		rcvWnd:   server.RcvWnd,
+		mtu:      server.MTU,
+		minRTO:   server.MinRTO,
+	}).init())
+	if err != nil {
+		return err
+	}
+
+	server.server = &TCPServer{
+		Addr:            server.Addr,
+		MaxConnNum:      server.MaxConnNum,
+		PendingWriteNum: server.PendingWriteNum,
+		NewAgent: func(conn *TCPConn) Agent {
+			return server.NewAgent(newKCPConn(conn))
+		},
+		Sessions:          server.Sessions,
+		Metrics:           server.Metrics,
+		LenMsgLen:         server.LenMsgLen,
+		MinMsgLen:         server.MinMsgLen,
+		MaxMsgLen:         server.MaxMsgLen,
+		LittleEndian:      server.LittleEndian,
+		Codec:             server.Codec,
+		Handshaker:        server.Handshaker,
+		HandshakeTimeout:  server.HandshakeTimeout,
+		OverflowPolicy:    server.OverflowPolicy,
+		OverflowTimeout:   server.OverflowTimeout,
+		CoalesceBytes:     server.CoalesceBytes,
+		OnOverflow:        server.OnOverflow,
+		ReadIdleTimeout:   server.ReadIdleTimeout,
+		WriteIdleTimeout:  server.WriteIdleTimeout,
+		IdleTimeout:       server.IdleTimeout,
+		HeartbeatInterval: server.HeartbeatInterval,
+		OnIdle:            server.OnIdle,
+		IPFilter:          server.IPFilter,
+		MaxConnPerIP:      server.MaxConnPerIP,
+		AcceptRate:        server.AcceptRate,
+		AcceptBurst:       server.AcceptBurst,
+		MsgRate:           server.MsgRate,
+		MsgBurst:          server.MsgBurst,
+		ByteRate:          server.ByteRate,
+		ByteBurst:         server.ByteBurst,
+		RateLimitAction:   server.RateLimitAction,
+		OnRateLimit:       server.OnRateLimit,
+	}
+	if err := server.server.setup([]net.Listener{ln}); err != nil {
+		ln.Close()
+		return err
+	}
+	server.Metrics = server.server.Metrics
+	server.server.wgLn.Add(1)
+	go server.server.run(server.server.lns[0])
+	return nil
+}
+
+func (server *KCPServer) Close() {
+	server.server.Close()
+}
+
+// Shutdown works as TCPServer.Shutdown
+func (server *KCPServer) Shutdown(ctx context.Context) error {
+	return server.server.Shutdown(ctx)
+}
@@ -0,0 +1,360 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+type kcpEchoAgent struct {
+	conn  *KCPConn
+	convs chan uint32
+}
+
+func (a *kcpEchoAgent) Run() {
+	a.convs <- a.conn.Conv()
+	for {
+		msg, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		a.conn.WriteMsg(msg)
+	}
+}
+
+func (a *kcpEchoAgent) OnClose() {}
+
+type kcpClientAgent struct {
+	conn *KCPConn
+	done chan error
+}
+
+func (a *kcpClientAgent) Run() {
+	a.done <- func() error {
+		for i := 0; i < 100; i++ {
+			msg := bytes.Repeat([]byte{byte(i)}, 1+i*40)
+			if err := a.conn.WriteMsg(msg); err != nil {
+				return err
+			}
+			echo, err := a.conn.ReadMsg()
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(echo, msg) {
+				return io.ErrUnexpectedEOF
+			}
+		}
+		return nil
+	}()
+}
+
+func (a *kcpClientAgent) OnClose() {}
+
+func TestKCP_Echo(t *testing.T) {
+	convs := make(chan uint32, 1)
+	server := &KCPServer{
+		Addr: "127.0.0.1:0",
+		NewAgent: func(conn *KCPConn) Agent {
+			return &kcpEchoAgent{conn: conn, convs: convs}
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	done := make(chan error, 1)
+	client := &KCPClient{
+		Addr: server.server.lns[0].Addr().String(),
+		Conv: 42,
+		NewAgent: func(conn *KCPConn) Agent {
+			return &kcpClientAgent{conn: conn, done: done}
+		},
+	}
+	client.Start()
+	defer client.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("echo timeout")
+	}
+	if conv := <-convs; conv != 42 {
+		t.Fatalf("server conv %v", conv)
+	}
+}
+
+type kcpGreetAgent struct {
+	conn *KCPConn
+}
+
+func (a *kcpGreetAgent) Run() {
+	a.conn.WriteMsg([]byte("hello"))
+	for {
+		if _, err := a.conn.ReadMsg(); err != nil {
+			return
+		}
+	}
+}
+
+func (a *kcpGreetAgent) OnClose() {}
+
+type kcpReadAgent struct {
+	conn *KCPConn
+	msgs chan []byte
+}
+
+func (a *kcpReadAgent) Run() {
+	for {
+		msg, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		a.msgs <- msg
+	}
+}
+
+func (a *kcpReadAgent) OnClose() {}
+
+func TestKCP_ServerSpeaksFirst(t *testing.T) {
+	server := &KCPServer{
+		Addr: "127.0.0.1:0",
+		NewAgent: func(conn *KCPConn) Agent {
+			return &kcpGreetAgent{conn: conn}
+		},
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	msgs := make(chan []byte, 1)
+	client := &KCPClient{
+		Addr: server.server.lns[0].Addr().String(),
+		NewAgent: func(conn *KCPConn) Agent {
+			return &kcpReadAgent{conn: conn, msgs: msgs}
+		},
+	}
+	client.Start()
+	defer client.Close()
+
+	select {
+	case msg := <-msgs:
+		if string(msg) != "hello" {
+			t.Fatalf("read %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("greeting timeout")
+	}
+}
+
+// closedUDPAddr returns an addr nothing listens on
+func closedUDPAddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	return addr
+}
+
+func TestKCPClient_GiveUp(t *testing.T) {
+	gaveUp := make(chan error, 1)
+	client := &KCPClient{
+		Addr:            closedUDPAddr(t),
+		ConnectInterval: time.Millisecond,
+		MaxAttempts:     2,
+		ConnectTimeout:  50 * time.Millisecond,
+		NewAgent: func(conn *KCPConn) Agent {
+			return &kcpReadAgent{conn: conn, msgs: make(chan []byte, 1)}
+		},
+		OnConnected: func(conn Conn) { t.Error("connected without a server") },
+		OnGiveUp:    func(err error) { gaveUp <- err },
+	}
+	client.Start()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := client.Ready(ctx); err != errKCPConnectTimeout {
+		t.Fatalf("ready error %v", err)
+	}
+	if err := <-gaveUp; err != errKCPConnectTimeout {
+		t.Fatalf("give up error %v", err)
+	}
+	if n := client.Metrics.Snapshot().Rejected[rejectDial]; n != 2 {
+		t.Fatalf("%d dials", n)
+	}
+}
+
+func TestKCPClient_CancelDial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &KCPClient{
+		Addr:           closedUDPAddr(t),
+		ConnectTimeout: time.Minute,
+		NewAgent: func(conn *KCPConn) Agent {
+			return &kcpReadAgent{conn: conn, msgs: make(chan []byte, 1)}
+		},
+	}
+	client.StartContext(ctx)
+
+	cancel()
+	start := time.Now()
+	client.Close()
+	if time.Since(start) > time.Second {
+		t.Fatal("close waits for the dial")
+	}
+}
+
+func TestKCPSegment_Layout(t *testing.T) {
+	got := appendKCPSegment(nil, 0x01020304, kcpCmdPush, 0x0506, 7, 8, 9, []byte("ab"))
+	want := []byte{
+		4, 3, 2, 1, // conv
+		81,   // cmd
+		0,    // frg
+		6, 5, // wnd
+		7, 0, 0, 0, // ts
+		8, 0, 0, 0, // sn
+		9, 0, 0, 0, // una
+		2, 0, 0, 0, // len
+		'a', 'b',
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("segment %v, want %v", got, want)
+	}
+}
+
+// lossyKCPPair connects two sessions by a link dropping the packets at the rate
+func lossyKCPPair(rate float64) (*kcpSession, *kcpSession) {
+	cfg := (&kcpConfig{}).init()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	var a, b *kcpSession
+	link := func(to **kcpSession) func([]byte) error {
+		ch := make(chan []byte, 1024)
+		go func() {
+			for p := range ch {
+				(*to).input(p)
+			}
+		}()
+		return func(p []byte) error {
+			if rand.Float64() >= rate {
+				select {
+				case ch <- append([]byte(nil), p...):
+				default:
+				}
+			}
+			return nil
+		}
+	}
+	a = newKCPSession(1, cfg, addr, addr, link(&b))
+	b = newKCPSession(1, cfg, addr, addr, link(&a))
+	return a, b
+}
+
+func TestKCPSession_Lossy(t *testing.T) {
+	a, b := lossyKCPPair(0.2)
+	defer b.Close()
+
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+	go func() {
+		a.Write(data)
+		a.Close()
+	}()
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes, not the %d sent", len(got), len(data))
+	}
+}
+
+func TestKCPListener_LostFirstPacket(t *testing.T) {
+	ln, err := listenKCP("127.0.0.1:0", (&kcpConfig{}).init())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the push of sn 0 is late, another session of the same address is told apart by its conv
+	conn.Write(appendKCPSegment(nil, 7, kcpCmdPush, 128, 0, 1, 0, []byte("world")))
+	conn.Write(appendKCPSegment(nil, 7, kcpCmdPush, 128, 0, 0, 0, []byte("hello ")))
+	conn.Write(appendKCPSegment(nil, 8, kcpCmdPush, 128, 0, 0, 0, []byte("other")))
+	for _, want := range []string{"hello world", "other"} {
+		s, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetReadDeadline(time.Now().Add(time.Second))
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(s, got); err != nil || string(got) != want {
+			t.Fatalf("read %q, error %v", got, err)
+		}
+		s.(*kcpSession).SetLinger(0)
+		s.Close()
+	}
+
+	// a packet of a session the peer has got data of is reset
+	conn.Write(appendKCPSegment(nil, 9, kcpCmdPush, 128, 0, 5, 3, []byte("stale")))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 1500)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n >= kcpHeaderLen && binary.LittleEndian.Uint32(b) == 9 {
+			if b[4] != kcpCmdReset {
+				t.Fatalf("unexpected cmd %d", b[4])
+			}
+			break
+		}
+	}
+}
+
+func TestKCPServer_IPFilter(t *testing.T) {
+	filter, err := NewIPFilter(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &KCPServer{
+		Addr:     "127.0.0.1:0",
+		IPFilter: filter,
+		NewAgent: func(conn *KCPConn) Agent {
+			t.Error("denied conn served")
+			return &kcpEchoAgent{conn: conn, convs: make(chan uint32, 1)}
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("udp", server.server.lns[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(appendKCPSegment(nil, 1, kcpCmdPush, 128, 0, 0, 0, []byte("hello")))
+
+	deadline := time.Now().Add(time.Second)
+	for server.Metrics.Snapshot().Rejected["ip_denied"] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("conn not denied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
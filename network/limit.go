@@ -0,0 +1,321 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("rate limited")
+
+var (
+	errIPDenied     = errors.New("ip denied")
+	errAcceptRate   = errors.New("accept rate exceeded")
+	errTooManyPerIP = errors.New("too many connections from ip")
+)
+
+// RateLimitAction is what a conn does when its peer sends faster than the message or byte rate
+type RateLimitAction int
+
+const (
+	// RateLimitThrottle delays the read until the peer is within the rate again
+	RateLimitThrottle RateLimitAction = iota
+	// RateLimitDrop discards the messages over the rate
+	RateLimitDrop
+	// RateLimitDisconnect destroys the conn, ReadMsg returns ErrRateLimited
+	RateLimitDisconnect
+)
+
+func (a RateLimitAction) String() string {
+	switch a {
+	case RateLimitThrottle:
+		return "throttle"
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+// tokenBucket refills rate tokens per second up to burst, goroutine not safe
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns nil if rate is not positive, burst defaults to rate
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// has reports whether n tokens are available, n is capped at burst so that a large message can pass at all
+func (tb *tokenBucket) has(now time.Time, n float64) bool {
+	if tb == nil {
+		return true
+	}
+	tb.refill(now)
+	if n > tb.burst {
+		n = tb.burst
+	}
+	return tb.tokens >= n
+}
+
+func (tb *tokenBucket) take(n float64) {
+	if tb == nil {
+		return
+	}
+	if n > tb.burst {
+		n = tb.burst
+	}
+	tb.tokens -= n
+}
+
+// reserve takes n tokens and returns how long to wait until they are paid off
+func (tb *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	if tb == nil {
+		return 0
+	}
+	tb.refill(now)
+	tb.take(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// msgLimiter limits the messages a conn reads, goroutine not safe
+type msgLimiter struct {
+	msgs  *tokenBucket
+	bytes *tokenBucket
+	cfg   *connConfig
+}
+
+// newMsgLimiter returns nil if neither the message nor the byte rate is set
+func newMsgLimiter(cfg *connConfig) *msgLimiter {
+	msgs := newTokenBucket(cfg.msgRate, cfg.msgBurst)
+	bytes := newTokenBucket(cfg.byteRate, cfg.byteBurst)
+	if msgs == nil && bytes == nil {
+		return nil
+	}
+	return &msgLimiter{msgs: msgs, bytes: bytes, cfg: cfg}
+}
+
+// check reports whether to deliver the message of n bytes read from conn
+func (l *msgLimiter) check(conn Conn, n int) (bool, error) {
+	if l == nil {
+		return true, nil
+	}
+
+	now := time.Now()
+	if l.cfg.rateLimitAction == RateLimitThrottle {
+		wait := l.msgs.reserve(now, 1)
+		if w := l.bytes.reserve(now, float64(n)); w > wait {
+			wait = w
+		}
+		if wait > 0 {
+			l.cfg.rateLimited(conn)
+			time.Sleep(wait)
+		}
+		return true, nil
+	}
+
+	if l.msgs.has(now, 1) && l.bytes.has(now, float64(n)) {
+		l.msgs.take(1)
+		l.bytes.take(float64(n))
+		return true, nil
+	}
+	l.cfg.rateLimited(conn)
+	if l.cfg.rateLimitAction == RateLimitDisconnect {
+		destroyWithReason(conn, CloseRateLimited)
+		return false, ErrRateLimited
+	}
+	return false, nil
+}
+
+// IPFilter admits the ips by the allow and deny CIDR lists, a bare ip is taken as a single host,
+// the deny list wins and an empty allow list allows all
+// goroutine safe
+type IPFilter struct {
+	mu    sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	f := new(IPFilter)
+	if err := f.Reload(allow, deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload replaces both lists, the filter is unchanged on error
+func (f *IPFilter) Reload(allow, deny []string) error {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return err
+	}
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.allow = allowNets
+	f.deny = denyNets
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *IPFilter) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("invalid ip " + s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// addrIP returns the ip of a tcp or an ip:port addr, nil for the others
+func addrIP(addr string) net.IP {
+	return net.ParseIP(addrHost(addr))
+}
+
+// connLimiter admits the accepted conns by the ip filter, the accept rate and the conns per ip
+// goroutine safe
+type connLimiter struct {
+	mu       sync.Mutex
+	filter   *IPFilter
+	maxPerIP int
+	accept   *tokenBucket
+	perIP    map[string]int
+}
+
+// newConnLimiter returns nil if there is nothing to limit
+func newConnLimiter(filter *IPFilter, maxPerIP int, acceptRate float64, acceptBurst int) *connLimiter {
+	accept := newTokenBucket(acceptRate, acceptBurst)
+	if filter == nil && maxPerIP <= 0 && accept == nil {
+		return nil
+	}
+	return &connLimiter{
+		filter:   filter,
+		maxPerIP: maxPerIP,
+		accept:   accept,
+		perIP:    make(map[string]int),
+	}
+}
+
+// admit counts the conn from addr if it is admitted, call release when it is gone,
+// the ip filter and the conns per ip pass the addrs without an ip, such as the unix ones
+func (l *connLimiter) admit(addr string) error {
+	if l == nil {
+		return nil
+	}
+
+	ip := addrIP(addr)
+	if ip != nil && l.filter != nil && !l.filter.Allowed(ip) {
+		return errIPDenied
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// the per ip cap goes first not to waste the accept tokens on the rejected conns
+	countIP := ip != nil && l.maxPerIP > 0
+	if countIP && l.perIP[ip.String()] >= l.maxPerIP {
+		return errTooManyPerIP
+	}
+	if l.accept != nil {
+		if !l.accept.has(time.Now(), 1) {
+			return errAcceptRate
+		}
+		l.accept.take(1)
+	}
+	if countIP {
+		l.perIP[ip.String()]++
+	}
+	return nil
+}
+
+func (l *connLimiter) release(addr string) {
+	if l == nil || l.maxPerIP <= 0 {
+		return
+	}
+
+	ip := addrIP(addr)
+	if ip == nil {
+		return
+	}
+	key := ip.String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.perIP[key] <= 1 {
+		delete(l.perIP, key)
+	} else {
+		l.perIP[key]--
+	}
+}
@@ -0,0 +1,127 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIPFilter(t *testing.T) {
+	f, err := NewIPFilter([]string{"10.0.0.0/8", "192.168.1.1"}, []string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, allowed := range map[string]bool{
+		"10.1.2.3":    true,
+		"10.0.0.1":    false,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+	} {
+		if f.Allowed(net.ParseIP(ip)) != allowed {
+			t.Fatalf("%v allowed is not %v", ip, allowed)
+		}
+	}
+
+	if err := f.Reload(nil, []string{"bad"}); err == nil {
+		t.Fatal("invalid cidr reloaded")
+	}
+	if !f.Allowed(net.ParseIP("10.1.2.3")) {
+		t.Fatal("filter changed by a failed reload")
+	}
+	if err := f.Reload(nil, []string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	if f.Allowed(net.ParseIP("10.1.2.3")) || !f.Allowed(net.ParseIP("192.168.1.2")) {
+		t.Fatal("reload not applied")
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter(nil, 2, 0, 0)
+	for i := 0; i < 2; i++ {
+		if err := l.admit("1.2.3.4:1000"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.admit("1.2.3.4:1001"); err != errTooManyPerIP {
+		t.Fatalf("third conn from ip, got error %v", err)
+	}
+	if err := l.admit("5.6.7.8:1000"); err != nil {
+		t.Fatal(err)
+	}
+	l.release("1.2.3.4:1000")
+	if err := l.admit("1.2.3.4:1001"); err != nil {
+		t.Fatal(err)
+	}
+
+	l = newConnLimiter(nil, 0, 1, 1)
+	if err := l.admit("1.2.3.4:1000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.admit("1.2.3.4:1000"); err != errAcceptRate {
+		t.Fatalf("accept over rate, got error %v", err)
+	}
+
+	// the per ip cap rejects before an accept token is taken
+	l = newConnLimiter(nil, 1, 1, 1)
+	l.perIP["1.2.3.4"] = 1
+	if err := l.admit("1.2.3.4:1000"); err != errTooManyPerIP {
+		t.Fatalf("second conn from ip, got error %v", err)
+	}
+	if err := l.admit("5.6.7.8:1000"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the unix addrs have no ip to filter or count by
+	filter, err := NewIPFilter([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = newConnLimiter(filter, 1, 0, 0)
+	for i := 0; i < 2; i++ {
+		if err := l.admit("@"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.release("@")
+	if len(l.perIP) != 0 {
+		t.Fatalf("unix conns counted %v", l.perIP)
+	}
+}
+
+func TestMsgLimiter(t *testing.T) {
+	var limited int
+	cfg := &connConfig{
+		msgRate:         2,
+		rateLimitAction: RateLimitDrop,
+		onRateLimit:     func(conn Conn, action RateLimitAction) { limited++ },
+	}
+	l := newMsgLimiter(cfg)
+	conn := new(recordConn)
+	for i, want := range []bool{true, true, false} {
+		deliver, err := l.check(conn, 10)
+		if err != nil || deliver != want {
+			t.Fatalf("message %d delivered %v, error %v", i, deliver, err)
+		}
+	}
+	if limited != 1 {
+		t.Fatalf("rate limited %d times", limited)
+	}
+
+	cfg.rateLimitAction = RateLimitDisconnect
+	if _, err := l.check(conn, 10); err != ErrRateLimited {
+		t.Fatalf("disconnect, got error %v", err)
+	}
+
+	cfg = &connConfig{byteRate: 1000, byteBurst: 100, rateLimitAction: RateLimitThrottle}
+	l = newMsgLimiter(cfg)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if deliver, _ := l.check(conn, 100); !deliver {
+			t.Fatal("throttled message not delivered")
+		}
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("throttled for %v only", d)
+	}
+}
@@ -0,0 +1,125 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+var errNoListenerFile = errors.New("listener has no file")
+
+// listen opens the listeners of the server, one for each accept loop, which share it unless ReusePort is set
+func (server *TCPServer) listen() ([]net.Listener, error) {
+	if server.AcceptLoops <= 0 {
+		server.AcceptLoops = 1
+	}
+	if server.Network == "" {
+		server.Network = "tcp"
+	}
+
+	if server.Listener != nil || server.InheritFd > 0 {
+		ln := server.Listener
+		if ln == nil {
+			var err error
+			ln, err = inheritListener(server.InheritFd)
+			if err != nil {
+				return nil, err
+			}
+		}
+		lns := make([]net.Listener, server.AcceptLoops)
+		for i := range lns {
+			lns[i] = ln
+		}
+		return lns, nil
+	}
+
+	if server.Network == "unix" {
+		if err := removeStaleSocket(server.Addr); err != nil {
+			return nil, err
+		}
+	}
+	if !server.ReusePort {
+		ln, err := net.Listen(server.Network, server.Addr)
+		if err != nil {
+			return nil, err
+		}
+		lns := make([]net.Listener, server.AcceptLoops)
+		for i := range lns {
+			lns[i] = ln
+		}
+		return lns, nil
+	}
+
+	// the others bind the address of the first, the port it got for port 0
+	lns := make([]net.Listener, 0, server.AcceptLoops)
+	for i := 0; i < server.AcceptLoops; i++ {
+		addr := server.Addr
+		if i > 0 {
+			addr = lns[0].Addr().String()
+		}
+		ln, err := listenReusePort(server.Network, addr)
+		if err != nil {
+			closeListeners(lns)
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// inheritListener returns the listener of fd, e.g. 3 for the first of exec.Cmd.ExtraFiles
+func inheritListener(fd int) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("listener-%d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid listener fd %d", fd)
+	}
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherit listener fd %d: %w", fd, err)
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket file a crashed process left, the one a live server listens on is in use
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return &net.OpError{Op: "listen", Net: "unix", Addr: &net.UnixAddr{Name: path, Net: "unix"}, Err: syscall.EADDRINUSE}
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// closeListeners closes the distinct listeners of lns
+func closeListeners(lns []net.Listener) {
+	for i, ln := range lns {
+		if i == 0 || ln != lns[i-1] {
+			ln.Close()
+		}
+	}
+}
+
+// ListenerFile returns a duplicate of the listening socket, pass it to the new process by exec.Cmd.ExtraFiles
+// and serve it there by InheritFd so the restart refuses no conn
+func (server *TCPServer) ListenerFile() (*os.File, error) {
+	if len(server.rawLns) == 0 {
+		return nil, errNoListenerFile
+	}
+	ln, ok := server.rawLns[0].(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errNoListenerFile
+	}
+	return ln.File()
+}
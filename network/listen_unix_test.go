@@ -0,0 +1,123 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package network
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func newListenTestServer(t *testing.T, server *TCPServer) *TCPServer {
+	t.Helper()
+	server.NewAgent = func(conn *TCPConn) Agent {
+		return &pipeEchoAgent{conn: conn}
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func echoOver(t *testing.T, network, addr string) {
+	t.Helper()
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := NewFakeClient(conn, nil, Faults{})
+	if err := c.Roundtrip([]byte("hello"), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTCPServer_Unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "srv.sock")
+	server := newListenTestServer(t, &TCPServer{Network: "unix", Addr: path})
+	echoOver(t, "unix", path)
+	server.Close()
+
+	// a stale socket file does not stop the next start
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	server = newListenTestServer(t, &TCPServer{Network: "unix", Addr: path})
+	defer server.Close()
+	echoOver(t, "unix", path)
+
+	// the socket of a live server is kept
+	busy := &TCPServer{Network: "unix", Addr: path, NewAgent: server.NewAgent}
+	if err := busy.Start(); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	echoOver(t, "unix", path)
+}
+
+func TestTCPServer_ReusePort(t *testing.T) {
+	server := newListenTestServer(t, &TCPServer{Addr: "127.0.0.1:0", ReusePort: true})
+	addr := server.lns[0].Addr().String()
+
+	// another server binds the same port
+	other := newListenTestServer(t, &TCPServer{Addr: addr, ReusePort: true, AcceptLoops: 4})
+	defer other.Close()
+	if len(other.lns) != 4 {
+		t.Fatalf("listeners %v", len(other.lns))
+	}
+	for i := 0; i < 10; i++ {
+		echoOver(t, "tcp", addr)
+	}
+
+	server.Close()
+	echoOver(t, "tcp", addr)
+
+	// the listeners of port 0 share the port the first got
+	zero := newListenTestServer(t, &TCPServer{Addr: "127.0.0.1:0", ReusePort: true, AcceptLoops: 4})
+	defer zero.Close()
+	for _, ln := range zero.lns {
+		if ln.Addr().String() != zero.lns[0].Addr().String() {
+			t.Fatalf("listeners on %v and %v", zero.lns[0].Addr(), ln.Addr())
+		}
+	}
+}
+
+func TestTCPServer_InheritFd(t *testing.T) {
+	old := newListenTestServer(t, &TCPServer{Addr: "127.0.0.1:0"})
+	addr := old.lns[0].Addr().String()
+	f, err := old.ListenerFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the new process owns the fd it inherits
+	fd, err := unix.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newListenTestServer(t, &TCPServer{InheritFd: fd, AcceptLoops: 2})
+	defer server.Close()
+	old.Close()
+	echoOver(t, "tcp", addr)
+}
+
+func TestTCPServer_StartError(t *testing.T) {
+	server := newListenTestServer(t, &TCPServer{Addr: "127.0.0.1:0"})
+	defer server.Close()
+
+	busy := &TCPServer{Addr: server.lns[0].Addr().String(), NewAgent: server.NewAgent}
+	if err := busy.Start(); err == nil {
+		t.Fatal("listen on a busy port")
+	}
+	noAgent := &TCPServer{Addr: "127.0.0.1:0"}
+	if err := noAgent.Start(); err == nil {
+		t.Fatal("start without NewAgent")
+	}
+}
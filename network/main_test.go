@@ -0,0 +1,14 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gzjjyz/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitLogger(logger.WithAppName("test"), logger.WithPath(filepath.Join(os.TempDir(), "srvlib_network_test")))
+	os.Exit(m.Run())
+}
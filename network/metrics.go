@@ -0,0 +1,333 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseReason tells why a conn was closed, the first reason recorded wins
+type CloseReason int32
+
+const (
+	CloseUnknown CloseReason = iota
+	// ClosePeerEOF the peer closed the conn
+	ClosePeerEOF
+	// CloseLocal Close was called
+	CloseLocal
+	// CloseDestroy Destroy was called
+	CloseDestroy
+	// CloseChannelFull the write queue overflowed
+	CloseChannelFull
+	// CloseTimeout an idle timeout or a deadline expired
+	CloseTimeout
+	// CloseRateLimited the peer sent over the rate limits
+	CloseRateLimited
+	// CloseError a read or write error
+	CloseError
+	closeReasonNum
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case ClosePeerEOF:
+		return "peer_eof"
+	case CloseLocal:
+		return "local"
+	case CloseDestroy:
+		return "destroy"
+	case CloseChannelFull:
+		return "channel_full"
+	case CloseTimeout:
+		return "timeout"
+	case CloseRateLimited:
+		return "rate_limited"
+	case CloseError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// readCloseReason classifies a read error
+func readCloseReason(err error) CloseReason {
+	if _, ok := err.(*websocket.CloseError); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ClosePeerEOF
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return CloseTimeout
+	}
+	return CloseError
+}
+
+// the reasons a server or a client refuses a conn
+const (
+	rejectMaxConn   = "max_conn"
+	rejectHandshake = "handshake"
+	rejectUpgrade   = "upgrade"
+	rejectDial      = "dial"
+)
+
+func limitRejectReason(err error) string {
+	switch err {
+	case errIPDenied:
+		return "ip_denied"
+	case errAcceptRate:
+		return "accept_rate"
+	case errTooManyPerIP:
+		return "max_conn_per_ip"
+	}
+	return "limit"
+}
+
+// ConnStats are the counters of a conn
+type ConnStats struct {
+	ConnectedAt    time.Time
+	BytesIn        uint64
+	BytesOut       uint64
+	MsgsIn         uint64
+	MsgsOut        uint64
+	QueueLen       int
+	QueueHighWater int
+	CloseReason    CloseReason
+}
+
+type closeReasonSetter interface {
+	setCloseReason(reason CloseReason)
+}
+
+// destroyWithReason destroys conn, the reason is recorded if conn keeps one
+func destroyWithReason(conn Conn, reason CloseReason) {
+	if s, ok := conn.(closeReasonSetter); ok {
+		s.setCloseReason(reason)
+	}
+	conn.Destroy()
+}
+
+// connStats counts the io of a conn and adds it to the metrics of its server or client
+// goroutine safe
+type connStats struct {
+	metrics        *Metrics
+	connectedAt    time.Time
+	bytesIn        atomic.Uint64
+	bytesOut       atomic.Uint64
+	msgsIn         atomic.Uint64
+	msgsOut        atomic.Uint64
+	queueHighWater atomic.Int64
+	reason         atomic.Int32
+}
+
+func newConnStats(metrics *Metrics) *connStats {
+	return &connStats{metrics: metrics, connectedAt: time.Now()}
+}
+
+func (s *connStats) read(n int) {
+	s.bytesIn.Add(uint64(n))
+	if s.metrics != nil {
+		s.metrics.bytesIn.Add(uint64(n))
+	}
+}
+
+func (s *connStats) wrote(n int) {
+	s.bytesOut.Add(uint64(n))
+	if s.metrics != nil {
+		s.metrics.bytesOut.Add(uint64(n))
+	}
+}
+
+func (s *connStats) readMsg() {
+	s.msgsIn.Add(1)
+	if s.metrics != nil {
+		s.metrics.msgsIn.Add(1)
+	}
+}
+
+func (s *connStats) wroteMsg() {
+	s.msgsOut.Add(1)
+	if s.metrics != nil {
+		s.metrics.msgsOut.Add(1)
+	}
+}
+
+func (s *connStats) queued(depth int) {
+	storeMax(&s.queueHighWater, int64(depth))
+	if s.metrics != nil {
+		storeMax(&s.metrics.queueHighWater, int64(depth))
+	}
+}
+
+func (s *connStats) setCloseReason(reason CloseReason) {
+	s.reason.CompareAndSwap(int32(CloseUnknown), int32(reason))
+}
+
+func (s *connStats) closeReason() CloseReason {
+	return CloseReason(s.reason.Load())
+}
+
+func (s *connStats) snapshot(queueLen int) ConnStats {
+	return ConnStats{
+		ConnectedAt:    s.connectedAt,
+		BytesIn:        s.bytesIn.Load(),
+		BytesOut:       s.bytesOut.Load(),
+		MsgsIn:         s.msgsIn.Load(),
+		MsgsOut:        s.msgsOut.Load(),
+		QueueLen:       queueLen,
+		QueueHighWater: int(s.queueHighWater.Load()),
+		CloseReason:    s.closeReason(),
+	}
+}
+
+func storeMax(v *atomic.Int64, n int64) {
+	for {
+		old := v.Load()
+		if n <= old || v.CompareAndSwap(old, n) {
+			return
+		}
+	}
+}
+
+// Metrics are the counters and the gauges of the conns of a server or a client,
+// several servers may share one, the servers and the clients create their own if they are not given one
+// goroutine safe
+type Metrics struct {
+	name           string
+	accepted       atomic.Uint64
+	active         atomic.Int64
+	bytesIn        atomic.Uint64
+	bytesOut       atomic.Uint64
+	msgsIn         atomic.Uint64
+	msgsOut        atomic.Uint64
+	queueHighWater atomic.Int64
+	closed         [closeReasonNum]atomic.Uint64
+
+	mutexRejected sync.Mutex
+	rejected      map[string]uint64
+}
+
+// NewMetrics returns the metrics labeled by name in the prometheus text
+func NewMetrics(name string) *Metrics {
+	return &Metrics{name: name, rejected: make(map[string]uint64)}
+}
+
+func (m *Metrics) accept() {
+	if m != nil {
+		m.accepted.Add(1)
+	}
+}
+
+func (m *Metrics) reject(reason string) {
+	if m == nil {
+		return
+	}
+	m.mutexRejected.Lock()
+	m.rejected[reason]++
+	m.mutexRejected.Unlock()
+}
+
+func (m *Metrics) open() {
+	if m != nil {
+		m.active.Add(1)
+	}
+}
+
+func (m *Metrics) close(reason CloseReason) {
+	if m == nil {
+		return
+	}
+	m.active.Add(-1)
+	m.closed[reason].Add(1)
+}
+
+// MetricsSnapshot is a copy of Metrics, Rejected and Closed are by reason,
+// Accepted counts the conns of the servers before they are admitted, the rejected ones included
+type MetricsSnapshot struct {
+	Name           string
+	Accepted       uint64
+	Rejected       map[string]uint64
+	Active         int64
+	BytesIn        uint64
+	BytesOut       uint64
+	MsgsIn         uint64
+	MsgsOut        uint64
+	QueueHighWater int
+	Closed         map[string]uint64
+}
+
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	s := MetricsSnapshot{
+		Name:           m.name,
+		Accepted:       m.accepted.Load(),
+		Rejected:       make(map[string]uint64),
+		Active:         m.active.Load(),
+		BytesIn:        m.bytesIn.Load(),
+		BytesOut:       m.bytesOut.Load(),
+		MsgsIn:         m.msgsIn.Load(),
+		MsgsOut:        m.msgsOut.Load(),
+		QueueHighWater: int(m.queueHighWater.Load()),
+		Closed:         make(map[string]uint64),
+	}
+
+	m.mutexRejected.Lock()
+	for reason, n := range m.rejected {
+		s.Rejected[reason] = n
+	}
+	m.mutexRejected.Unlock()
+
+	for reason := CloseUnknown; reason < closeReasonNum; reason++ {
+		if n := m.closed[reason].Load(); n > 0 {
+			s.Closed[reason.String()] = n
+		}
+	}
+	return s
+}
+
+// MetricsHandler serves the metrics in the prometheus text format
+func MetricsHandler(metrics ...*Metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshots := make([]MetricsSnapshot, len(metrics))
+		for i, m := range metrics {
+			snapshots[i] = m.Snapshot()
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheus(w, snapshots)
+	})
+}
+
+func writePrometheus(w io.Writer, snapshots []MetricsSnapshot) {
+	family := func(name, typ, help string, value func(s MetricsSnapshot) interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, s := range snapshots {
+			fmt.Fprintf(w, "%s{name=%q} %v\n", name, s.Name, value(s))
+		}
+	}
+	byReason := func(name, help string, values func(s MetricsSnapshot) map[string]uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, s := range snapshots {
+			counts := values(s)
+			reasons := make([]string, 0, len(counts))
+			for reason := range counts {
+				reasons = append(reasons, reason)
+			}
+			sort.Strings(reasons)
+			for _, reason := range reasons {
+				fmt.Fprintf(w, "%s{name=%q,reason=%q} %d\n", name, s.Name, reason, counts[reason])
+			}
+		}
+	}
+
+	family("srvlib_conns_accepted_total", "counter", "Conns accepted or dialed.", func(s MetricsSnapshot) interface{} { return s.Accepted })
+	byReason("srvlib_conns_rejected_total", "Conns refused or failed to connect.", func(s MetricsSnapshot) map[string]uint64 { return s.Rejected })
+	family("srvlib_conns_active", "gauge", "Conns served now.", func(s MetricsSnapshot) interface{} { return s.Active })
+	byReason("srvlib_conns_closed_total", "Conns closed.", func(s MetricsSnapshot) map[string]uint64 { return s.Closed })
+	family("srvlib_bytes_in_total", "counter", "Bytes read.", func(s MetricsSnapshot) interface{} { return s.BytesIn })
+	family("srvlib_bytes_out_total", "counter", "Bytes written.", func(s MetricsSnapshot) interface{} { return s.BytesOut })
+	family("srvlib_msgs_in_total", "counter", "Messages read.", func(s MetricsSnapshot) interface{} { return s.MsgsIn })
+	family("srvlib_msgs_out_total", "counter", "Messages written.", func(s MetricsSnapshot) interface{} { return s.MsgsOut })
+	family("srvlib_write_queue_high_water", "gauge", "Most messages queued to write on a conn.", func(s MetricsSnapshot) interface{} { return s.QueueHighWater })
+}
@@ -0,0 +1,132 @@
+package network
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type statsTestAgent struct {
+	conn  *TCPConn
+	stats chan ConnStats
+}
+
+func (a *statsTestAgent) Run() {
+	for {
+		msg, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		a.conn.WriteMsg(msg)
+	}
+}
+
+func (a *statsTestAgent) OnClose() {
+	a.stats <- a.conn.Stats()
+}
+
+func TestMetrics(t *testing.T) {
+	stats := make(chan ConnStats, 1)
+	server := &TCPServer{
+		Addr:    "127.0.0.1:0",
+		Metrics: NewMetrics("gate"),
+		NewAgent: func(conn *TCPConn) Agent {
+			return &statsTestAgent{conn: conn, stats: stats}
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.lns[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser := NewMsgParser()
+	for i := 0; i < 3; i++ {
+		msg, _ := parser.PackFrame(nil, []byte("hello"))
+		conn.Write(msg)
+		if _, err := parser.Read(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+
+	var s ConnStats
+	select {
+	case s = <-stats:
+	case <-time.After(time.Second):
+		t.Fatal("conn not closed")
+	}
+	if s.MsgsIn != 3 || s.MsgsOut != 3 || s.BytesIn != 3*7 || s.CloseReason != ClosePeerEOF {
+		t.Fatalf("unexpected conn stats %+v", s)
+	}
+
+	// the server counts the close after OnClose
+	var m MetricsSnapshot
+	for i := 0; i < 100; i++ {
+		if m = server.Metrics.Snapshot(); m.Active == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m.Accepted != 1 || m.Active != 0 || m.MsgsIn != 3 || m.BytesOut != 3*7 || m.Closed["peer_eof"] != 1 {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+
+	w := httptest.NewRecorder()
+	MetricsHandler(server.Metrics).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`srvlib_conns_accepted_total{name="gate"} 1`,
+		`srvlib_conns_closed_total{name="gate",reason="peer_eof"} 1`,
+		`srvlib_msgs_in_total{name="gate"} 3`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Fatalf("%q missing in\n%s", line, w.Body.String())
+		}
+	}
+}
+
+func TestMetrics_AcceptDenied(t *testing.T) {
+	filter, err := NewIPFilter(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpServer := &TCPServer{
+		Addr:     "127.0.0.1:0",
+		IPFilter: filter,
+		NewAgent: func(conn *TCPConn) Agent { return &idleTestAgent{conn: conn, closed: make(chan struct{})} },
+	}
+	tcpServer.Start()
+	defer tcpServer.Close()
+	wsServer := &WSServer{
+		IPFilter: filter,
+		NewAgent: func(conn *WSConn) Agent { return &wsEchoAgent{conn: conn} },
+	}
+	ts := httptest.NewServer(wsServer.Handler())
+	defer ts.Close()
+	defer wsServer.Close()
+
+	conn, err := net.Dial("tcp", tcpServer.lns[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil); err == nil {
+		t.Fatal("denied ws conn upgraded")
+	}
+
+	// both count the denied conns as accepted and rejected
+	deadline := time.Now().Add(time.Second)
+	for _, m := range []*Metrics{tcpServer.Metrics, wsServer.Metrics} {
+		for s := m.Snapshot(); s.Accepted != 1 || s.Rejected["ip_denied"] != 1; s = m.Snapshot() {
+			if time.Now().After(deadline) {
+				t.Fatalf("unexpected metrics %+v", s)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
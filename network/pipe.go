@@ -0,0 +1,96 @@
+package network
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+// pipeConn is an end of net.Pipe with the addresses of a loopback conn
+type pipeConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// PipeListener is an in-memory listener, Dial connects to it by net.Pipe,
+// it is the Listener of TCPServer and its DialContext is the Dial of TCPClient to serve without binding ports.
+// the dialed conns look like loopback conns from 127.0.0.1 with their own ports
+// goroutine safe
+type PipeListener struct {
+	addr      pipeAddr
+	ports     atomic.Int32
+	conns     chan net.Conn
+	die       chan struct{}
+	closeOnce sync.Once
+}
+
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		addr:  "127.0.0.1:0",
+		conns: make(chan net.Conn),
+		die:   make(chan struct{}),
+	}
+}
+
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.die:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.die)
+	})
+	return nil
+}
+
+func (l *PipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Dial blocks until the listener accepts the conn
+func (l *PipeListener) Dial() (net.Conn, error) {
+	return l.DialContext(context.Background())
+}
+
+func (l *PipeListener) DialContext(ctx context.Context) (net.Conn, error) {
+	remote := pipeAddr("127.0.0.1:" + strconv.Itoa(int(l.ports.Add(1))))
+	c, s := net.Pipe()
+	select {
+	case l.conns <- &pipeConn{Conn: s, local: l.addr, remote: remote}:
+		return &pipeConn{Conn: c, local: remote, remote: l.addr}, nil
+	case <-l.die:
+		c.Close()
+		s.Close()
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		c.Close()
+		s.Close()
+		return nil, ctx.Err()
+	}
+}
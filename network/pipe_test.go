@@ -0,0 +1,124 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type pipeEchoAgent struct {
+	conn *TCPConn
+}
+
+func (a *pipeEchoAgent) Run() {
+	for {
+		msg, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		if string(msg) == "quit" {
+			return
+		}
+		a.conn.WriteMsg(msg)
+	}
+}
+
+func (a *pipeEchoAgent) OnClose() {}
+
+func newPipeEchoServer() (*TCPServer, *PipeListener) {
+	ln := NewPipeListener()
+	server := &TCPServer{
+		Listener: ln,
+		NewAgent: func(conn *TCPConn) Agent {
+			return &pipeEchoAgent{conn: conn}
+		},
+	}
+	server.Start()
+	return server, ln
+}
+
+func TestPipeListener_Faults(t *testing.T) {
+	server, ln := newPipeEchoServer()
+	defer server.Close()
+
+	for name, faults := range map[string]Faults{
+		"none":       {},
+		"latency":    {Latency: 5 * time.Millisecond},
+		"fragment":   {Fragment: true},
+		"slowreader": {ReadDelay: 5 * time.Millisecond},
+	} {
+		conn, err := ln.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := NewFakeClient(conn, nil, faults)
+		if err := c.Roundtrip([]byte("hello"), []byte("hello")); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		big := bytes.Repeat([]byte{1}, 1000)
+		if err := c.Roundtrip(big, big); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if err := c.Send([]byte("quit")); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if err := c.ExpectClosed(); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+	}
+}
+
+func TestPipeListener_Abort(t *testing.T) {
+	server, ln := newPipeEchoServer()
+	defer server.Close()
+
+	conn, _ := ln.Dial()
+	c := NewFakeClient(conn, nil, Faults{CloseAfter: 3})
+	if err := c.Send([]byte("hello")); err == nil {
+		t.Fatal("write not aborted")
+	}
+	// the server gives up the half written message
+	deadline := time.Now().Add(time.Second)
+	for server.Metrics.Snapshot().Active != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("conn still served")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPipeListener_TCPClient(t *testing.T) {
+	server, ln := newPipeEchoServer()
+	defer server.Close()
+
+	done := make(chan error, 1)
+	client := &TCPClient{
+		Dial: ln.DialContext,
+		NewAgent: func(conn *TCPConn) Agent {
+			return &pipeClientAgent{conn: conn, done: done}
+		},
+	}
+	client.Start()
+	defer client.Close()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+type pipeClientAgent struct {
+	conn *TCPConn
+	done chan error
+}
+
+func (a *pipeClientAgent) Run() {
+	a.conn.WriteMsg([]byte("ping"))
+	msg, err := a.conn.ReadMsg()
+	if err == nil && string(msg) != "ping" {
+		err = fmt.Errorf("received %q", msg)
+	}
+	a.done <- err
+}
+
+func (a *pipeClientAgent) OnClose() {}
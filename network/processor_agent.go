@@ -0,0 +1,82 @@
+package network
+
+import (
+	"github.com/gzjjyz/logger"
+)
+
+// ProcessorAgent runs the ReadMsg -> Unmarshal -> Route loop of a conn, the agent itself is
+// the userData of the routing
+type ProcessorAgent struct {
+	conn         Conn
+	processor    Processor
+	userData     interface{}
+	closeHandler func(a *ProcessorAgent)
+}
+
+func NewProcessorAgent(conn Conn, processor Processor) *ProcessorAgent {
+	return &ProcessorAgent{
+		conn:      conn,
+		processor: processor,
+	}
+}
+
+func (a *ProcessorAgent) Run() {
+	for {
+		data, err := a.conn.ReadMsg()
+		if err != nil {
+			logger.LogDebug("read message: %v", err)
+			break
+		}
+
+		msg, err := a.processor.Unmarshal(data)
+		if err != nil {
+			logger.LogDebug("unmarshal message error: %v", err)
+			break
+		}
+		err = a.processor.Route(msg, a)
+		if err != nil {
+			logger.LogDebug("route message error: %v", err)
+			break
+		}
+	}
+}
+
+func (a *ProcessorAgent) OnClose() {
+	if a.closeHandler != nil {
+		a.closeHandler(a)
+	}
+}
+
+// SetCloseHandler sets the function called by OnClose
+func (a *ProcessorAgent) SetCloseHandler(closeHandler func(a *ProcessorAgent)) {
+	a.closeHandler = closeHandler
+}
+
+func (a *ProcessorAgent) WriteMsg(msg interface{}) error {
+	data, err := a.processor.Marshal(msg)
+	if err != nil {
+		logger.LogError("marshal message %T error: %v", msg, err)
+		return err
+	}
+	return a.conn.WriteMsg(data...)
+}
+
+func (a *ProcessorAgent) Conn() Conn {
+	return a.conn
+}
+
+func (a *ProcessorAgent) Close() {
+	a.conn.Close()
+}
+
+func (a *ProcessorAgent) Destroy() {
+	a.conn.Destroy()
+}
+
+func (a *ProcessorAgent) UserData() interface{} {
+	return a.userData
+}
+
+func (a *ProcessorAgent) SetUserData(data interface{}) {
+	a.userData = data
+}
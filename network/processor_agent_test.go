@@ -0,0 +1,57 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/gzjjyz/srvlib/network/json"
+)
+
+type echoReq struct {
+	Text string `json:"text"`
+}
+
+type echoResp struct {
+	Text string `json:"text"`
+}
+
+func TestProcessorAgent(t *testing.T) {
+	p := json.NewProcessor()
+	p.Register(1, &echoReq{})
+	p.Register(2, &echoResp{})
+	p.SetHandler(1, func(msg interface{}, userData interface{}) {
+		userData.(*ProcessorAgent).WriteMsg(&echoResp{Text: msg.(*echoReq).Text})
+	})
+
+	closed := make(chan struct{})
+	ln := NewPipeListener()
+	server := &TCPServer{
+		Listener: ln,
+		NewAgent: func(conn *TCPConn) Agent {
+			a := NewProcessorAgent(conn, p)
+			a.SetCloseHandler(func(a *ProcessorAgent) {
+				close(closed)
+			})
+			return a
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	conn, err := ln.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewFakeClient(conn, nil, Faults{})
+	if err := c.Roundtrip([]byte(`{"id":1,"data":{"text":"hi"}}`), []byte(`{"id":2,"data":{"text":"hi"}}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// an unregistered message ends the agent
+	if err := c.Send([]byte(`{"id":3}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ExpectClosed(); err != nil {
+		t.Fatal(err)
+	}
+	<-closed
+}
@@ -0,0 +1,164 @@
+package protobuf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/gzjjyz/logger"
+	"github.com/gzjjyz/srvlib/pb3"
+)
+
+// -------------------------
+// | id | protobuf message |
+// -------------------------
+type Processor struct {
+	littleEndian bool
+	msgInfo      map[uint32]*MsgInfo
+	msgId        map[reflect.Type]uint32
+}
+
+type MsgInfo struct {
+	msgType    reflect.Type
+	msgHandler MsgHandler
+	msgSender  MsgSender
+}
+
+type MsgHandler func(msg pb3.Message, userData interface{})
+
+// MsgSender is satisfied by worker.Worker and worker/v2.Worker, the routed message is sent with
+// the msg id and the params msg, userData
+type MsgSender interface {
+	SendMsg(id uint32, params ...interface{})
+}
+
+func NewProcessor() *Processor {
+	p := new(Processor)
+	p.littleEndian = false
+	p.msgInfo = make(map[uint32]*MsgInfo)
+	p.msgId = make(map[reflect.Type]uint32)
+	return p
+}
+
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) SetByteOrder(littleEndian bool) {
+	p.littleEndian = littleEndian
+}
+
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) Register(id uint32, msg pb3.Message) {
+	msgType := reflect.TypeOf(msg)
+	if msgType == nil || msgType.Kind() != reflect.Ptr {
+		logger.LogFatal("protobuf message pointer required")
+	}
+	if _, ok := p.msgInfo[id]; ok {
+		logger.LogFatal("message id %v is already registered", id)
+	}
+	if _, ok := p.msgId[msgType]; ok {
+		logger.LogFatal("message %s is already registered", msgType)
+	}
+
+	p.msgInfo[id] = &MsgInfo{msgType: msgType}
+	p.msgId[msgType] = id
+}
+
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) SetHandler(id uint32, msgHandler MsgHandler) {
+	i, ok := p.msgInfo[id]
+	if !ok {
+		logger.LogFatal("message id %v not registered", id)
+	}
+
+	i.msgHandler = msgHandler
+}
+
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) SetWorker(id uint32, msgSender MsgSender) {
+	i, ok := p.msgInfo[id]
+	if !ok {
+		logger.LogFatal("message id %v not registered", id)
+	}
+
+	i.msgSender = msgSender
+}
+
+// MsgId returns the registered id of the message
+func (p *Processor) MsgId(msg interface{}) (uint32, error) {
+	msgType := reflect.TypeOf(msg)
+	id, ok := p.msgId[msgType]
+	if !ok {
+		return 0, fmt.Errorf("message %s not registered", msgType)
+	}
+	return id, nil
+}
+
+// goroutine safe
+func (p *Processor) Route(msg interface{}, userData interface{}) error {
+	id, err := p.MsgId(msg)
+	if err != nil {
+		return err
+	}
+
+	i := p.msgInfo[id]
+	if i.msgHandler != nil {
+		i.msgHandler(msg.(pb3.Message), userData)
+	}
+	if i.msgSender != nil {
+		i.msgSender.SendMsg(id, msg, userData)
+	}
+	return nil
+}
+
+// goroutine safe
+func (p *Processor) Unmarshal(data []byte) (interface{}, error) {
+	if len(data) < 4 {
+		return nil, errors.New("protobuf data too short")
+	}
+
+	// id
+	var id uint32
+	if p.littleEndian {
+		id = binary.LittleEndian.Uint32(data)
+	} else {
+		id = binary.BigEndian.Uint32(data)
+	}
+
+	// msg
+	i, ok := p.msgInfo[id]
+	if !ok {
+		return nil, fmt.Errorf("message id %v not registered", id)
+	}
+	msg := reflect.New(i.msgType.Elem()).Interface().(pb3.Message)
+	return msg, pb3.Unmarshal(data[4:], msg)
+}
+
+// goroutine safe
+func (p *Processor) Marshal(msg interface{}) ([][]byte, error) {
+	pbMsg, ok := msg.(pb3.Message)
+	if !ok {
+		return nil, errors.New("protobuf message required")
+	}
+	_id, err := p.MsgId(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 4)
+	if p.littleEndian {
+		binary.LittleEndian.PutUint32(id, _id)
+	} else {
+		binary.BigEndian.PutUint32(id, _id)
+	}
+
+	// data
+	data, err := pb3.Marshal(pbMsg)
+	return [][]byte{id, data}, err
+}
+
+// goroutine safe
+func (p *Processor) Range(f func(id uint32, t reflect.Type)) {
+	for id, i := range p.msgInfo {
+		f(id, i.msgType)
+	}
+}
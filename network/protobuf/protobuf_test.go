@@ -0,0 +1,48 @@
+package protobuf
+
+import (
+	"testing"
+
+	"github.com/gzjjyz/srvlib/pb3"
+	"github.com/gzjjyz/srvlib/pb3/health"
+)
+
+type testSender struct {
+	id     uint32
+	params []interface{}
+}
+
+func (s *testSender) SendMsg(id uint32, params ...interface{}) {
+	s.id, s.params = id, params
+}
+
+func TestProcessor(t *testing.T) {
+	p := NewProcessor()
+	p.Register(1, &health.PingReq{})
+	p.Register(2, &health.NodeHealthDesc{})
+
+	var handled *health.NodeHealthDesc
+	p.SetHandler(2, func(msg pb3.Message, userData interface{}) {
+		handled = msg.(*health.NodeHealthDesc)
+	})
+	sender := &testSender{}
+	p.SetWorker(2, sender)
+
+	data, err := p.Marshal(&health.NodeHealthDesc{FailedCnt: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := p.Unmarshal(append(data[0], data[1]...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Route(msg, "agent"); err != nil {
+		t.Fatal(err)
+	}
+	if handled == nil || handled.FailedCnt != 3 {
+		t.Fatalf("unexpected handled msg %v", handled)
+	}
+	if sender.id != 2 || sender.params[1] != "agent" {
+		t.Fatalf("unexpected worker msg %d %v", sender.id, sender.params)
+	}
+}
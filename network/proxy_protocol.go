@@ -0,0 +1,263 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gzjjyz/logger"
+)
+
+var (
+	proxyV1Prefix  = []byte("PROXY ")
+	proxyV2Sig     = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	errProxyHeader = errors.New("invalid proxy protocol header")
+)
+
+const proxyV1MaxLen = 107
+
+// proxyConn is a conn behind a proxy, its addresses are the ones the PROXY protocol header tells
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header,
+// the addresses are kept for the UNKNOWN v1 and the LOCAL v2 headers
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	c := &proxyConn{
+		Conn:   conn,
+		r:      bufio.NewReaderSize(conn, 256),
+		local:  conn.LocalAddr(),
+		remote: conn.RemoteAddr(),
+	}
+
+	sig, err := c.r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		return c, c.readV2()
+	}
+	if bytes.HasPrefix(sig, proxyV1Prefix) {
+		return c, c.readV1()
+	}
+	return nil, errProxyHeader
+}
+
+// PROXY TCP4|TCP6|UNKNOWN src dst srcport dstport\r\n
+func (c *proxyConn) readV1() error {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+	if len(line) > proxyV1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errProxyHeader
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return errProxyHeader
+	}
+	src, err := proxyTCPAddr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := proxyTCPAddr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remote, c.local = src, dst
+	return nil
+}
+
+func proxyTCPAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr.IP == nil || err != nil {
+		return nil, errProxyHeader
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+// | sig(12) | version 2, command(1) | family, protocol(1) | len(2) | addresses | tlvs |
+func (c *proxyConn) readV2() error {
+	var h [16]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return err
+	}
+	if h[12]>>4 != 2 {
+		return errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return err
+	}
+
+	// LOCAL, the proxy itself connects
+	if h[12]&0xf == 0 {
+		return nil
+	}
+	if h[12]&0xf != 1 {
+		return errProxyHeader
+	}
+
+	var ipLen int
+	switch h[13] >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// unix or unspecified, there is no ip to tell
+		return nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return errProxyHeader
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	c.remote, c.local = src, dst
+	return nil
+}
+
+type proxyAccept struct {
+	conn net.Conn
+	err  error
+}
+
+// proxyListener reads the PROXY protocol headers of the conns from the trusted proxies, all the peers if trusted is empty,
+// the headers are read in their own goroutines and the conns without a valid header are closed
+type proxyListener struct {
+	net.Listener
+	trusted   []*net.IPNet
+	timeout   time.Duration
+	accepts   chan proxyAccept
+	die       chan struct{}
+	closeOnce sync.Once
+}
+
+func newProxyListener(ln net.Listener, trusted []*net.IPNet, timeout time.Duration) *proxyListener {
+	l := &proxyListener{
+		Listener: ln,
+		trusted:  trusted,
+		timeout:  timeout,
+		accepts:  make(chan proxyAccept),
+		die:      make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.accepts <- proxyAccept{err: err}:
+			case <-l.die:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		if len(l.trusted) > 0 && !containsIP(l.trusted, addrIP(conn.RemoteAddr().String())) {
+			l.deliver(conn)
+			continue
+		}
+		go func() {
+			conn.SetReadDeadline(time.Now().Add(l.timeout))
+			pc, err := readProxyHeader(conn)
+			if err != nil {
+				logger.LogDebug("proxy protocol header from %v error: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			conn.SetReadDeadline(time.Time{})
+			l.deliver(pc)
+		}()
+	}
+}
+
+func (l *proxyListener) deliver(conn net.Conn) {
+	select {
+	case l.accepts <- proxyAccept{conn: conn}:
+	case <-l.die:
+		conn.Close()
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-l.accepts:
+		return a.conn, a.err
+	case <-l.die:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.die)
+	})
+	return l.Listener.Close()
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrHost returns the host of a host:port addr, addr itself if it has no port
+func addrHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
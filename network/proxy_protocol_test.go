@@ -0,0 +1,108 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	b := append([]byte(nil), proxyV2Sig...)
+	b = append(b, 0x21, 0x11, 0, 12)
+	b = append(b, src.To4()...)
+	b = append(b, dst.To4()...)
+	b = binary.BigEndian.AppendUint16(b, srcPort)
+	return binary.BigEndian.AppendUint16(b, dstPort)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, tc := range []struct {
+		header []byte
+		remote string
+	}{
+		{[]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\n"), "1.2.3.4:1111"},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 1111 2222\r\n"), "[2001:db8::1]:1111"},
+		{[]byte("PROXY UNKNOWN\r\n"), "pipe"},
+		{proxyV2Header(net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8), 1111, 2222), "1.2.3.4:1111"},
+	} {
+		c, s := net.Pipe()
+		go func() {
+			c.Write(append(tc.header, "data"...))
+			c.Close()
+		}()
+		pc, err := readProxyHeader(s)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.header, err)
+		}
+		if remote := pc.RemoteAddr().String(); remote != tc.remote {
+			t.Fatalf("%q: remote addr %v", tc.header, remote)
+		}
+		data := make([]byte, 4)
+		if _, err := pc.Read(data); err != nil || string(data) != "data" {
+			t.Fatalf("%q: read %q after the header, error %v", tc.header, data, err)
+		}
+	}
+
+	c, s := net.Pipe()
+	go c.Write([]byte("GET / HTTP/1.1\r\n"))
+	if _, err := readProxyHeader(s); err != errProxyHeader {
+		t.Fatalf("no header, got error %v", err)
+	}
+}
+
+func TestTCPServer_ProxyProtocol(t *testing.T) {
+	addrs := make(chan string, 1)
+	server := &TCPServer{
+		Addr:           "127.0.0.1:0",
+		ProxyProtocol:  true,
+		TrustedProxies: []string{"127.0.0.0/8"},
+		NewAgent: func(conn *TCPConn) Agent {
+			addrs <- conn.RemoteIP() + " " + conn.RemoteAddrWithoutPort()
+			return &idleTestAgent{conn: conn, closed: make(chan struct{})}
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.lns[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 5555 80\r\n"))
+
+	select {
+	case addr := <-addrs:
+		if addr != "203.0.113.7 203.0.113.7:5555" {
+			t.Fatalf("remote addr %v", addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("conn not accepted")
+	}
+}
+
+func TestWSHandler_RemoteIP(t *testing.T) {
+	trusted, _ := parseCIDRs([]string{"10.0.0.0/8"})
+	handler := &WSHandler{trusted: trusted}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	r.Header.Set("X-Forwarded-For", "1.1.1.1")
+	if ip := handler.remoteIP(r); ip != "198.51.100.1" {
+		t.Fatalf("header of an untrusted peer honored, ip %v", ip)
+	}
+
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "1.1.1.1, 203.0.113.7, 10.0.0.2")
+	if ip := handler.remoteIP(r); ip != "203.0.113.7" {
+		t.Fatalf("ip %v", ip)
+	}
+
+	r.Header.Del("X-Forwarded-For")
+	r.Header.Set("X-Real-IP", "203.0.113.8")
+	if ip := handler.remoteIP(r); ip != "203.0.113.8" {
+		t.Fatalf("ip %v", ip)
+	}
+}
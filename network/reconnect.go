@@ -0,0 +1,124 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrClientClosed = errors.New("client closed")
+
+// reconnector paces the dials of the conns of a client and tells when the client is ready or gives up,
+// the delay doubles from interval up to maxInterval on every failure in a row, randomized by jitter
+// goroutine safe
+type reconnector struct {
+	interval    time.Duration
+	maxInterval time.Duration
+	jitter      float64
+	maxAttempts int
+	onGiveUp    func(err error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	ready     chan struct{}
+	readyOnce sync.Once
+	done      chan struct{}
+	alive     atomic.Int32
+	mutexErr  sync.Mutex
+	lastErr   error
+}
+
+// newReconnector is for connNum conns, all of them give up when ctx is done
+func newReconnector(ctx context.Context, connNum int) *reconnector {
+	r := &reconnector{
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	r.alive.Store(int32(connNum))
+	return r
+}
+
+// delay is the backoff after failures in a row, interval after none
+func (r *reconnector) delay(failures int) time.Duration {
+	d := r.interval
+	for i := 1; i < failures && d < r.maxInterval; i++ {
+		d *= 2
+	}
+	if r.maxInterval > r.interval && d > r.maxInterval {
+		d = r.maxInterval
+	}
+	if r.jitter > 0 {
+		d += time.Duration(float64(d) * r.jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// backoff waits after a failure, it returns false if the client is closed or gives up
+func (r *reconnector) backoff(failures int, err error) bool {
+	if r.maxAttempts > 0 && failures >= r.maxAttempts {
+		r.mutexErr.Lock()
+		r.lastErr = err
+		r.mutexErr.Unlock()
+		if r.onGiveUp != nil {
+			r.onGiveUp(err)
+		}
+		return false
+	}
+	return r.sleep(r.delay(failures))
+}
+
+// sleep returns false if the client is closed
+func (r *reconnector) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+func (r *reconnector) closed() bool {
+	return r.ctx.Err() != nil
+}
+
+func (r *reconnector) connected() {
+	r.readyOnce.Do(func() {
+		close(r.ready)
+	})
+}
+
+// exit is called when a conn stops reconnecting
+func (r *reconnector) exit() {
+	if r.alive.Add(-1) == 0 {
+		close(r.done)
+	}
+}
+
+func (r *reconnector) wait(ctx context.Context) error {
+	select {
+	case <-r.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.done:
+	}
+
+	select {
+	case <-r.ready:
+		return nil
+	default:
+	}
+	r.mutexErr.Lock()
+	defer r.mutexErr.Unlock()
+	if r.lastErr != nil {
+		return r.lastErr
+	}
+	return ErrClientClosed
+}
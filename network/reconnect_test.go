@@ -0,0 +1,104 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconnector_Delay(t *testing.T) {
+	r := newReconnector(context.Background(), 1)
+	r.interval = 10 * time.Millisecond
+	r.maxInterval = 80 * time.Millisecond
+	for failures, want := range []time.Duration{10, 10, 20, 40, 80, 80} {
+		if got := r.delay(failures); got != want*time.Millisecond {
+			t.Errorf("delay(%d) = %v, want %v", failures, got, want*time.Millisecond)
+		}
+	}
+
+	r.jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := r.delay(4); d < 40*time.Millisecond || d > 120*time.Millisecond {
+			t.Fatalf("jittered delay %v", d)
+		}
+	}
+}
+
+func TestTCPClient_GiveUp(t *testing.T) {
+	errDial := errors.New("dial refused")
+	gaveUp := make(chan error, 1)
+	client := &TCPClient{
+		ConnectInterval: time.Millisecond,
+		MaxAttempts:     3,
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			return nil, errDial
+		},
+		NewAgent: func(conn *TCPConn) Agent { return &pipeEchoAgent{conn: conn} },
+		OnGiveUp: func(err error) { gaveUp <- err },
+	}
+	client.Start()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.Ready(ctx); err != errDial {
+		t.Fatalf("ready error %v", err)
+	}
+	if err := <-gaveUp; err != errDial {
+		t.Fatalf("give up error %v", err)
+	}
+	if n := client.Metrics.Snapshot().Rejected[rejectDial]; n != 3 {
+		t.Fatalf("%d dials", n)
+	}
+}
+
+func TestTCPClient_CancelDial(t *testing.T) {
+	// nothing accepts, the dial blocks until canceled
+	ln := NewPipeListener()
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &TCPClient{
+		Dial:     ln.DialContext,
+		NewAgent: func(conn *TCPConn) Agent { return &pipeEchoAgent{conn: conn} },
+	}
+	client.StartContext(ctx)
+
+	cancel()
+	start := time.Now()
+	client.Close()
+	if time.Since(start) > time.Second {
+		t.Fatal("close waits for the dial")
+	}
+	if err := client.Ready(context.Background()); err != ErrClientClosed {
+		t.Fatalf("ready error %v", err)
+	}
+}
+
+func TestTCPClient_Lifecycle(t *testing.T) {
+	server, ln := newPipeEchoServer()
+	defer server.Close()
+
+	connected := make(chan Conn, 1)
+	disconnected := make(chan CloseReason, 1)
+	client := &TCPClient{
+		Dial: ln.DialContext,
+		NewAgent: func(conn *TCPConn) Agent {
+			return &pipeClientAgent{conn: conn, done: make(chan error, 1)}
+		},
+		OnConnected:    func(conn Conn) { connected <- conn },
+		OnDisconnected: func(conn Conn, reason CloseReason) { disconnected <- reason },
+	}
+	client.Start()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-connected
+	if reason := <-disconnected; reason != CloseLocal {
+		t.Fatalf("close reason %v", reason)
+	}
+}
@@ -0,0 +1,358 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gzjjyz/logger"
+)
+
+var errBadRecording = errors.New("invalid recording")
+
+// a recording holds the messages of a conn as its agent reads and writes them, after the codec
+// ------------------------------------------------------------------------------------------------
+// | magic(4) | version(1) | start unix nano(8) | addr len(uvarint) | addr |
+// | dir(1) | since the previous frame nano(uvarint) | header len(uvarint) | header | len(uvarint) | payload |
+// ...
+// ------------------------------------------------------------------------------------------------
+// the header len is 0 if the codec keeps no header, version 1 has no header len and header, a header is
+// | msg id(uvarint) | flags(uvarint) | seq(uvarint) | version(1) | trace id len(uvarint) | trace id | meta num(uvarint) |
+// followed by the metas ordered by key
+// | key(1) | len(uvarint) | value |
+const (
+	recordMagic   = "SRVR"
+	recordVersion = 2
+)
+
+// RecordDir is the direction of a recorded frame
+type RecordDir byte
+
+const (
+	// RecordIn is read from the peer
+	RecordIn RecordDir = iota + 1
+	// RecordOut is written to the peer
+	RecordOut
+)
+
+func (d RecordDir) String() string {
+	switch d {
+	case RecordIn:
+		return "in"
+	case RecordOut:
+		return "out"
+	}
+	return "unknown"
+}
+
+type RecordedFrame struct {
+	Dir RecordDir
+	// At is the time since the conn was opened
+	At time.Duration
+	// Header is nil if the codec keeps no header
+	Header  *FrameHeader
+	Payload []byte
+}
+
+// Recording is a recorded conn, see ReadRecording
+type Recording struct {
+	Start      time.Time
+	RemoteAddr string
+	Frames     []RecordedFrame
+}
+
+// recorder writes the frames of a conn, the ones after an error or close are dropped
+// goroutine safe
+type recorder struct {
+	mu     sync.Mutex
+	wc     io.WriteCloser
+	w      *bufio.Writer
+	start  time.Time
+	last   time.Time
+	closed bool
+}
+
+// newRecorder returns nil if cfg records nothing for conn
+func newRecorder(cfg *connConfig, conn Conn) *recorder {
+	if cfg.record == nil {
+		return nil
+	}
+	wc := cfg.record(conn)
+	if wc == nil {
+		return nil
+	}
+
+	r := &recorder{wc: wc, w: bufio.NewWriter(wc), start: time.Now()}
+	r.last = r.start
+	addr := conn.RemoteAddr().String()
+	head := make([]byte, 0, len(recordMagic)+1+8+binary.MaxVarintLen64+len(addr))
+	head = append(head, recordMagic...)
+	head = append(head, recordVersion)
+	head = binary.BigEndian.AppendUint64(head, uint64(r.start.UnixNano()))
+	head = binary.AppendUvarint(head, uint64(len(addr)))
+	head = append(head, addr...)
+	if _, err := r.w.Write(head); err != nil {
+		r.fail(err)
+	}
+	return r
+}
+
+func (r *recorder) in(h *FrameHeader, b []byte) {
+	if r != nil {
+		r.write(RecordIn, h, b)
+	}
+}
+
+func (r *recorder) out(h *FrameHeader, args ...[]byte) {
+	if r != nil {
+		r.write(RecordOut, h, args...)
+	}
+}
+
+func (r *recorder) write(dir RecordDir, h *FrameHeader, args ...[]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+
+	now := time.Now()
+	var header []byte
+	if h != nil {
+		header = appendRecordHeader(nil, h)
+	}
+	head := make([]byte, 0, 1+3*binary.MaxVarintLen64+len(header))
+	head = append(head, byte(dir))
+	head = binary.AppendUvarint(head, uint64(now.Sub(r.last)))
+	head = binary.AppendUvarint(head, uint64(len(header)))
+	head = append(head, header...)
+	head = binary.AppendUvarint(head, uint64(argsLen(args)))
+	r.last = now
+
+	if _, err := r.w.Write(head); err != nil {
+		r.fail(err)
+		return
+	}
+	for _, b := range args {
+		if _, err := r.w.Write(b); err != nil {
+			r.fail(err)
+			return
+		}
+	}
+}
+
+func appendRecordHeader(b []byte, h *FrameHeader) []byte {
+	b = binary.AppendUvarint(b, uint64(h.MsgId))
+	b = binary.AppendUvarint(b, uint64(h.Flags))
+	b = binary.AppendUvarint(b, uint64(h.Seq))
+	b = append(b, h.Version)
+	b = binary.AppendUvarint(b, uint64(len(h.TraceId)))
+	b = append(b, h.TraceId...)
+	b = binary.AppendUvarint(b, uint64(len(h.Meta)))
+	keys := make([]int, 0, len(h.Meta))
+	for k := range h.Meta {
+		keys = append(keys, int(k))
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		v := h.Meta[uint8(k)]
+		b = append(b, uint8(k))
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		b = append(b, v...)
+	}
+	return b
+}
+
+func parseRecordHeader(b []byte) (*FrameHeader, error) {
+	r := bytes.NewReader(b)
+	uvarint := func(max uint64) (uint64, error) {
+		v, err := binary.ReadUvarint(r)
+		if err != nil || v > max {
+			return 0, errBadRecording
+		}
+		return v, nil
+	}
+	field := func() ([]byte, error) {
+		n, err := uvarint(uint64(r.Len()))
+		if err != nil {
+			return nil, err
+		}
+		v := make([]byte, n)
+		r.Read(v)
+		return v, nil
+	}
+
+	h := &FrameHeader{}
+	msgId, err := uvarint(math.MaxUint32)
+	if err != nil {
+		return nil, err
+	}
+	flags, err := uvarint(math.MaxUint16)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := uvarint(math.MaxUint32)
+	if err != nil {
+		return nil, err
+	}
+	if h.Version, err = r.ReadByte(); err != nil {
+		return nil, errBadRecording
+	}
+	h.MsgId, h.Flags, h.Seq = uint32(msgId), uint16(flags), uint32(seq)
+	traceId, err := field()
+	if err != nil {
+		return nil, err
+	}
+	h.TraceId = string(traceId)
+	n, err := uvarint(uint64(r.Len()))
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < n; i++ {
+		k, err := r.ReadByte()
+		if err != nil {
+			return nil, errBadRecording
+		}
+		v, err := field()
+		if err != nil {
+			return nil, err
+		}
+		if h.Meta == nil {
+			h.Meta = make(FrameMeta)
+		}
+		h.Meta[k] = v
+	}
+	if r.Len() > 0 {
+		return nil, errBadRecording
+	}
+	return h, nil
+}
+
+// fail stops recording, r.mu is held or r is not shared yet
+func (r *recorder) fail(err error) {
+	logger.LogError("record error: %v", err)
+	r.closed = true
+	r.wc.Close()
+}
+
+func (r *recorder) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	if err := r.w.Flush(); err != nil {
+		logger.LogError("record error: %v", err)
+	}
+	r.wc.Close()
+}
+
+// RecordToDir records every conn to a file of dir named by its remote address and start time, it is the Record of the servers
+func RecordToDir(dir string) func(conn Conn) io.WriteCloser {
+	return func(conn Conn) io.WriteCloser {
+		name := strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(conn.RemoteAddr().String())
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%s_%d.rec", name, time.Now().UnixNano())))
+		if err != nil {
+			logger.LogError("record error: %v", err)
+			return nil
+		}
+		return f
+	}
+}
+
+// ReadRecording reads a recording to the end, a frame cut short by a crash is dropped
+func ReadRecording(r io.Reader) (*Recording, error) {
+	br := bufio.NewReader(r)
+
+	head := make([]byte, len(recordMagic)+1+8)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, err
+	}
+	if string(head[:len(recordMagic)]) != recordMagic {
+		return nil, errBadRecording
+	}
+	version := head[len(recordMagic)]
+	if version != 1 && version != recordVersion {
+		return nil, fmt.Errorf("unsupported recording version %d", version)
+	}
+	rec := &Recording{Start: time.Unix(0, int64(binary.BigEndian.Uint64(head[len(recordMagic)+1:])))}
+	addr, err := readRecordBytes(br)
+	if err != nil {
+		return nil, err
+	}
+	rec.RemoteAddr = string(addr)
+
+	var at time.Duration
+	for {
+		dir, err := br.ReadByte()
+		if err == io.EOF {
+			return rec, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if d := RecordDir(dir); d != RecordIn && d != RecordOut {
+			return nil, errBadRecording
+		}
+		delta, err := binary.ReadUvarint(br)
+		if err != nil {
+			return rec, nil
+		}
+		var h *FrameHeader
+		if version > 1 {
+			header, err := readRecordBytes(br)
+			if err != nil {
+				return rec, nil
+			}
+			if len(header) > 0 {
+				if h, err = parseRecordHeader(header); err != nil {
+					return nil, err
+				}
+			}
+		}
+		payload, err := readRecordBytes(br)
+		if err != nil {
+			return rec, nil
+		}
+		at += time.Duration(delta)
+		rec.Frames = append(rec.Frames, RecordedFrame{Dir: RecordDir(dir), At: at, Header: h, Payload: payload})
+	}
+}
+
+// LoadRecording reads the recording file of path
+func LoadRecording(path string) (*Recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadRecording(f)
+}
+
+func readRecordBytes(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if n > 1<<30 {
+		return nil, errBadRecording
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
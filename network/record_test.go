@@ -0,0 +1,331 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gzjjyz/trace"
+	"github.com/petermattis/goid"
+)
+
+type recordBuffer struct {
+	bytes.Buffer
+	closed chan struct{}
+}
+
+func (b *recordBuffer) Close() error {
+	close(b.closed)
+	return nil
+}
+
+// recordTestAgent echoes with a prefix
+type recordTestAgent struct {
+	conn   *TCPConn
+	prefix string
+}
+
+func (a *recordTestAgent) Run() {
+	for {
+		msg, err := a.conn.ReadMsg()
+		if err != nil || string(msg) == "quit" {
+			return
+		}
+		a.conn.WriteMsg([]byte(a.prefix), msg)
+	}
+}
+
+func (a *recordTestAgent) OnClose() {}
+
+func newRecordTestServer(prefix string, rec *recordBuffer) (*TCPServer, *PipeListener) {
+	ln := NewPipeListener()
+	server := &TCPServer{
+		Listener: ln,
+		NewAgent: func(conn *TCPConn) Agent {
+			return &recordTestAgent{conn: conn, prefix: prefix}
+		},
+	}
+	if rec != nil {
+		server.Record = func(conn Conn) io.WriteCloser {
+			return rec
+		}
+	}
+	server.Start()
+	return server, ln
+}
+
+func recordSession(t *testing.T) *Recording {
+	buf := &recordBuffer{closed: make(chan struct{})}
+	server, ln := newRecordTestServer("re:", buf)
+	defer server.Close()
+
+	conn, _ := ln.Dial()
+	c := NewFakeClient(conn, nil, Faults{})
+	for _, msg := range []string{"a", "bb", "ccc"} {
+		if err := c.Roundtrip([]byte(msg), []byte("re:"+msg)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Send([]byte("quit"))
+	<-buf.closed
+
+	rec, err := ReadRecording(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a frame cut short is dropped
+	cut, err := ReadRecording(bytes.NewReader(buf.Bytes()[:buf.Len()-2]))
+	if err != nil || len(cut.Frames) != len(rec.Frames)-1 {
+		t.Fatalf("cut recording: %v", err)
+	}
+	return rec
+}
+
+func TestRecord(t *testing.T) {
+	rec := recordSession(t)
+	if rec.RemoteAddr == "" || rec.Start.IsZero() {
+		t.Fatalf("header %+v", rec)
+	}
+	want := []struct {
+		dir     RecordDir
+		payload string
+	}{
+		{RecordIn, "a"}, {RecordOut, "re:a"},
+		{RecordIn, "bb"}, {RecordOut, "re:bb"},
+		{RecordIn, "ccc"}, {RecordOut, "re:ccc"},
+		{RecordIn, "quit"},
+	}
+	if len(rec.Frames) != len(want) {
+		t.Fatalf("frames %v", len(rec.Frames))
+	}
+	var last time.Duration
+	for i, f := range rec.Frames {
+		if f.Dir != want[i].dir || string(f.Payload) != want[i].payload || f.At < last {
+			t.Fatalf("frame %v: %v %q at %v", i, f.Dir, f.Payload, f.At)
+		}
+		last = f.At
+	}
+	if last < 15*time.Millisecond {
+		t.Fatalf("timing %v", last)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	rec := recordSession(t)
+
+	for _, tc := range []struct {
+		prefix string
+		speed  float64
+		diffs  int
+	}{
+		{"re:", 1, 0},
+		{"re:", 10, 0},
+		{"re:", 0, 0},
+		{"v2:", 0, 3},
+	} {
+		server, ln := newRecordTestServer(tc.prefix, nil)
+		replayer := &Replayer{
+			Client:  &TCPClient{Addr: "pipe", Dial: ln.DialContext},
+			Speed:   tc.speed,
+			Timeout: 100 * time.Millisecond,
+		}
+		start := time.Now()
+		report, err := replayer.Replay(context.Background(), rec)
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Sent != 4 || len(report.Responses) != 3 || len(report.Diffs) != tc.diffs {
+			t.Fatalf("%+v: sent %v, responses %v, diffs %v", tc, report.Sent, report.Responses, report.Diffs)
+		}
+		if tc.speed == 1 && time.Since(start) < rec.Frames[len(rec.Frames)-1].At {
+			t.Fatal("replayed faster than recorded")
+		}
+	}
+}
+
+// recordFrameTestAgent answers a frame with the suffix added to its meta
+type recordFrameTestAgent struct {
+	conn   *TCPConn
+	suffix string
+}
+
+func (a *recordFrameTestAgent) Run() {
+	for {
+		h, msg, err := a.conn.ReadFrame()
+		if err != nil {
+			return
+		}
+		a.conn.WriteFrame(&FrameHeader{TraceId: h.TraceId, Meta: FrameMeta{1: []byte(string(h.Meta[1]) + a.suffix)}}, msg)
+	}
+}
+
+func (a *recordFrameTestAgent) OnClose() {}
+
+func TestRecord_Headers(t *testing.T) {
+	newServer := func(suffix string, rec *recordBuffer) (*TCPServer, *PipeListener) {
+		ln := NewPipeListener()
+		server := &TCPServer{
+			Listener: ln,
+			Codec:    NewVersionedCodec(),
+			NewAgent: func(conn *TCPConn) Agent {
+				return &recordFrameTestAgent{conn: conn, suffix: suffix}
+			},
+		}
+		if rec != nil {
+			server.Record = func(conn Conn) io.WriteCloser {
+				return rec
+			}
+		}
+		server.Start()
+		return server, ln
+	}
+
+	buf := &recordBuffer{closed: make(chan struct{})}
+	server, ln := newServer("!", buf)
+	conn, _ := ln.Dial()
+	c := NewFakeClient(conn, NewVersionedCodec(), Faults{})
+	h := &FrameHeader{TraceId: "t-1", Meta: FrameMeta{1: []byte("uid")}}
+	if err := c.SendFrame(h, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.RecvFrame(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	server.Close()
+	<-buf.closed
+
+	rec, err := ReadRecording(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Frames) != 2 {
+		t.Fatalf("frames %v", len(rec.Frames))
+	}
+	for i, want := range []string{"uid", "uid!"} {
+		got := rec.Frames[i].Header
+		if got == nil || got.TraceId != "t-1" || string(got.Meta[1]) != want {
+			t.Fatalf("frame %v header %+v", i, got)
+		}
+	}
+
+	// the frames are replayed with their headers and the responses differ by the meta
+	for _, tc := range []struct {
+		suffix string
+		diffs  int
+	}{
+		{"!", 0},
+		{"?", 1},
+	} {
+		server, ln := newServer(tc.suffix, nil)
+		replayer := &Replayer{
+			Client:  &TCPClient{Addr: "pipe", Dial: ln.DialContext, Codec: NewVersionedCodec()},
+			Timeout: 100 * time.Millisecond,
+		}
+		report, err := replayer.Replay(context.Background(), rec)
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Responses) != 1 || len(report.Diffs) != tc.diffs {
+			t.Fatalf("suffix %v: responses %v, diffs %v", tc.suffix, report.Responses, report.Diffs)
+		}
+	}
+}
+
+// recordTraceTestAgent echoes the trace frames
+type recordTraceTestAgent struct {
+	conn *TCPConn
+}
+
+func (a *recordTraceTestAgent) Run() {
+	for {
+		msg, err := a.conn.ReadMsgWithTrace()
+		if err != nil {
+			return
+		}
+		a.conn.WriteMsgWithTrace(msg)
+	}
+}
+
+func (a *recordTraceTestAgent) OnClose() {}
+
+func TestRecord_Trace(t *testing.T) {
+	newServer := func(rec *recordBuffer) (*TCPServer, *PipeListener) {
+		ln := NewPipeListener()
+		server := &TCPServer{
+			Listener: ln,
+			NewAgent: func(conn *TCPConn) Agent {
+				return &recordTraceTestAgent{conn: conn}
+			},
+		}
+		if rec != nil {
+			server.Record = func(conn Conn) io.WriteCloser {
+				return rec
+			}
+		}
+		server.Start()
+		return server, ln
+	}
+
+	buf := &recordBuffer{closed: make(chan struct{})}
+	server, ln := newServer(buf)
+	conn, _ := ln.Dial()
+	gid := goid.Get()
+	trace.Ctx.SetCurGTrace(gid, "t-2")
+	defer trace.Ctx.RemoveGTrace(gid)
+	b, err := NewMsgParser().PackMsgWithTrace([]byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(b)
+	if _, err := NewMsgParser().ReadWithTrace(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	server.Close()
+	<-buf.closed
+
+	rec, err := ReadRecording(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Frames) != 2 {
+		t.Fatalf("frames %v", len(rec.Frames))
+	}
+	for i, f := range rec.Frames {
+		if f.Header == nil || f.Header.TraceId != "t-2" || string(f.Payload) != "hi" {
+			t.Fatalf("frame %v: %v", i, &f)
+		}
+	}
+
+	server, ln = newServer(nil)
+	defer server.Close()
+	replayer := &Replayer{
+		Client:  &TCPClient{Addr: "pipe", Dial: ln.DialContext},
+		Timeout: 100 * time.Millisecond,
+	}
+	report, err := replayer.Replay(context.Background(), rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sent != 1 || !report.OK() {
+		t.Fatalf("sent %v, diffs %v", report.Sent, report.Diffs)
+	}
+}
+
+func TestRecordHeader(t *testing.T) {
+	h := &FrameHeader{MsgId: 1 << 30, Flags: FlagTrace | FlagMeta, Seq: 9, Version: 2, TraceId: "t", Meta: FrameMeta{2: nil, 1: []byte("v")}}
+	got, err := parseRecordHeader(appendRecordHeader(nil, h))
+	if err != nil || !equalHeaders(got, h) || got.Flags != h.Flags || got.Version != h.Version {
+		t.Fatalf("header %+v, error %v", got, err)
+	}
+	if _, err := parseRecordHeader(appendRecordHeader(nil, h)[:3]); err != errBadRecording {
+		t.Fatalf("cut header, got error %v", err)
+	}
+}
@@ -0,0 +1,278 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gzjjyz/trace"
+	"github.com/petermattis/goid"
+)
+
+// Replayer sends the frames a server read in a recording to the server again and compares the responses
+// with the ones it wrote, headers included, a recording of a client is replayed after Swapped
+type Replayer struct {
+	// Client connects to the server, its NewAgent is set by Replay and its codec must match the server's
+	Client *TCPClient
+	// Speed scales the timing, 1 is the original and 2 twice as fast, 0 sends without waiting
+	Speed float64
+	// Timeout waits for the responses left after the last frame is sent
+	Timeout time.Duration
+	// Equal compares the payload of a recorded response with the replayed one, nil compares the bytes,
+	// e.g. to skip timestamps or random ids, the headers are compared without the flags the codecs set
+	Equal func(want, got []byte) bool
+}
+
+// ReplayDiff is a response differing from the recording, Want is nil if it is extra and Got is nil if it is missing
+type ReplayDiff struct {
+	Index int
+	Want  *RecordedFrame
+	Got   *RecordedFrame
+}
+
+func (d ReplayDiff) String() string {
+	switch {
+	case d.Want == nil:
+		return fmt.Sprintf("#%d extra: %v", d.Index, d.Got)
+	case d.Got == nil:
+		return fmt.Sprintf("#%d missing: %v", d.Index, d.Want)
+	}
+	return fmt.Sprintf("#%d want %v, got %v", d.Index, d.Want, d.Got)
+}
+
+func (f *RecordedFrame) String() string {
+	if f.Header == nil {
+		return fmt.Sprintf("%x", f.Payload)
+	}
+	return fmt.Sprintf("%+v %x", *f.Header, f.Payload)
+}
+
+type ReplayReport struct {
+	Sent      int
+	Responses []RecordedFrame
+	Diffs     []ReplayDiff
+}
+
+// OK reports whether the responses match the recording
+func (r *ReplayReport) OK() bool {
+	return len(r.Diffs) == 0
+}
+
+type replayAgent struct {
+	conn      *TCPConn
+	traced    bool
+	start     time.Time
+	conns     chan<- *TCPConn
+	responses chan<- RecordedFrame
+	done      <-chan struct{}
+}
+
+func (a *replayAgent) Run() {
+	a.conns <- a.conn
+	read := a.conn.codec.ReadFrame
+	// the trace frames of a codec without header are only told apart by reading them as such
+	if tr, ok := a.conn.codec.(traceFrameReader); ok && a.traced && !carriesHeader(a.conn.codec) {
+		read = tr.readTraceFrame
+	}
+	for {
+		h, b, err := a.conn.readFrameWith(read)
+		if err != nil {
+			return
+		}
+		f := RecordedFrame{Dir: RecordOut, At: time.Since(a.start), Header: h, Payload: append([]byte(nil), b...)}
+		select {
+		case a.responses <- f:
+		case <-a.done:
+			return
+		}
+	}
+}
+
+func (a *replayAgent) OnClose() {
+	close(a.responses)
+}
+
+// Replay replays rec over a conn of the client, the client is closed on return
+func (replayer *Replayer) Replay(ctx context.Context, rec *Recording) (*ReplayReport, error) {
+	if replayer.Timeout <= 0 {
+		replayer.Timeout = 3 * time.Second
+	}
+
+	conns := make(chan *TCPConn, 1)
+	responses := make(chan RecordedFrame, 1024)
+	done := make(chan struct{})
+	traced := rec.traced()
+	opened := time.Now()
+	client := replayer.Client
+	client.ConnNum = 1
+	client.AutoReconnect = false
+	client.NewAgent = func(conn *TCPConn) Agent {
+		return &replayAgent{conn: conn, traced: traced, start: opened, conns: conns, responses: responses, done: done}
+	}
+	client.StartContext(ctx)
+	defer client.Close()
+	defer close(done)
+	if err := client.Ready(ctx); err != nil {
+		return nil, err
+	}
+	conn := <-conns
+
+	report := &ReplayReport{}
+	var want []RecordedFrame
+	start := time.Now()
+	for _, f := range rec.Frames {
+		if f.Dir == RecordOut {
+			want = append(want, f)
+			continue
+		}
+		if replayer.Speed > 0 {
+			wait := time.Until(start.Add(time.Duration(float64(f.At) / replayer.Speed)))
+			if err := sleepContext(ctx, wait); err != nil {
+				return nil, err
+			}
+		}
+		report.Responses = drainResponses(report.Responses, responses)
+		if err := replayWrite(conn, f); err != nil {
+			return nil, err
+		}
+		report.Sent++
+	}
+
+	// the responses left, until the recorded ones are all in or the server is quiet for Timeout
+	timer := time.NewTimer(replayer.Timeout)
+	defer timer.Stop()
+	for len(report.Responses) < len(want) {
+		select {
+		case b, ok := <-responses:
+			if !ok {
+				report.Diffs = replayer.diff(want, report.Responses)
+				return report, nil
+			}
+			report.Responses = append(report.Responses, b)
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(replayer.Timeout)
+		case <-timer.C:
+			report.Diffs = replayer.diff(want, report.Responses)
+			return report, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	report.Responses = drainResponses(report.Responses, responses)
+	report.Diffs = replayer.diff(want, report.Responses)
+	return report, nil
+}
+
+// replayWrite writes f as it was read, with its header or as a trace frame
+func replayWrite(conn *TCPConn, f RecordedFrame) error {
+	h := f.Header
+	if h == nil {
+		return conn.WriteMsg(f.Payload)
+	}
+	if h.Flags&FlagTrace != 0 && !carriesHeader(conn.codec) {
+		gid := goid.Get()
+		trace.Ctx.SetCurGTrace(gid, h.TraceId)
+		defer trace.Ctx.RemoveGTrace(gid)
+		return conn.WriteMsgWithTrace(f.Payload)
+	}
+	return conn.WriteFrame(h, f.Payload)
+}
+
+// traced reports whether the frames of rec were read and written as trace frames
+func (rec *Recording) traced() bool {
+	for _, f := range rec.Frames {
+		if f.Header != nil && f.Header.Flags&FlagTrace != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Swapped returns rec with the directions swapped, to replay a recording of a client
+func (rec *Recording) Swapped() *Recording {
+	swapped := &Recording{Start: rec.Start, RemoteAddr: rec.RemoteAddr, Frames: make([]RecordedFrame, len(rec.Frames))}
+	for i, f := range rec.Frames {
+		if f.Dir == RecordIn {
+			f.Dir = RecordOut
+		} else {
+			f.Dir = RecordIn
+		}
+		swapped.Frames[i] = f
+	}
+	return swapped
+}
+
+func (replayer *Replayer) diff(want, got []RecordedFrame) []ReplayDiff {
+	equal := replayer.Equal
+	if equal == nil {
+		equal = bytes.Equal
+	}
+
+	var diffs []ReplayDiff
+	for i := 0; i < len(want) || i < len(got); i++ {
+		switch {
+		case i >= len(got):
+			diffs = append(diffs, ReplayDiff{Index: i, Want: &want[i]})
+		case i >= len(want):
+			diffs = append(diffs, ReplayDiff{Index: i, Got: &got[i]})
+		case !equalHeaders(want[i].Header, got[i].Header) || !equal(want[i].Payload, got[i].Payload):
+			diffs = append(diffs, ReplayDiff{Index: i, Want: &want[i], Got: &got[i]})
+		}
+	}
+	return diffs
+}
+
+// codecFlags are set by the codecs for the frames on the wire
+const codecFlags = FlagCompressed | FlagEncrypted | FlagTrace | FlagMeta | FlagHeartbeat
+
+// equalHeaders compares a and b without the codec flags and the version, nil is a zero header
+func equalHeaders(a, b *FrameHeader) bool {
+	var zero FrameHeader
+	if a == nil {
+		a = &zero
+	}
+	if b == nil {
+		b = &zero
+	}
+	if a.MsgId != b.MsgId || a.Seq != b.Seq || a.Flags&^codecFlags != b.Flags&^codecFlags ||
+		a.TraceId != b.TraceId || len(a.Meta) != len(b.Meta) {
+		return false
+	}
+	for k, v := range a.Meta {
+		if w, ok := b.Meta[k]; !ok || !bytes.Equal(v, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func drainResponses(dst []RecordedFrame, responses <-chan RecordedFrame) []RecordedFrame {
+	for {
+		select {
+		case b, ok := <-responses:
+			if !ok {
+				return dst
+			}
+			dst = append(dst, b)
+		default:
+			return dst
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
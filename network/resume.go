@@ -0,0 +1,593 @@
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// resume frames, one per message of the link conn
+// hello   client -> server | kind(1) | token(16) | last seq received(8) |
+// welcome server -> client | kind(1) | token(16) | last seq received(8) | resumed(1) |
+// data                     | kind(1) | seq(8) | ack(8) | payload |
+// ack                      | kind(1) | ack(8) |
+// a zero token in hello starts a new session, ack is the last seq received in order
+const (
+	resumeHello uint8 = iota + 1
+	resumeWelcome
+	resumeData
+	resumeAck
+)
+
+const (
+	resumeTokenLen   = 16
+	resumeHelloLen   = 1 + resumeTokenLen + 8
+	resumeWelcomeLen = resumeHelloLen + 1
+	resumeDataLen    = 1 + 8 + 8
+	resumeAckLen     = 1 + 8
+)
+
+var (
+	ErrSessionClosed = errors.New("resumable session closed")
+	errResumeFrame   = errors.New("invalid resume frame")
+)
+
+type resumeToken [resumeTokenLen]byte
+
+func (t resumeToken) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+type resumeFrame struct {
+	seq uint64
+	b   []byte
+}
+
+// ResumableConn is a session which lives across the conns of a client,
+// the messages the peer has not acked are kept and replayed on the conn the client resumes with
+type ResumableConn struct {
+	mu        sync.Mutex
+	token     resumeToken
+	maxReplay int
+	ackEvery  int
+	link      Conn
+	lastLink  Conn
+	sendSeq   uint64
+	replay    []resumeFrame
+	recvSeq   uint64
+	unacked   int
+	inbox     chan []byte
+	die       chan struct{}
+	closeOnce sync.Once
+	timer     *time.Timer
+	onClose   func()
+	reason    CloseReason
+}
+
+func newResumableConn(token resumeToken, maxReplay, ackEvery int) *ResumableConn {
+	return &ResumableConn{
+		token:     token,
+		maxReplay: maxReplay,
+		ackEvery:  ackEvery,
+		inbox:     make(chan []byte, 64),
+		die:       make(chan struct{}),
+	}
+}
+
+// Token identifies the session when the client resumes
+func (rc *ResumableConn) Token() string {
+	return rc.token.String()
+}
+
+// goroutine not safe
+func (rc *ResumableConn) ReadMsg() ([]byte, error) {
+	select {
+	case b := <-rc.inbox:
+		return b, nil
+	case <-rc.die:
+		return nil, ErrSessionClosed
+	}
+}
+
+// WriteMsg keeps the message until the peer acks it, it is sent when the session is resumed if there is no conn now
+func (rc *ResumableConn) WriteMsg(args ...[]byte) error {
+	var msgLen int
+	for _, arg := range args {
+		msgLen += len(arg)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	select {
+	case <-rc.die:
+		return ErrSessionClosed
+	default:
+	}
+
+	rc.sendSeq++
+	b := make([]byte, resumeDataLen, resumeDataLen+msgLen)
+	b[0] = resumeData
+	binary.BigEndian.PutUint64(b[1:], rc.sendSeq)
+	binary.BigEndian.PutUint64(b[9:], rc.recvSeq)
+	for _, arg := range args {
+		b = append(b, arg...)
+	}
+	rc.unacked = 0
+
+	// the session can no longer be resumed once a message not acked is dropped
+	rc.replay = append(rc.replay, resumeFrame{seq: rc.sendSeq, b: b})
+	if len(rc.replay) > rc.maxReplay {
+		rc.replay[0] = resumeFrame{}
+		rc.replay = rc.replay[1:]
+	}
+
+	if rc.link != nil {
+		return rc.link.WriteMsg(b)
+	}
+	return nil
+}
+
+func (rc *ResumableConn) LocalAddr() net.Addr {
+	if link := rc.currentLink(); link != nil {
+		return link.LocalAddr()
+	}
+	return nil
+}
+
+func (rc *ResumableConn) RemoteAddr() net.Addr {
+	if link := rc.currentLink(); link != nil {
+		return link.RemoteAddr()
+	}
+	return nil
+}
+
+func (rc *ResumableConn) RemoteAddrWithoutPort() string {
+	if link := rc.currentLink(); link != nil {
+		return link.RemoteAddrWithoutPort()
+	}
+	return ""
+}
+
+// Stats are the ones of the conn the session is on now or was on last
+func (rc *ResumableConn) Stats() ConnStats {
+	if link := rc.currentLink(); link != nil {
+		return link.Stats()
+	}
+	return ConnStats{}
+}
+
+func (rc *ResumableConn) currentLink() Conn {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.lastLink
+}
+
+// Close ends the session and closes its conn
+func (rc *ResumableConn) Close() {
+	rc.end(CloseLocal, func(link Conn) { link.Close() })
+}
+
+// Destroy ends the session and destroys its conn
+func (rc *ResumableConn) Destroy() {
+	rc.end(CloseDestroy, func(link Conn) { link.Destroy() })
+}
+
+// expire ends the session left without a conn for the grace period
+func (rc *ResumableConn) expire() {
+	rc.end(CloseTimeout, func(link Conn) { link.Close() })
+}
+
+func (rc *ResumableConn) end(reason CloseReason, closeLink func(link Conn)) {
+	rc.closeOnce.Do(func() {
+		rc.mu.Lock()
+		rc.reason = reason
+		close(rc.die)
+		if rc.timer != nil {
+			rc.timer.Stop()
+		}
+		link := rc.link
+		rc.link = nil
+		rc.mu.Unlock()
+
+		if link != nil {
+			closeLink(link)
+		}
+		if rc.onClose != nil {
+			rc.onClose()
+		}
+	})
+}
+
+// canResume reports whether the messages after peerRecv are all kept
+func (rc *ResumableConn) canResume(peerRecv uint64) bool {
+	if peerRecv > rc.sendSeq {
+		return false
+	}
+	if peerRecv == rc.sendSeq {
+		return true
+	}
+	return len(rc.replay) > 0 && rc.replay[0].seq <= peerRecv+1
+}
+
+// attach moves the session onto link, the welcome goes before the replayed messages
+func (rc *ResumableConn) attach(link Conn, peerRecv uint64, welcome []byte) {
+	rc.mu.Lock()
+	if rc.timer != nil {
+		rc.timer.Stop()
+		rc.timer = nil
+	}
+	old := rc.link
+	rc.link = link
+	rc.lastLink = link
+
+	if welcome != nil {
+		link.WriteMsg(welcome)
+	}
+	rc.trim(peerRecv)
+	for _, f := range rc.replay {
+		link.WriteMsg(f.b)
+	}
+	rc.mu.Unlock()
+
+	if old != nil && old != link {
+		old.Close()
+	}
+}
+
+// detach is called when link is gone, expire is called after grace unless the session is resumed before
+func (rc *ResumableConn) detach(link Conn, grace time.Duration, expire func()) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.link != link {
+		return
+	}
+
+	rc.link = nil
+	if expire != nil {
+		rc.timer = time.AfterFunc(grace, expire)
+	}
+}
+
+func (rc *ResumableConn) trim(ack uint64) {
+	i := 0
+	for i < len(rc.replay) && rc.replay[i].seq <= ack {
+		rc.replay[i] = resumeFrame{}
+		i++
+	}
+	rc.replay = rc.replay[i:]
+}
+
+// serveLink reads the frames of link until it fails
+func (rc *ResumableConn) serveLink(link Conn) {
+	for {
+		b, err := link.ReadMsg()
+		if err != nil {
+			return
+		}
+		if err := rc.handle(link, b); err != nil {
+			link.Close()
+			return
+		}
+	}
+}
+
+func (rc *ResumableConn) handle(link Conn, b []byte) error {
+	switch {
+	case len(b) >= resumeDataLen && b[0] == resumeData:
+		seq := binary.BigEndian.Uint64(b[1:])
+		rc.mu.Lock()
+		rc.trim(binary.BigEndian.Uint64(b[9:]))
+		if seq <= rc.recvSeq {
+			// replayed again
+			rc.mu.Unlock()
+			return nil
+		}
+		if seq != rc.recvSeq+1 {
+			rc.mu.Unlock()
+			return errResumeFrame
+		}
+		rc.recvSeq = seq
+		rc.unacked++
+		if rc.unacked >= rc.ackEvery {
+			rc.unacked = 0
+			link.WriteMsg(resumeAckFrame(seq))
+		}
+		rc.mu.Unlock()
+
+		select {
+		case rc.inbox <- b[resumeDataLen:]:
+			return nil
+		case <-rc.die:
+			return ErrSessionClosed
+		}
+	case len(b) == resumeAckLen && b[0] == resumeAck:
+		rc.mu.Lock()
+		rc.trim(binary.BigEndian.Uint64(b[1:]))
+		rc.mu.Unlock()
+		return nil
+	}
+	return errResumeFrame
+}
+
+func resumeAckFrame(ack uint64) []byte {
+	b := make([]byte, resumeAckLen)
+	b[0] = resumeAck
+	binary.BigEndian.PutUint64(b[1:], ack)
+	return b
+}
+
+func resumeHelloFrame(kind uint8, token resumeToken, recv uint64) []byte {
+	b := make([]byte, resumeHelloLen, resumeWelcomeLen)
+	b[0] = kind
+	copy(b[1:], token[:])
+	binary.BigEndian.PutUint64(b[1+resumeTokenLen:], recv)
+	return b
+}
+
+func parseResumeHello(b []byte, kind uint8, n int) (token resumeToken, recv uint64, err error) {
+	if len(b) != n || b[0] != kind {
+		return token, 0, errResumeFrame
+	}
+	copy(token[:], b[1:])
+	return token, binary.BigEndian.Uint64(b[1+resumeTokenLen:]), nil
+}
+
+// runResumeAgent runs the agent of a session in its own goroutine, it outlives the conns of the session
+func runResumeAgent(wg *sync.WaitGroup, rc *ResumableConn, agent Agent) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runAgent(context.Background(), agent, rc.die)
+		rc.Close()
+		closeAgent(agent, rc.reason)
+	}()
+}
+
+// resumeLink is the agent of a conn, it moves the frames between the conn and its session
+type resumeLink struct {
+	conn    Conn
+	session *ResumableConn
+	start   func(conn Conn) (*ResumableConn, error)
+	detach  func(rc *ResumableConn, conn Conn)
+}
+
+func (l *resumeLink) Run() {
+	rc, err := l.start(l.conn)
+	if err != nil {
+		return
+	}
+	l.session = rc
+	rc.serveLink(l.conn)
+}
+
+func (l *resumeLink) OnClose() {
+	if l.session != nil {
+		l.detach(l.session, l.conn)
+	}
+}
+
+// ResumeServer keeps the sessions of the clients across their conns for GracePeriod,
+// its link agents serve the conns of TCPServer, WSServer or KCPServer, the agents of the sessions run in their own goroutines
+// goroutine safe
+type ResumeServer struct {
+	// GracePeriod is how long a session without conn is kept, 30s by default
+	GracePeriod time.Duration
+	// MaxReplay is how many messages not acked are kept, 1024 by default
+	MaxReplay int
+	// AckEvery is how many messages are received before an ack if no message goes the other way, 8 by default
+	AckEvery int
+	NewAgent func(*ResumableConn) Agent
+
+	mu       sync.Mutex
+	sessions map[resumeToken]*ResumableConn
+	wg       sync.WaitGroup
+}
+
+func NewResumeServer(newAgent func(*ResumableConn) Agent) *ResumeServer {
+	return &ResumeServer{
+		NewAgent: newAgent,
+		sessions: make(map[resumeToken]*ResumableConn),
+	}
+}
+
+// NewLinkAgent returns the agent of a conn, it is the NewAgent of the servers
+func (rs *ResumeServer) NewLinkAgent(conn Conn) Agent {
+	return &resumeLink{conn: conn, start: rs.start, detach: rs.detach}
+}
+
+func (rs *ResumeServer) start(conn Conn) (*ResumableConn, error) {
+	b, err := conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	token, peerRecv, err := parseResumeHello(b, resumeHello, resumeHelloLen)
+	if err != nil {
+		return nil, err
+	}
+
+	rs.mu.Lock()
+	rc := rs.sessions[token]
+	if rc != nil {
+		rc.mu.Lock()
+		resumable := rc.canResume(peerRecv)
+		recvSeq := rc.recvSeq
+		rc.mu.Unlock()
+		if resumable {
+			rs.mu.Unlock()
+			rc.attach(conn, peerRecv, append(resumeHelloFrame(resumeWelcome, token, recvSeq), 1))
+			return rc, nil
+		}
+		rs.mu.Unlock()
+		rc.Close()
+		rs.mu.Lock()
+	}
+
+	if _, err := rand.Read(token[:]); err != nil {
+		rs.mu.Unlock()
+		return nil, err
+	}
+	rc = newResumableConn(token, rs.maxReplay(), rs.ackEvery())
+	rc.onClose = func() {
+		rs.mu.Lock()
+		if rs.sessions[token] == rc {
+			delete(rs.sessions, token)
+		}
+		rs.mu.Unlock()
+	}
+	rs.sessions[token] = rc
+	rs.mu.Unlock()
+
+	rc.attach(conn, 0, append(resumeHelloFrame(resumeWelcome, token, 0), 0))
+	runResumeAgent(&rs.wg, rc, rs.NewAgent(rc))
+	return rc, nil
+}
+
+func (rs *ResumeServer) detach(rc *ResumableConn, conn Conn) {
+	grace := rs.GracePeriod
+	if grace <= 0 {
+		grace = 30 * time.Second
+	}
+	rc.detach(conn, grace, rc.expire)
+}
+
+func (rs *ResumeServer) maxReplay() int {
+	if rs.MaxReplay <= 0 {
+		return 1024
+	}
+	return rs.MaxReplay
+}
+
+func (rs *ResumeServer) ackEvery() int {
+	if rs.AckEvery <= 0 {
+		return 8
+	}
+	return rs.AckEvery
+}
+
+// Count returns how many sessions are kept
+func (rs *ResumeServer) Count() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return len(rs.sessions)
+}
+
+// Close ends all the sessions and waits for their agents
+func (rs *ResumeServer) Close() {
+	rs.mu.Lock()
+	sessions := make([]*ResumableConn, 0, len(rs.sessions))
+	for _, rc := range rs.sessions {
+		sessions = append(sessions, rc)
+	}
+	rs.mu.Unlock()
+
+	for _, rc := range sessions {
+		rc.Close()
+	}
+	rs.wg.Wait()
+}
+
+// ResumeClient keeps one session across the conns of TCPClient, WSClient or KCPClient with AutoReconnect,
+// a new session starts if the server can not resume the last one, which is closed then
+// goroutine safe
+type ResumeClient struct {
+	// MaxReplay is how many messages not acked are kept, 1024 by default
+	MaxReplay int
+	// AckEvery is how many messages are received before an ack if no message goes the other way, 8 by default
+	AckEvery int
+	NewAgent func(*ResumableConn) Agent
+
+	mu      sync.Mutex
+	session *ResumableConn
+	wg      sync.WaitGroup
+}
+
+func NewResumeClient(newAgent func(*ResumableConn) Agent) *ResumeClient {
+	return &ResumeClient{NewAgent: newAgent}
+}
+
+// NewLinkAgent returns the agent of a conn, it is the NewAgent of the clients
+func (c *ResumeClient) NewLinkAgent(conn Conn) Agent {
+	return &resumeLink{conn: conn, start: c.start, detach: c.detach}
+}
+
+func (c *ResumeClient) start(conn Conn) (*ResumableConn, error) {
+	c.mu.Lock()
+	rc := c.session
+	c.mu.Unlock()
+
+	var (
+		token   resumeToken
+		recvSeq uint64
+	)
+	if rc != nil {
+		rc.mu.Lock()
+		token, recvSeq = rc.token, rc.recvSeq
+		rc.mu.Unlock()
+	}
+	if err := conn.WriteMsg(resumeHelloFrame(resumeHello, token, recvSeq)); err != nil {
+		return nil, err
+	}
+
+	b, err := conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != resumeWelcomeLen {
+		return nil, errResumeFrame
+	}
+	newToken, peerRecv, err := parseResumeHello(b[:resumeHelloLen], resumeWelcome, resumeHelloLen)
+	if err != nil {
+		return nil, err
+	}
+
+	if b[resumeHelloLen] == 1 && rc != nil && newToken == token {
+		rc.attach(conn, peerRecv, nil)
+		return rc, nil
+	}
+	if rc != nil {
+		rc.Close()
+	}
+
+	rc = newResumableConn(newToken, c.maxReplay(), c.ackEvery())
+	c.mu.Lock()
+	c.session = rc
+	c.mu.Unlock()
+	rc.attach(conn, 0, nil)
+	runResumeAgent(&c.wg, rc, c.NewAgent(rc))
+	return rc, nil
+}
+
+func (c *ResumeClient) detach(rc *ResumableConn, conn Conn) {
+	rc.detach(conn, 0, nil)
+}
+
+func (c *ResumeClient) maxReplay() int {
+	if c.MaxReplay <= 0 {
+		return 1024
+	}
+	return c.MaxReplay
+}
+
+func (c *ResumeClient) ackEvery() int {
+	if c.AckEvery <= 0 {
+		return 8
+	}
+	return c.AckEvery
+}
+
+// Close ends the session and waits for its agent
+func (c *ResumeClient) Close() {
+	c.mu.Lock()
+	rc := c.session
+	c.mu.Unlock()
+
+	if rc != nil {
+		rc.Close()
+	}
+	c.wg.Wait()
+}
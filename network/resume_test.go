@@ -0,0 +1,139 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type resumeEchoAgent struct {
+	conn   *ResumableConn
+	closed chan struct{}
+}
+
+func (a *resumeEchoAgent) Run() {
+	for {
+		msg, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		a.conn.WriteMsg(msg)
+	}
+}
+
+func (a *resumeEchoAgent) OnClose() {
+	close(a.closed)
+}
+
+type resumeRecvAgent struct {
+	conn *ResumableConn
+	msgs chan string
+}
+
+func (a *resumeRecvAgent) Run() {
+	for {
+		msg, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		a.msgs <- string(msg)
+	}
+}
+
+func (a *resumeRecvAgent) OnClose() {}
+
+func TestResume_Reconnect(t *testing.T) {
+	var serverAgents []*resumeEchoAgent
+	var mu sync.Mutex
+	rs := NewResumeServer(func(conn *ResumableConn) Agent {
+		agent := &resumeEchoAgent{conn: conn, closed: make(chan struct{})}
+		mu.Lock()
+		serverAgents = append(serverAgents, agent)
+		mu.Unlock()
+		return agent
+	})
+	rs.GracePeriod = 100 * time.Millisecond
+	rs.AckEvery = 4
+	server := &TCPServer{
+		Addr:     "127.0.0.1:0",
+		NewAgent: func(conn *TCPConn) Agent { return rs.NewLinkAgent(conn) },
+	}
+	server.Start()
+	defer server.Close()
+
+	sessions := make(chan *ResumableConn, 1)
+	msgs := make(chan string, 100)
+	rc := NewResumeClient(func(conn *ResumableConn) Agent {
+		sessions <- conn
+		return &resumeRecvAgent{conn: conn, msgs: msgs}
+	})
+	links := make(chan *TCPConn, 4)
+	client := &TCPClient{
+		Addr:            server.lns[0].Addr().String(),
+		AutoReconnect:   true,
+		ConnectInterval: 10 * time.Millisecond,
+		NewAgent: func(conn *TCPConn) Agent {
+			links <- conn
+			return rc.NewLinkAgent(conn)
+		},
+	}
+	client.Start()
+
+	session := <-sessions
+	link := <-links
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			// the messages written while the client reconnects are replayed
+			link.Destroy()
+			<-links
+		}
+		if err := session.WriteMsg([]byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case msg := <-msgs:
+			if msg != fmt.Sprint(i) {
+				t.Fatalf("received %q, want %d", msg, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d timeout", i)
+		}
+	}
+
+	mu.Lock()
+	n := len(serverAgents)
+	agent := serverAgents[0]
+	mu.Unlock()
+	if n != 1 {
+		t.Fatalf("%d server agents, want 1", n)
+	}
+
+	// the session expires after the grace period once the client is gone
+	client.Close()
+	rc.Close()
+	select {
+	case <-agent.closed:
+	case <-time.After(time.Second):
+		t.Fatal("session not expired")
+	}
+	if rs.Count() != 0 {
+		t.Fatalf("%d sessions kept", rs.Count())
+	}
+	rs.Close()
+}
+
+func TestResumableConn_CanResume(t *testing.T) {
+	rc := newResumableConn(resumeToken{}, 2, 8)
+	for i := 0; i < 3; i++ {
+		rc.WriteMsg([]byte{byte(i)})
+	}
+	// seq 1 is dropped, 2 and 3 are kept
+	for recv, want := range []bool{false, true, true, true, false} {
+		if got := rc.canResume(uint64(recv)); got != want {
+			t.Errorf("canResume(%d) = %v, want %v", recv, got, want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gzjjyz/logger"
+	"github.com/gzjjyz/srvlib/utils"
+)
+
+var ErrRPCClosed = errors.New("rpc conn closed")
+
+// RPCError is the error returned by the request handler of the peer
+type RPCError string
+
+func (e RPCError) Error() string {
+	return string(e)
+}
+
+// ------------------------------
+// | kind(1) | seq(4) | payload |
+// ------------------------------
+const (
+	rpcPush byte = iota
+	rpcRequest
+	rpcResponse
+	rpcError
+)
+
+const rpcHeaderLen = 5
+
+type rpcResult struct {
+	data []byte
+	err  error
+}
+
+// RPCConn correlates requests and responses over a Conn by sequence number, both peers must use it
+type RPCConn struct {
+	conn    Conn
+	seq     atomic.Uint32
+	mu      sync.Mutex
+	pending map[uint32]chan rpcResult
+	closed  bool
+
+	// Timeout applies to the calls whose context has no deadline
+	Timeout time.Duration
+	// OnRequest answers the calls of the peer, it runs in its own goroutine
+	OnRequest func(req []byte) ([]byte, error)
+	// OnPush handles the messages the peer sent by Push, it runs in the Serve goroutine
+	OnPush func(msg []byte)
+}
+
+func NewRPCConn(conn Conn) *RPCConn {
+	return &RPCConn{
+		conn:    conn,
+		pending: make(map[uint32]chan rpcResult),
+	}
+}
+
+func (c *RPCConn) Conn() Conn {
+	return c.conn
+}
+
+func (c *RPCConn) write(kind byte, seq uint32, msg []byte) error {
+	var header [rpcHeaderLen]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], seq)
+	return c.conn.WriteMsg(header[:], msg)
+}
+
+// Push sends a message which expects no reply
+func (c *RPCConn) Push(msg []byte) error {
+	return c.write(rpcPush, 0, msg)
+}
+
+func (c *RPCConn) Call(ctx context.Context, msg []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok && c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	seq := c.seq.Add(1)
+	ch := make(chan rpcResult, 1)
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrRPCClosed
+	}
+	c.pending[seq] = ch
+	c.mu.Unlock()
+
+	if err := c.write(rpcRequest, seq, msg); err != nil {
+		c.remove(seq)
+		return nil, err
+	}
+
+	select {
+	case r := <-ch:
+		return r.data, r.err
+	case <-ctx.Done():
+		c.remove(seq)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *RPCConn) remove(seq uint32) chan rpcResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.pending[seq]
+	if !ok {
+		return nil
+	}
+	delete(c.pending, seq)
+	return ch
+}
+
+// Serve reads the conn until it fails, the pending calls fail with ErrRPCClosed then
+func (c *RPCConn) Serve() error {
+	defer c.close()
+
+	for {
+		data, err := c.conn.ReadMsg()
+		if err != nil {
+			return err
+		}
+		if len(data) < rpcHeaderLen {
+			logger.LogDebug("rpc message too short")
+			continue
+		}
+
+		kind, seq, payload := data[0], binary.BigEndian.Uint32(data[1:]), data[rpcHeaderLen:]
+		switch kind {
+		case rpcPush:
+			if c.OnPush != nil {
+				utils.ProtectRun(func() {
+					c.OnPush(payload)
+				})
+			}
+		case rpcRequest:
+			go c.handleRequest(seq, payload)
+		case rpcResponse, rpcError:
+			ch := c.remove(seq)
+			if ch == nil {
+				logger.LogDebug("rpc response %v without pending call", seq)
+				continue
+			}
+			if kind == rpcError {
+				ch <- rpcResult{err: RPCError(payload)}
+			} else {
+				ch <- rpcResult{data: payload}
+			}
+		default:
+			logger.LogDebug("unknown rpc message kind %v", kind)
+		}
+	}
+}
+
+func (c *RPCConn) handleRequest(seq uint32, req []byte) {
+	if c.OnRequest == nil {
+		c.write(rpcError, seq, []byte("rpc request not handled"))
+		return
+	}
+
+	// err is kept if the handler panics
+	var resp []byte
+	err := errors.New("rpc request handler panicked")
+	utils.ProtectRun(func() {
+		resp, err = c.OnRequest(req)
+	})
+	if err != nil {
+		c.write(rpcError, seq, []byte(err.Error()))
+		return
+	}
+	c.write(rpcResponse, seq, resp)
+}
+
+func (c *RPCConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for seq, ch := range c.pending {
+		ch <- rpcResult{err: ErrRPCClosed}
+		delete(c.pending, seq)
+	}
+}
@@ -0,0 +1,65 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRPCConn(t *testing.T) {
+	c, s := net.Pipe()
+	cfg := (&connConfig{pendingWriteNum: 10}).init()
+	client := NewRPCConn(newTCPConn(c, cfg, NewMsgParser()))
+	server := NewRPCConn(newTCPConn(s, cfg, NewMsgParser()))
+
+	pushed := make(chan string, 1)
+	client.OnPush = func(msg []byte) {
+		pushed <- string(msg)
+	}
+	server.OnRequest = func(req []byte) ([]byte, error) {
+		switch string(req) {
+		case "ping":
+			server.Push([]byte("notice"))
+			return []byte("pong"), nil
+		case "slow":
+			time.Sleep(time.Second)
+		}
+		return nil, errors.New("bad request")
+	}
+	go server.Serve()
+	served := make(chan error, 1)
+	go func() {
+		served <- client.Serve()
+	}()
+
+	reply, err := client.Call(context.Background(), []byte("ping"))
+	if err != nil || string(reply) != "pong" {
+		t.Fatalf("unexpected reply %q %v", reply, err)
+	}
+	if msg := <-pushed; msg != "notice" {
+		t.Fatalf("unexpected push %q", msg)
+	}
+	if _, err := client.Call(context.Background(), []byte("?")); err != RPCError("bad request") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.Call(ctx, []byte("slow")); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Call(context.Background(), []byte("slow"))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	if err := <-done; err != ErrRPCClosed {
+		t.Fatalf("unexpected error %v", err)
+	}
+	<-served
+}
@@ -0,0 +1,346 @@
+package network
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gzjjyz/logger"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+type Session struct {
+	id       uint64
+	conn     Conn
+	mu       sync.RWMutex
+	key      string
+	userData interface{}
+	groups   map[string]struct{}
+}
+
+func (s *Session) Id() uint64 {
+	return s.id
+}
+
+func (s *Session) Conn() Conn {
+	return s.conn
+}
+
+// Key returns the key bound by SessionManager.Bind
+func (s *Session) Key() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.key
+}
+
+func (s *Session) UserData() interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.userData
+}
+
+func (s *Session) SetUserData(userData interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.userData = userData
+}
+
+func (s *Session) WriteMsg(args ...[]byte) error {
+	return s.conn.WriteMsg(args...)
+}
+
+// SessionManager gives every conn a unique session id, set it on TCPServer or WSServer to register the
+// accepted conns automatically, the session is removed after the agent's OnClose
+type SessionManager struct {
+	mu       sync.RWMutex
+	nextId   atomic.Uint64
+	sessions map[uint64]*Session
+	byConn   map[Conn]*Session
+	byKey    map[string]*Session
+	groups   map[string]map[uint64]*Session
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions: make(map[uint64]*Session),
+		byConn:   make(map[Conn]*Session),
+		byKey:    make(map[string]*Session),
+		groups:   make(map[string]map[uint64]*Session),
+	}
+}
+
+func (m *SessionManager) Add(conn Conn) *Session {
+	s := &Session{
+		id:   m.nextId.Add(1),
+		conn: conn,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.id] = s
+	m.byConn[conn] = s
+	return s
+}
+
+func (m *SessionManager) Remove(id uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return
+	}
+	delete(m.sessions, id)
+	delete(m.byConn, s.conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key != "" && m.byKey[s.key] == s {
+		delete(m.byKey, s.key)
+	}
+	for group := range s.groups {
+		m.leaveGroup(group, s)
+	}
+}
+
+func (m *SessionManager) Get(id uint64) (*Session, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.sessions[id]
+	return s, ok
+}
+
+func (m *SessionManager) GetByConn(conn Conn) (*Session, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.byConn[conn]
+	return s, ok
+}
+
+func (m *SessionManager) GetByKey(key string) (*Session, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.byKey[key]
+	return s, ok
+}
+
+// Bind binds the key and the user data to the session, the session which held the key before is returned
+// so that the caller can kick it
+func (m *SessionManager) Bind(id uint64, key string, userData interface{}) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key != "" && m.byKey[s.key] == s {
+		delete(m.byKey, s.key)
+	}
+
+	old := m.byKey[key]
+	if old != nil {
+		old.mu.Lock()
+		old.key = ""
+		old.mu.Unlock()
+	}
+
+	s.key = key
+	s.userData = userData
+	m.byKey[key] = s
+	return old, nil
+}
+
+func (m *SessionManager) Unbind(id uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key != "" && m.byKey[s.key] == s {
+		delete(m.byKey, s.key)
+	}
+	s.key = ""
+	s.userData = nil
+}
+
+func (m *SessionManager) Count() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.sessions)
+}
+
+// Range stops if fn returns false, fn must not call back into the manager
+func (m *SessionManager) Range(fn func(s *Session) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.sessions {
+		if !fn(s) {
+			return
+		}
+	}
+}
+
+func (m *SessionManager) JoinGroup(group string, id uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	members, ok := m.groups[group]
+	if !ok {
+		members = make(map[uint64]*Session)
+		m.groups[group] = members
+	}
+	members[id] = s
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.groups == nil {
+		s.groups = make(map[string]struct{})
+	}
+	s.groups[group] = struct{}{}
+	return nil
+}
+
+func (m *SessionManager) LeaveGroup(group string, id uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.leaveGroup(group, s)
+}
+
+// leaveGroup must be called with both the manager and the session locked
+func (m *SessionManager) leaveGroup(group string, s *Session) {
+	delete(s.groups, group)
+	if members, ok := m.groups[group]; ok {
+		delete(members, s.id)
+		if len(members) == 0 {
+			delete(m.groups, group)
+		}
+	}
+}
+
+func (m *SessionManager) GroupMembers(group string) []*Session {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	members := make([]*Session, 0, len(m.groups[group]))
+	for _, s := range m.groups[group] {
+		members = append(members, s)
+	}
+	return members
+}
+
+// Broadcast writes the message to every session, it's packed once per codec
+func (m *SessionManager) Broadcast(args ...[]byte) error {
+	m.mu.RLock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.mu.RUnlock()
+
+	return fanout(sessions, args)
+}
+
+// Multicast writes the message to the sessions of the ids, unknown ids are skipped
+func (m *SessionManager) Multicast(ids []uint64, args ...[]byte) error {
+	m.mu.RLock()
+	sessions := make([]*Session, 0, len(ids))
+	for _, id := range ids {
+		if s, ok := m.sessions[id]; ok {
+			sessions = append(sessions, s)
+		}
+	}
+	m.mu.RUnlock()
+
+	return fanout(sessions, args)
+}
+
+func (m *SessionManager) GroupBroadcast(group string, args ...[]byte) error {
+	return fanout(m.GroupMembers(group), args)
+}
+
+// packedWriter is implemented by conns which can write a message packed once for many conns,
+// conns with equal pack keys share the packed bytes, a nil key writes by WriteMsg
+type packedWriter interface {
+	packKey() interface{}
+	packMsg(args ...[]byte) ([]byte, error)
+	// args are the message b is packed from
+	writePacked(b []byte, args [][]byte)
+}
+
+// fanout writes to every session, the ones failing are logged and skipped, the first error is returned
+func fanout(sessions []*Session, args [][]byte) error {
+	var first error
+	fail := func(s *Session, err error) {
+		logger.LogError("broadcast to session %d error: %v", s.id, err)
+		if first == nil {
+			first = err
+		}
+	}
+
+	packed := make(map[interface{}][]byte)
+	packErrs := make(map[interface{}]error)
+	for _, s := range sessions {
+		var key interface{}
+		pw, ok := s.conn.(packedWriter)
+		if ok {
+			key = pw.packKey()
+		}
+		if key == nil {
+			if err := s.conn.WriteMsg(args...); err != nil {
+				fail(s, err)
+			}
+			continue
+		}
+
+		var b []byte
+		var cached bool
+		shareable := reflect.TypeOf(key).Comparable()
+		if shareable {
+			if err, failed := packErrs[key]; failed {
+				fail(s, err)
+				continue
+			}
+			b, cached = packed[key]
+		}
+		if !cached {
+			var err error
+			b, err = pw.packMsg(args...)
+			if err != nil {
+				if shareable {
+					packErrs[key] = err
+				}
+				fail(s, err)
+				continue
+			}
+			if shareable {
+				packed[key] = b
+			}
+		}
+		pw.writePacked(b, args)
+	}
+	return first
+}
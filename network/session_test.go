@@ -0,0 +1,74 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+type recordConn struct {
+	msgs [][]byte
+	err  error
+}
+
+func (c *recordConn) ReadMsg() ([]byte, error) { return nil, nil }
+func (c *recordConn) WriteMsg(args ...[]byte) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.msgs = append(c.msgs, args[0])
+	return nil
+}
+func (c *recordConn) LocalAddr() net.Addr           { return nil }
+func (c *recordConn) RemoteAddr() net.Addr          { return nil }
+func (c *recordConn) Close()                        {}
+func (c *recordConn) Destroy()                      {}
+func (c *recordConn) RemoteAddrWithoutPort() string { return "" }
+func (c *recordConn) Stats() ConnStats              { return ConnStats{} }
+
+func TestSessionManager(t *testing.T) {
+	m := NewSessionManager()
+	c1, c2 := &recordConn{}, &recordConn{}
+	s1, s2 := m.Add(c1), m.Add(c2)
+	if s1.Id() == s2.Id() {
+		t.Fatal("duplicated session id")
+	}
+
+	if old, err := m.Bind(s1.Id(), "role:1", 1); err != nil || old != nil {
+		t.Fatalf("unexpected bind %v %v", old, err)
+	}
+	if old, _ := m.Bind(s2.Id(), "role:1", 2); old != s1 {
+		t.Fatal("rebinding the key should return the old session")
+	}
+	if s, ok := m.GetByKey("role:1"); !ok || s != s2 || s.UserData() != 2 {
+		t.Fatal("unexpected session by key")
+	}
+
+	m.JoinGroup("guild", s1.Id())
+	m.GroupBroadcast("guild", []byte("g"))
+	m.Broadcast([]byte("all"))
+	if len(c1.msgs) != 2 || len(c2.msgs) != 1 {
+		t.Fatalf("unexpected msgs %q %q", c1.msgs, c2.msgs)
+	}
+
+	m.Remove(s1.Id())
+	if len(m.GroupMembers("guild")) != 0 || m.Count() != 1 {
+		t.Fatal("removed session still referenced")
+	}
+}
+
+func TestSessionManager_BroadcastError(t *testing.T) {
+	m := NewSessionManager()
+	errWrite := errors.New("write error")
+	conns := []*recordConn{{}, {err: errWrite}, {}}
+	for _, c := range conns {
+		m.Add(c)
+	}
+
+	if err := m.Broadcast([]byte("all")); err != errWrite {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(conns[0].msgs) != 1 || len(conns[2].msgs) != 1 {
+		t.Fatal("a failed session stopped the broadcast")
+	}
+}
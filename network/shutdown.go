@@ -0,0 +1,58 @@
+package network
+
+import (
+	"context"
+	"sync"
+)
+
+// agentConn is a conn and the agent serving it
+type agentConn struct {
+	conn  Conn
+	agent Agent
+}
+
+// shutdownAgents tells the agents at once and closes their conns, a closed conn flushes its write queue first,
+// it returns when every agent is told or ctx is done
+func shutdownAgents(ctx context.Context, agents []agentConn) {
+	var wg sync.WaitGroup
+	for _, ac := range agents {
+		wg.Add(1)
+		go func(ac agentConn) {
+			defer wg.Done()
+			if agent, ok := ac.agent.(ShutdownAgent); ok {
+				agent.OnShutdown()
+			}
+			ac.conn.Close()
+		}(ac)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// waitDrained waits for wg until ctx is done, then it destroys the conns left and returns without waiting for their agents
+func waitDrained(ctx context.Context, wg *sync.WaitGroup, agents []agentConn) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	for _, ac := range agents {
+		ac.conn.Destroy()
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,202 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type shutdownTestAgent struct {
+	idleTestAgent
+}
+
+func (a *shutdownTestAgent) OnShutdown() {
+	a.conn.WriteMsg([]byte("bye"))
+}
+
+func TestTCPServer_Shutdown(t *testing.T) {
+	agents := make(chan *shutdownTestAgent, 1)
+	server := &TCPServer{
+		Addr: "127.0.0.1:0",
+		NewAgent: func(conn *TCPConn) Agent {
+			agent := &shutdownTestAgent{idleTestAgent{conn: conn, closed: make(chan struct{})}}
+			agents <- agent
+			return agent
+		},
+	}
+	server.Start()
+
+	conn, err := net.Dial("tcp", server.lns[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	agent := <-agents
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-agent.closed:
+	default:
+		t.Fatal("agent not closed")
+	}
+
+	msg, err := NewMsgParser().Read(conn)
+	if err != nil || string(msg) != "bye" {
+		t.Fatalf("read %q, error %v", msg, err)
+	}
+	if _, err := NewMsgParser().Read(conn); err == nil {
+		t.Fatal("conn not closed")
+	}
+	if _, err := net.Dial("tcp", server.lns[0].Addr().String()); err == nil {
+		t.Fatal("server still accepting")
+	}
+}
+
+type wsShutdownTestAgent struct {
+	conn   *WSConn
+	closed chan struct{}
+}
+
+func (a *wsShutdownTestAgent) Run() {
+	for {
+		if _, err := a.conn.ReadMsg(); err != nil {
+			return
+		}
+	}
+}
+
+func (a *wsShutdownTestAgent) OnClose() {
+	close(a.closed)
+}
+
+func (a *wsShutdownTestAgent) OnShutdown() {
+	a.conn.WriteMsg([]byte("bye"))
+}
+
+func TestWSServer_Shutdown(t *testing.T) {
+	agents := make(chan *wsShutdownTestAgent, 1)
+	server := &WSServer{
+		Addr: "127.0.0.1:0",
+		NewAgent: func(conn *WSConn) Agent {
+			agent := &wsShutdownTestAgent{conn: conn, closed: make(chan struct{})}
+			agents <- agent
+			return agent
+		},
+	}
+	server.Start()
+
+	url := "ws://" + server.ln.Addr().String()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	agent := <-agents
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-agent.closed:
+	default:
+		t.Fatal("agent not closed")
+	}
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil || string(msg) != "bye" {
+		t.Fatalf("read %q, error %v", msg, err)
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("conn not closed")
+	}
+	if _, _, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		t.Fatal("server still accepting")
+	}
+}
+
+type blockingShutdownAgent struct {
+	told    chan struct{}
+	release chan struct{}
+}
+
+func (a *blockingShutdownAgent) Run()     {}
+func (a *blockingShutdownAgent) OnClose() {}
+
+func (a *blockingShutdownAgent) OnShutdown() {
+	a.told <- struct{}{}
+	<-a.release
+}
+
+func TestShutdownAgents_Context(t *testing.T) {
+	agent := &blockingShutdownAgent{told: make(chan struct{}, 2), release: make(chan struct{})}
+	defer close(agent.release)
+	agents := []agentConn{{conn: &recordConn{}, agent: agent}, {conn: &recordConn{}, agent: agent}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	shutdownAgents(ctx, agents)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("shutdown took %v past the context", d)
+	}
+	// both are told although the first one blocks
+	for i := 0; i < 2; i++ {
+		<-agent.told
+	}
+}
+
+type stuckTestAgent struct {
+	release chan struct{}
+}
+
+func (a *stuckTestAgent) Run() {
+	<-a.release
+}
+
+func (a *stuckTestAgent) OnClose() {}
+
+func TestTCPServer_ShutdownTimeout(t *testing.T) {
+	agent := &stuckTestAgent{release: make(chan struct{})}
+	served := make(chan struct{})
+	server := &TCPServer{
+		Addr: "127.0.0.1:0",
+		NewAgent: func(conn *TCPConn) Agent {
+			close(served)
+			return agent
+		},
+	}
+	server.Start()
+
+	conn, err := net.Dial("tcp", server.lns[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-served
+
+	// the agent does not return, Shutdown gives up when ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown error %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("shutdown took %v", d)
+	}
+	if _, err := NewMsgParser().Read(conn); err == nil {
+		t.Fatal("conn not destroyed")
+	}
+
+	close(agent.release)
+	server.Close()
+}
@@ -1,6 +1,9 @@
 package network
 
 import (
+	"context"
+	"crypto/tls"
+	"io"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -17,28 +20,90 @@ type TCPClient struct {
 	PendingWriteNum int
 	AutoReconnect   bool
 	NewAgent        func(*TCPConn) Agent
+	Metrics         *Metrics                                    // nil creates one named by Addr
+	Dial            func(ctx context.Context) (net.Conn, error) // nil dials Addr over tcp, the DialContext of a PipeListener connects in memory
 	conns           ConnSet
 	wg              sync.WaitGroup
+	connCfg         *connConfig
 	closeFlag       atomic.Bool
+	retry           *reconnector
+
+	// reconnect, the delay doubles from ConnectInterval up to MaxConnectInterval on every failure in a row,
+	// ConnectJitter randomizes it by up to the fraction, a conn gives up after MaxAttempts failures in a row, 0 never
+	MaxConnectInterval time.Duration
+	ConnectJitter      float64
+	MaxAttempts        int
+	OnConnected        func(conn Conn)
+	OnDisconnected     func(conn Conn, reason CloseReason)
+	OnGiveUp           func(err error)
 
 	// msg parser
 	LenMsgLen    int
 	MinMsgLen    uint32
 	MaxMsgLen    uint32
 	LittleEndian bool
-	msgParser    *MsgParser
+	// Codec takes precedence over the msg parser options above
+	Codec FrameCodec
+	codec FrameCodec
+
+	// handshake
+	Handshaker       Handshaker
+	HandshakeTimeout time.Duration
+
+	// write queue overflow
+	OverflowPolicy  OverflowPolicy
+	OverflowTimeout time.Duration
+	CoalesceBytes   int
+	OnOverflow      func(conn Conn, policy OverflowPolicy)
+
+	// idle
+	ReadIdleTimeout  time.Duration
+	WriteIdleTimeout time.Duration
+	IdleTimeout      time.Duration
+	// HeartbeatInterval also lets the default msg parser take a zero len as a heartbeat, set it on both sides
+	HeartbeatInterval time.Duration
+	// OnIdle returns whether to destroy the conn, nil destroys on read and total idle
+	OnIdle func(conn Conn, kind IdleKind) bool
+
+	// record, Record returns where the messages of a conn are recorded, nil or a nil writer records nothing, see RecordToDir
+	Record func(conn Conn) io.WriteCloser
+
+	// tls, enabled if TLS is set, CertFile is the client certificate and RootCAFile verifies the server
+	TLS        bool
+	CertFile   string
+	KeyFile    string
+	RootCAFile string
+	ServerName string
+	ConfigTLS  func(config *tls.Config)
+	tlsConfig  *tls.Config
 }
 
 func (client *TCPClient) Start() {
-	client.init()
+	client.StartContext(context.Background())
+}
+
+// StartContext starts the client, the pending dials are canceled and the conns are closed when ctx is done
+func (client *TCPClient) StartContext(ctx context.Context) {
+	client.init(ctx)
 
+	client.wg.Add(1)
+	go func() {
+		defer client.wg.Done()
+		<-client.retry.ctx.Done()
+		client.closeConns()
+	}()
 	for i := 0; i < client.ConnNum; i++ {
 		client.wg.Add(1)
 		go client.connect()
 	}
 }
 
-func (client *TCPClient) init() {
+// Ready waits until a conn is connected, it fails if ctx is done, the client is closed or all the conns give up
+func (client *TCPClient) Ready(ctx context.Context) error {
+	return client.retry.wait(ctx)
+}
+
+func (client *TCPClient) init(ctx context.Context) {
 	client.Lock()
 	defer client.Unlock()
 
@@ -54,6 +119,9 @@ func (client *TCPClient) init() {
 		client.PendingWriteNum = 100
 		logger.LogInfo("invalid PendingWriteNum, reset to %v", client.PendingWriteNum)
 	}
+	if client.HandshakeTimeout <= 0 {
+		client.HandshakeTimeout = 10 * time.Second
+	}
 	if client.NewAgent == nil {
 		logger.LogFatal("NewAgent must not be nil")
 	}
@@ -62,71 +130,162 @@ func (client *TCPClient) init() {
 	}
 
 	client.conns = make(ConnSet)
+	if client.Metrics == nil {
+		client.Metrics = NewMetrics(client.Addr)
+	}
 	client.closeFlag.Store(false)
+	client.retry = newReconnector(ctx, client.ConnNum)
+	client.retry.interval = client.ConnectInterval
+	client.retry.maxInterval = client.MaxConnectInterval
+	client.retry.jitter = client.ConnectJitter
+	client.retry.maxAttempts = client.MaxAttempts
+	client.retry.onGiveUp = client.OnGiveUp
+	client.connCfg = (&connConfig{
+		isServer:          false,
+		pendingWriteNum:   client.PendingWriteNum,
+		overflowPolicy:    client.OverflowPolicy,
+		overflowTimeout:   client.OverflowTimeout,
+		coalesceBytes:     client.CoalesceBytes,
+		onOverflow:        client.OnOverflow,
+		readIdleTimeout:   client.ReadIdleTimeout,
+		writeIdleTimeout:  client.WriteIdleTimeout,
+		idleTimeout:       client.IdleTimeout,
+		heartbeatInterval: client.HeartbeatInterval,
+		onIdle:            client.OnIdle,
+		record:            client.Record,
+		metrics:           client.Metrics,
+	}).init()
+
+	if client.TLS {
+		config, err := newClientTLSConfig(client.Addr, client.CertFile, client.KeyFile, client.RootCAFile, client.ServerName, client.ConfigTLS)
+		if err != nil {
+			logger.LogFatal("%v", err)
+		}
+		client.tlsConfig = config
+	}
 
 	// msg parser
-	msgParser := NewMsgParser()
-	msgParser.SetMsgLen(client.LenMsgLen, client.MinMsgLen, client.MaxMsgLen)
-	msgParser.SetByteOrder(client.LittleEndian)
-	client.msgParser = msgParser
+	if client.Codec != nil {
+		client.codec = client.Codec
+	} else {
+		msgParser := NewMsgParser()
+		msgParser.SetMsgLen(client.LenMsgLen, client.MinMsgLen, client.MaxMsgLen)
+		msgParser.SetByteOrder(client.LittleEndian)
+		msgParser.SetHeartbeat(client.HeartbeatInterval > 0)
+		client.codec = msgParser
+	}
 }
 
-func (client *TCPClient) dial() net.Conn {
-	for {
-		conn, err := net.Dial("tcp", client.Addr)
-		if err == nil || client.closeFlag.Load() {
-			return conn
-		}
-
-		logger.LogError("connect to %v error: %v", client.Addr, err)
-		time.Sleep(client.ConnectInterval)
-		continue
+func (client *TCPClient) dial() (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if client.Dial != nil {
+		conn, err = client.Dial(client.retry.ctx)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(client.retry.ctx, "tcp", client.Addr)
+	}
+	if err == nil && client.tlsConfig != nil {
+		conn, err = tlsClientHandshake(conn, client.tlsConfig, client.HandshakeTimeout)
 	}
+	return conn, err
 }
 
 func (client *TCPClient) connect() {
 	defer client.wg.Done()
+	defer client.retry.exit()
 
-reconnect:
-	conn := client.dial()
-	if conn == nil {
-		return
-	}
+	failures := 0
+	for {
+		conn, err := client.dial()
+		if err != nil {
+			if client.retry.closed() {
+				return
+			}
+			client.Metrics.reject(rejectDial)
+			logger.LogError("connect to %v error: %v", client.Addr, err)
+			failures++
+			if !client.retry.backoff(failures, err) {
+				return
+			}
+			continue
+		}
 
-	client.Lock()
-	if client.closeFlag.Load() {
+		client.Lock()
+		if client.closeFlag.Load() {
+			client.Unlock()
+			conn.Close()
+			return
+		}
+		client.conns[conn] = struct{}{}
 		client.Unlock()
-		conn.Close()
-		return
+		client.Metrics.accept()
+
+		codec, err := handshake(conn, client.Handshaker, client.codec, false, client.HandshakeTimeout)
+		if err != nil {
+			logger.LogError("handshake with %v error: %v", client.Addr, err)
+			conn.Close()
+			client.Metrics.reject(rejectHandshake)
+			client.Lock()
+			delete(client.conns, conn)
+			client.Unlock()
+			failures++
+			if !client.AutoReconnect || !client.retry.backoff(failures, err) {
+				return
+			}
+			continue
+		}
+
+		failures = 0
+		client.serve(conn, codec)
+		if !client.AutoReconnect || !client.retry.sleep(client.retry.delay(0)) {
+			return
+		}
 	}
-	client.conns[conn] = struct{}{}
-	client.Unlock()
+}
 
-	tcpConn := newTCPConn(conn, client.PendingWriteNum, client.msgParser)
+func (client *TCPClient) serve(conn net.Conn, codec FrameCodec) {
+	tcpConn := newTCPConn(conn, client.connCfg, codec)
+	client.Metrics.open()
+	client.retry.connected()
 	agent := client.NewAgent(tcpConn)
-	agent.Run()
+	if client.OnConnected != nil {
+		client.OnConnected(tcpConn)
+	}
+	runAgent(client.retry.ctx, agent, tcpConn.done)
 
 	// cleanup
 	tcpConn.Close()
+	reason := tcpConn.stats.closeReason()
+	client.Metrics.close(reason)
 	client.Lock()
 	delete(client.conns, conn)
 	client.Unlock()
-	agent.OnClose()
-
-	if client.AutoReconnect {
-		time.Sleep(client.ConnectInterval)
-		goto reconnect
+	closeAgent(agent, reason)
+	if client.OnDisconnected != nil {
+		client.OnDisconnected(tcpConn, reason)
 	}
 }
 
-func (client *TCPClient) Close() {
+func (client *TCPClient) closeConns() {
 	client.Lock()
 	client.closeFlag.Store(true)
 	for conn := range client.conns {
 		conn.Close()
 	}
-	client.conns = nil
 	client.Unlock()
+}
 
+func (client *TCPClient) Close() {
+	if client.retry != nil {
+		client.retry.cancel()
+	}
+	client.closeConns()
 	client.wg.Wait()
+
+	client.Lock()
+	client.conns = nil
+	client.Unlock()
 }
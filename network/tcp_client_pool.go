@@ -0,0 +1,384 @@
+package network
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gzjjyz/logger"
+	"github.com/gzjjyz/srvlib/alg/consistent_hash"
+)
+
+var ErrNoEndpoint = errors.New("no endpoint available")
+
+// BalancePolicy picks the conn of TCPClientPool a message goes to
+type BalancePolicy int
+
+const (
+	// BalanceRoundRobin takes the conns in turn
+	BalanceRoundRobin BalancePolicy = iota
+	// BalanceLeastPending takes the conn with the fewest messages queued to write
+	BalanceLeastPending
+	// BalanceConsistentHash keeps a key on the same endpoint while the endpoints change little
+	BalanceConsistentHash
+)
+
+func (p BalancePolicy) String() string {
+	switch p {
+	case BalanceRoundRobin:
+		return "round_robin"
+	case BalanceLeastPending:
+		return "least_pending"
+	case BalanceConsistentHash:
+		return "consistent_hash"
+	}
+	return "unknown"
+}
+
+// TCPClientPool connects a TCPClient to each of a list of endpoints and balances the messages over their conns.
+// the list may change any time by SetEndpoints, e.g. when the discovery tells, the endpoints kept are not touched
+// and the ones removed take no more messages and are closed after DrainTimeout.
+// an endpoint failing EjectAfter dials in a row is ejected and probed again every ProbeInterval
+// goroutine safe
+type TCPClientPool struct {
+	Addrs []string
+	// NewClient returns the client of an endpoint, its AutoReconnect is set and its callbacks are chained
+	NewClient func(addr string) *TCPClient
+	Balance   BalancePolicy
+
+	// ejection
+	EjectAfter    int
+	ProbeInterval time.Duration
+	DrainTimeout  time.Duration
+
+	// HashReplicas are the points of an endpoint on the hash ring
+	HashReplicas int
+
+	mu        sync.Mutex
+	endpoints map[string]*poolEndpoint
+	ring      *consistent_hash.ConsistentHashing
+	next      atomic.Uint32
+	closeFlag bool
+}
+
+type poolEndpoint struct {
+	addr    string
+	client  *TCPClient
+	mu      sync.Mutex
+	conns   []*TCPConn
+	next    uint32
+	ejected bool
+	removed bool
+	timer   *time.Timer
+}
+
+func (pool *TCPClientPool) Start() {
+	if pool.NewClient == nil {
+		logger.LogFatal("NewClient must not be nil")
+	}
+	if pool.EjectAfter <= 0 {
+		pool.EjectAfter = 3
+	}
+	if pool.ProbeInterval <= 0 {
+		pool.ProbeInterval = 5 * time.Second
+	}
+	if pool.DrainTimeout <= 0 {
+		pool.DrainTimeout = 10 * time.Second
+	}
+	if pool.HashReplicas <= 0 {
+		pool.HashReplicas = 64
+	}
+
+	pool.mu.Lock()
+	pool.endpoints = make(map[string]*poolEndpoint)
+	pool.ring = &consistent_hash.ConsistentHashing{}
+	pool.ring.Init()
+	pool.closeFlag = false
+	pool.mu.Unlock()
+
+	pool.SetEndpoints(pool.Addrs)
+}
+
+// SetEndpoints replaces the endpoint list
+func (pool *TCPClientPool) SetEndpoints(addrs []string) {
+	keep := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		keep[addr] = true
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.closeFlag {
+		return
+	}
+	for addr, ep := range pool.endpoints {
+		if !keep[addr] {
+			pool.removeLocked(ep)
+		}
+	}
+	for addr := range keep {
+		if _, ok := pool.endpoints[addr]; !ok {
+			pool.addLocked(addr)
+		}
+	}
+}
+
+func (pool *TCPClientPool) AddEndpoint(addr string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if _, ok := pool.endpoints[addr]; !ok && !pool.closeFlag {
+		pool.addLocked(addr)
+	}
+}
+
+func (pool *TCPClientPool) RemoveEndpoint(addr string) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if ep, ok := pool.endpoints[addr]; ok {
+		pool.removeLocked(ep)
+	}
+}
+
+// Endpoints returns the endpoints not ejected
+func (pool *TCPClientPool) Endpoints() []string {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	addrs := make([]string, 0, len(pool.endpoints))
+	for addr, ep := range pool.endpoints {
+		ep.mu.Lock()
+		if !ep.ejected {
+			addrs = append(addrs, addr)
+		}
+		ep.mu.Unlock()
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (pool *TCPClientPool) addLocked(addr string) {
+	ep := &poolEndpoint{addr: addr, client: pool.NewClient(addr)}
+	client := ep.client
+	client.Addr = addr
+	client.AutoReconnect = true
+	if client.MaxAttempts <= 0 {
+		client.MaxAttempts = pool.EjectAfter
+	}
+
+	onConnected, onDisconnected, onGiveUp := client.OnConnected, client.OnDisconnected, client.OnGiveUp
+	client.OnConnected = func(conn Conn) {
+		pool.connected(ep, conn.(*TCPConn))
+		if onConnected != nil {
+			onConnected(conn)
+		}
+	}
+	client.OnDisconnected = func(conn Conn, reason CloseReason) {
+		ep.remove(conn.(*TCPConn))
+		if onDisconnected != nil {
+			onDisconnected(conn, reason)
+		}
+	}
+	client.OnGiveUp = func(err error) {
+		logger.LogError("endpoint %v ejected: %v", addr, err)
+		pool.eject(ep)
+		if onGiveUp != nil {
+			onGiveUp(err)
+		}
+	}
+
+	pool.endpoints[addr] = ep
+	pool.addToRing(addr)
+	client.Start()
+}
+
+// removeLocked stops picking ep, its conns are closed after DrainTimeout so the messages in flight are served
+func (pool *TCPClientPool) removeLocked(ep *poolEndpoint) {
+	delete(pool.endpoints, ep.addr)
+	pool.removeFromRing(ep.addr)
+
+	ep.mu.Lock()
+	ep.removed = true
+	if ep.timer != nil {
+		ep.timer.Stop()
+	}
+	ep.mu.Unlock()
+	time.AfterFunc(pool.DrainTimeout, ep.client.Close)
+}
+
+func (pool *TCPClientPool) ringHash(addr string, i int) uint32 {
+	return hashKey(addr + "#" + strconv.Itoa(i))
+}
+
+func (pool *TCPClientPool) addToRing(addr string) {
+	for i := 0; i < pool.HashReplicas; i++ {
+		pool.ring.AddNode(addr, pool.ringHash(addr, i))
+	}
+}
+
+func (pool *TCPClientPool) removeFromRing(addr string) {
+	for i := 0; i < pool.HashReplicas; i++ {
+		h := pool.ringHash(addr, i)
+		if key, ok := pool.ring.GetNode(h); ok && key == addr {
+			pool.ring.RemoveNode(h)
+		}
+	}
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (pool *TCPClientPool) connected(ep *poolEndpoint, conn *TCPConn) {
+	ep.mu.Lock()
+	ep.conns = append(ep.conns, conn)
+	ejected := ep.ejected
+	ep.ejected = false
+	ep.mu.Unlock()
+
+	if ejected {
+		logger.LogInfo("endpoint %v is back", ep.addr)
+		pool.mu.Lock()
+		if pool.endpoints[ep.addr] == ep {
+			pool.addToRing(ep.addr)
+		}
+		pool.mu.Unlock()
+	}
+}
+
+func (ep *poolEndpoint) remove(conn *TCPConn) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	for i, c := range ep.conns {
+		if c == conn {
+			ep.conns = append(ep.conns[:i], ep.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// eject takes ep out of the ring and dials it again after ProbeInterval
+func (pool *TCPClientPool) eject(ep *poolEndpoint) {
+	ep.mu.Lock()
+	if ep.ejected || ep.removed {
+		ep.mu.Unlock()
+		return
+	}
+	ep.ejected = true
+	ep.mu.Unlock()
+
+	pool.mu.Lock()
+	if pool.endpoints[ep.addr] == ep {
+		pool.removeFromRing(ep.addr)
+	}
+	pool.mu.Unlock()
+
+	// called by a conn goroutine of the client, which Close waits for
+	go func() {
+		ep.client.Close()
+		ep.mu.Lock()
+		defer ep.mu.Unlock()
+		if !ep.removed {
+			ep.timer = time.AfterFunc(pool.ProbeInterval, ep.probe)
+		}
+	}()
+}
+
+func (ep *poolEndpoint) probe() {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if !ep.removed {
+		ep.client.Start()
+	}
+}
+
+func (ep *poolEndpoint) pick() *TCPConn {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if len(ep.conns) == 0 {
+		return nil
+	}
+	ep.next++
+	return ep.conns[ep.next%uint32(len(ep.conns))]
+}
+
+// Pick returns a conn by the balance policy, key is only used by BalanceConsistentHash
+func (pool *TCPClientPool) Pick(key string) (*TCPConn, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	switch pool.Balance {
+	case BalanceConsistentHash:
+		addr, ok := pool.ring.GetNode(hashKey(key))
+		if !ok {
+			return nil, ErrNoEndpoint
+		}
+		if conn := pool.endpoints[addr].pick(); conn != nil {
+			return conn, nil
+		}
+		return nil, ErrNoEndpoint
+	case BalanceLeastPending:
+		var (
+			best    *TCPConn
+			pending int
+		)
+		for _, ep := range pool.endpoints {
+			ep.mu.Lock()
+			for _, conn := range ep.conns {
+				if n := conn.Stats().QueueLen; best == nil || n < pending {
+					best, pending = conn, n
+				}
+			}
+			ep.mu.Unlock()
+		}
+		if best == nil {
+			return nil, ErrNoEndpoint
+		}
+		return best, nil
+	default:
+		addrs := make([]string, 0, len(pool.endpoints))
+		for addr := range pool.endpoints {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		next := pool.next.Add(1)
+		for i := range addrs {
+			if conn := pool.endpoints[addrs[(int(next)+i)%len(addrs)]].pick(); conn != nil {
+				return conn, nil
+			}
+		}
+		return nil, ErrNoEndpoint
+	}
+}
+
+// WriteMsg writes to the conn Pick returns
+func (pool *TCPClientPool) WriteMsg(key string, args ...[]byte) error {
+	conn, err := pool.Pick(key)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMsg(args...)
+}
+
+func (pool *TCPClientPool) Close() {
+	pool.mu.Lock()
+	pool.closeFlag = true
+	endpoints := pool.endpoints
+	pool.endpoints = make(map[string]*poolEndpoint)
+	pool.mu.Unlock()
+
+	for _, ep := range endpoints {
+		ep.mu.Lock()
+		ep.removed = true
+		if ep.timer != nil {
+			ep.timer.Stop()
+		}
+		ep.mu.Unlock()
+		ep.client.Close()
+	}
+}
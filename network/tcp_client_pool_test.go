@@ -0,0 +1,230 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type poolTestCluster struct {
+	mu        sync.Mutex
+	listeners map[string]*PipeListener
+	servers   []*TCPServer
+	addrs     map[*TCPConn]string
+	down      map[string]*atomic.Bool
+}
+
+func newPoolTestCluster(n int) *poolTestCluster {
+	c := &poolTestCluster{
+		listeners: make(map[string]*PipeListener),
+		addrs:     make(map[*TCPConn]string),
+		down:      make(map[string]*atomic.Bool),
+	}
+	for i := 0; i < n; i++ {
+		server, ln := newPipeEchoServer()
+		addr := fmt.Sprintf("battle%d", i)
+		c.listeners[addr] = ln
+		c.servers = append(c.servers, server)
+		c.down[addr] = &atomic.Bool{}
+	}
+	return c
+}
+
+func (c *poolTestCluster) newClient(addr string) *TCPClient {
+	return &TCPClient{
+		ConnectInterval: time.Millisecond,
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			if c.down[addr].Load() {
+				return nil, errors.New("down")
+			}
+			return c.listeners[addr].DialContext(ctx)
+		},
+		NewAgent: func(conn *TCPConn) Agent { return &idleTestAgent{conn: conn, closed: make(chan struct{})} },
+		OnConnected: func(conn Conn) {
+			c.mu.Lock()
+			c.addrs[conn.(*TCPConn)] = addr
+			c.mu.Unlock()
+		},
+	}
+}
+
+func (c *poolTestCluster) pick(t *testing.T, pool *TCPClientPool, key string) string {
+	conn, err := pool.Pick(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addrs[conn]
+}
+
+func (c *poolTestCluster) close() {
+	for _, server := range c.servers {
+		server.Close()
+	}
+}
+
+func waitEndpoints(t *testing.T, pool *TCPClientPool, want int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n := 0
+		pool.mu.Lock()
+		for _, ep := range pool.endpoints {
+			ep.mu.Lock()
+			if len(ep.conns) > 0 {
+				n++
+			}
+			ep.mu.Unlock()
+		}
+		pool.mu.Unlock()
+		if n == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d endpoints connected, want %d", n, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTCPClientPool_RoundRobin(t *testing.T) {
+	cluster := newPoolTestCluster(3)
+	defer cluster.close()
+	pool := &TCPClientPool{Addrs: []string{"battle0", "battle1", "battle2"}, NewClient: cluster.newClient}
+	pool.Start()
+	defer pool.Close()
+	waitEndpoints(t, pool, 3)
+
+	seen := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		seen[cluster.pick(t, pool, "")]++
+	}
+	for addr, n := range seen {
+		if n != 10 {
+			t.Fatalf("%v picked %d times", addr, n)
+		}
+	}
+}
+
+func TestTCPClientPool_ConsistentHash(t *testing.T) {
+	cluster := newPoolTestCluster(3)
+	defer cluster.close()
+	pool := &TCPClientPool{
+		Addrs:        []string{"battle0", "battle1", "battle2"},
+		NewClient:    cluster.newClient,
+		Balance:      BalanceConsistentHash,
+		DrainTimeout: time.Millisecond,
+	}
+	pool.Start()
+	defer pool.Close()
+	waitEndpoints(t, pool, 3)
+
+	before := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("player", i)
+		before[key] = cluster.pick(t, pool, key)
+		if again := cluster.pick(t, pool, key); again != before[key] {
+			t.Fatalf("%v moved from %v to %v", key, before[key], again)
+		}
+	}
+
+	// only the keys of the removed endpoint move
+	pool.SetEndpoints([]string{"battle0", "battle1"})
+	for key, addr := range before {
+		got := cluster.pick(t, pool, key)
+		if addr != "battle2" && got != addr || got == "battle2" {
+			t.Fatalf("%v moved from %v to %v", key, addr, got)
+		}
+	}
+}
+
+func TestTCPClientPool_Eject(t *testing.T) {
+	cluster := newPoolTestCluster(2)
+	defer cluster.close()
+	cluster.down["battle1"].Store(true)
+	pool := &TCPClientPool{
+		Addrs:         []string{"battle0", "battle1"},
+		NewClient:     cluster.newClient,
+		ProbeInterval: 20 * time.Millisecond,
+	}
+	pool.Start()
+	defer pool.Close()
+	waitEndpoints(t, pool, 1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(pool.Endpoints()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("endpoints %v", pool.Endpoints())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if addr := cluster.pick(t, pool, ""); addr != "battle0" {
+		t.Fatalf("picked %v", addr)
+	}
+
+	// probed back in
+	cluster.down["battle1"].Store(false)
+	waitEndpoints(t, pool, 2)
+	if n := len(pool.Endpoints()); n != 2 {
+		t.Fatalf("%d endpoints", n)
+	}
+}
+
+type poolStalledAgent struct {
+	release chan struct{}
+}
+
+func (a *poolStalledAgent) Run()     { <-a.release }
+func (a *poolStalledAgent) OnClose() {}
+
+func TestTCPClientPool_LeastPending(t *testing.T) {
+	cluster := newPoolTestCluster(2)
+	defer cluster.close()
+	// battle0 never reads, the messages written to it stay queued
+	release := make(chan struct{})
+	ln := NewPipeListener()
+	server := &TCPServer{Listener: ln, NewAgent: func(conn *TCPConn) Agent { return &poolStalledAgent{release: release} }}
+	server.Start()
+	cluster.servers = append(cluster.servers, server)
+	cluster.listeners["battle0"] = ln
+	defer close(release)
+
+	pool := &TCPClientPool{
+		Addrs:     []string{"battle0", "battle1"},
+		NewClient: cluster.newClient,
+		Balance:   BalanceLeastPending,
+	}
+	pool.Start()
+	defer pool.Close()
+	waitEndpoints(t, pool, 2)
+
+	var stalled *TCPConn
+	cluster.mu.Lock()
+	for conn, addr := range cluster.addrs {
+		if addr == "battle0" {
+			stalled = conn
+		}
+	}
+	cluster.mu.Unlock()
+	for i := 0; i < 5; i++ {
+		stalled.WriteMsg([]byte("hello"))
+	}
+	deadline := time.Now().Add(time.Second)
+	for stalled.Stats().QueueLen == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("queue not filled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 10; i++ {
+		if addr := cluster.pick(t, pool, ""); addr != "battle1" {
+			t.Fatalf("picked %v", addr)
+		}
+	}
+}
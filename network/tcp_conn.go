@@ -1,55 +1,196 @@
 package network
 
 import (
+	"bufio"
+	"io"
 	"net"
 	"sync"
 
 	"github.com/gzjjyz/logger"
+	"github.com/gzjjyz/trace"
+	"github.com/petermattis/goid"
 )
 
 type ConnSet map[net.Conn]struct{}
 
 type TCPConn struct {
 	sync.Mutex
-	conn      net.Conn
-	writeChan chan []byte
-	closeFlag bool
-	msgParser *MsgParser
+	conn       net.Conn
+	writeQueue *writeQueue
+	closeFlag  bool
+	codec      FrameCodec
+	cfg        *connConfig
+	idle       *idleWatcher
+	limiter    *msgLimiter
+	stats      *connStats
+	reader     io.Reader
+	rec        *recorder
+	done       chan struct{}
+	// packMu keeps the frames of the codecs sealing in order queued in the order they are packed
+	packMu  sync.Mutex
+	ordered bool
 }
 
-func newTCPConn(conn net.Conn, pendingWriteNum int, msgParser *MsgParser) *TCPConn {
+type tcpConnReader struct {
+	tcpConn *TCPConn
+}
+
+func (r tcpConnReader) Read(b []byte) (int, error) {
+	return r.tcpConn.readConn(b)
+}
+
+func newTCPConn(conn net.Conn, cfg *connConfig, codec FrameCodec) *TCPConn {
 	tcpConn := new(TCPConn)
 	tcpConn.conn = conn
-	tcpConn.writeChan = make(chan []byte, pendingWriteNum)
-	tcpConn.msgParser = msgParser
+	tcpConn.writeQueue = newWriteQueue(cfg)
+	tcpConn.codec = codec
+	tcpConn.ordered = sealsInOrder(codec)
+	tcpConn.cfg = cfg
+	tcpConn.idle = newIdleWatcher(cfg)
+	tcpConn.limiter = newMsgLimiter(cfg)
+	tcpConn.stats = newConnStats(cfg.metrics)
+	tcpConn.reader = tcpConnReader{tcpConn}
+	if cfg.readBufferSize > 0 {
+		tcpConn.reader = bufio.NewReaderSize(tcpConn.reader, cfg.readBufferSize)
+	}
+	tcpConn.rec = newRecorder(cfg, tcpConn)
+	tcpConn.done = make(chan struct{})
+
+	go tcpConn.writeLoop()
+	go tcpConn.idle.run(tcpConn, tcpConn.ping)
+
+	return tcpConn
+}
+
+// writeLoop drains the queued messages and writes them in batches of up to writeBatch,
+// by writev on tcp and through a coalescing buffer on the others
+func (tcpConn *TCPConn) writeLoop() {
+	conn := tcpConn.conn
+	writev := false
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		writev = true
+	}
 
-	go func() {
-		for b := range tcpConn.writeChan {
-			if b == nil {
-				break
+	batch := make([]queuedMsg, 0, tcpConn.cfg.writeBatch)
+	bufs := make([][]byte, 0, tcpConn.cfg.writeBatch)
+	for m := range tcpConn.writeQueue.ch {
+		batch = append(batch[:0], m)
+		closing := m.b == nil
+	drain:
+		for !closing && len(batch) < tcpConn.cfg.writeBatch {
+			select {
+			case m, ok := <-tcpConn.writeQueue.ch:
+				if !ok {
+					closing = true
+					break drain
+				}
+				batch = append(batch, m)
+				closing = m.b == nil
+			default:
+				break drain
 			}
+		}
+
+		// only the coalesce policy keeps messages pending, the others may block pushing with the conn locked
+		if tcpConn.cfg.overflowPolicy == OverflowCoalesce {
+			tcpConn.Lock()
+			batch = append(batch, tcpConn.writeQueue.takePending(closing)...)
+			tcpConn.Unlock()
+		}
 
-			_, err := conn.Write(b)
+		bufs = bufs[:0]
+		for _, m := range batch {
+			if m.b != nil {
+				bufs = append(bufs, m.b)
+			}
+		}
+		if len(bufs) > 0 {
+			var (
+				n   int64
+				err error
+			)
+			if writev || len(bufs) == 1 {
+				nb := net.Buffers(bufs)
+				n, err = nb.WriteTo(conn)
+			} else {
+				n, err = writeCoalesced(conn, bufs)
+			}
+			tcpConn.stats.wrote(int(n))
 			if err != nil {
-				break
+				// the batch is put back before breaking
+				tcpConn.stats.setCloseReason(CloseError)
+				closing = true
+			} else {
+				tcpConn.idle.touchWrite()
 			}
 		}
 
-		conn.Close()
-		tcpConn.Lock()
-		tcpConn.closeFlag = true
-		tcpConn.Unlock()
-	}()
+		for i, m := range batch {
+			if m.pooled {
+				PutBuffer(m.b)
+			}
+			batch[i] = queuedMsg{}
+		}
+		for i := range bufs {
+			bufs[i] = nil
+		}
+		if closing {
+			break
+		}
+	}
 
-	return tcpConn
+	conn.Close()
+	tcpConn.Lock()
+	tcpConn.closeFlag = true
+	tcpConn.Unlock()
+	tcpConn.idle.stop()
+	tcpConn.rec.close()
+	close(tcpConn.done)
+}
+
+const writeCoalesceMax = 64 * 1024
+
+// writeCoalesced copies the small buffers together up to writeCoalesceMax to write them at once
+func writeCoalesced(conn net.Conn, bufs [][]byte) (int64, error) {
+	var written int64
+	scratch := GetBuffer(writeCoalesceMax)[:0]
+	defer PutBuffer(scratch)
+
+	flush := func(b []byte) error {
+		n, err := conn.Write(b)
+		written += int64(n)
+		return err
+	}
+	for _, b := range bufs {
+		if len(scratch)+len(b) > cap(scratch) && len(scratch) > 0 {
+			if err := flush(scratch); err != nil {
+				return written, err
+			}
+			scratch = scratch[:0]
+		}
+		if len(b) >= cap(scratch) {
+			if err := flush(b); err != nil {
+				return written, err
+			}
+			continue
+		}
+		scratch = append(scratch, b...)
+	}
+	if len(scratch) > 0 {
+		if err := flush(scratch); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
 }
 
 func (tcpConn *TCPConn) doDestroy() {
-	tcpConn.conn.(*net.TCPConn).SetLinger(0)
+	setLinger0(tcpConn.conn)
 	tcpConn.conn.Close()
 
 	if !tcpConn.closeFlag {
-		close(tcpConn.writeChan)
+		close(tcpConn.writeQueue.ch)
 		tcpConn.closeFlag = true
 	}
 }
@@ -57,6 +198,7 @@ func (tcpConn *TCPConn) doDestroy() {
 func (tcpConn *TCPConn) Destroy() {
 	tcpConn.Lock()
 	defer tcpConn.Unlock()
+	tcpConn.stats.setCloseReason(CloseDestroy)
 
 	tcpConn.doDestroy()
 }
@@ -68,33 +210,109 @@ func (tcpConn *TCPConn) Close() {
 		return
 	}
 
-	tcpConn.doWrite(nil)
+	tcpConn.stats.setCloseReason(CloseLocal)
+	tcpConn.doWrite(queuedMsg{})
 	tcpConn.closeFlag = true
 }
 
-func (tcpConn *TCPConn) doWrite(b []byte) {
-	if len(tcpConn.writeChan) == cap(tcpConn.writeChan) {
+// doWrite reports whether the write queue overflowed
+func (tcpConn *TCPConn) doWrite(m queuedMsg) bool {
+	overflow, destroy := tcpConn.writeQueue.push(m)
+	tcpConn.stats.queued(tcpConn.writeQueue.len())
+	if destroy {
 		logger.LogDebug("close conn: channel full")
+		tcpConn.stats.setCloseReason(CloseChannelFull)
 		tcpConn.doDestroy()
-		return
 	}
-
-	tcpConn.writeChan <- b
+	return overflow
 }
 
 // b must not be modified by the others goroutines
 func (tcpConn *TCPConn) Write(b []byte) {
+	if tcpConn.write(queuedMsg{b: b}) {
+		tcpConn.cfg.overflow(tcpConn)
+	}
+}
+
+// WritePooled writes b and puts it back by PutBuffer once written or dropped,
+// b must be used by nobody else after, in particular it must not be broadcast
+func (tcpConn *TCPConn) WritePooled(b []byte) {
+	if tcpConn.write(queuedMsg{b: b, pooled: true}) {
+		tcpConn.cfg.overflow(tcpConn)
+	}
+}
+
+func (tcpConn *TCPConn) write(m queuedMsg) bool {
 	tcpConn.Lock()
 	defer tcpConn.Unlock()
-	if tcpConn.closeFlag || b == nil {
-		return
+	if tcpConn.closeFlag || m.b == nil {
+		return false
 	}
 
-	tcpConn.doWrite(b)
+	tcpConn.stats.wroteMsg()
+	return tcpConn.doWrite(m)
 }
 
+// goroutine not safe, the reads are buffered by readBufferSize
 func (tcpConn *TCPConn) Read(b []byte) (int, error) {
-	return tcpConn.conn.Read(b)
+	return tcpConn.reader.Read(b)
+}
+
+func (tcpConn *TCPConn) readConn(b []byte) (int, error) {
+	n, err := tcpConn.conn.Read(b)
+	if n > 0 {
+		tcpConn.idle.touchRead()
+		tcpConn.stats.read(n)
+	}
+	if err != nil {
+		tcpConn.stats.setCloseReason(readCloseReason(err))
+	}
+	return n, err
+}
+
+func (tcpConn *TCPConn) ping() {
+	heartbeatCodec, ok := tcpConn.codec.(HeartbeatCodec)
+	if !ok {
+		return
+	}
+	b, err := heartbeatCodec.PackHeartbeat()
+	if err != nil {
+		logger.LogError("pack heartbeat error: %v", err)
+		return
+	}
+	tcpConn.Write(b)
+}
+
+// readFrame consumes the heartbeats, answers them on the server side, and applies the rate limits
+func (tcpConn *TCPConn) readFrame() (*FrameHeader, []byte, error) {
+	return tcpConn.readFrameWith(tcpConn.codec.ReadFrame)
+}
+
+func (tcpConn *TCPConn) readFrameWith(read func(r io.Reader) (*FrameHeader, []byte, error)) (*FrameHeader, []byte, error) {
+	for {
+		h, b, err := read(tcpConn)
+		if err != nil {
+			return nil, nil, err
+		}
+		if h != nil && h.Flags&FlagHeartbeat != 0 {
+			if _, err := tcpConn.limiter.check(tcpConn, 0); err != nil {
+				return nil, nil, err
+			}
+			if tcpConn.cfg.isServer && tcpConn.cfg.heartbeatInterval > 0 {
+				tcpConn.ping()
+			}
+			continue
+		}
+		deliver, err := tcpConn.limiter.check(tcpConn, len(b))
+		if err != nil {
+			return nil, nil, err
+		}
+		if deliver {
+			tcpConn.stats.readMsg()
+			tcpConn.rec.in(h, b)
+			return h, b, nil
+		}
+	}
 }
 
 func (tcpConn *TCPConn) LocalAddr() net.Addr {
@@ -108,18 +326,148 @@ func (tcpConn *TCPConn) RemoteAddr() net.Addr {
 func (tcpConn *TCPConn) RemoteAddrWithoutPort() string {
 	return tcpConn.RemoteAddr().String()
 }
+
+// RemoteIP returns the host of RemoteAddr, the client ip if a PROXY header told it
+func (tcpConn *TCPConn) RemoteIP() string {
+	return addrHost(tcpConn.RemoteAddr().String())
+}
 func (tcpConn *TCPConn) ReadMsg() ([]byte, error) {
-	return tcpConn.msgParser.Read(tcpConn)
+	_, b, err := tcpConn.readFrame()
+	return b, err
 }
 
 func (tcpConn *TCPConn) WriteMsg(args ...[]byte) error {
-	return tcpConn.msgParser.Write(tcpConn, args...)
+	return tcpConn.WriteFrame(nil, args...)
+}
+
+// goroutine not safe
+func (tcpConn *TCPConn) ReadFrame() (*FrameHeader, []byte, error) {
+	return tcpConn.readFrame()
+}
+
+func (tcpConn *TCPConn) WriteFrame(h *FrameHeader, args ...[]byte) error {
+	if tcpConn.ordered {
+		tcpConn.packMu.Lock()
+		defer tcpConn.packMu.Unlock()
+	}
+	buf, err := tcpConn.codec.PackFrame(h, args...)
+	if err != nil {
+		return err
+	}
+	tcpConn.rec.out(tcpConn.recordHeader(h), args...)
+	tcpConn.WritePooled(buf)
+	return nil
+}
+
+// recordHeader returns the header h goes on the wire with to record, nil if the codec keeps none
+func (tcpConn *TCPConn) recordHeader(h *FrameHeader) *FrameHeader {
+	if tcpConn.rec == nil || !carriesHeader(tcpConn.codec) {
+		return nil
+	}
+	var wh FrameHeader
+	if h != nil {
+		wh = *h
+	}
+	// the versioned codec carries the trace id of the goroutine as well
+	if wh.TraceId == "" && findCodec(tcpConn.codec, func(codec FrameCodec) bool {
+		_, ok := codec.(*VersionedCodec)
+		return ok
+	}) != nil {
+		wh.TraceId, _ = trace.Ctx.GetCurGTrace(goid.Get())
+	}
+	return &wh
+}
+
+// recordTraceHeader returns the header of a trace frame to record, the codecs without header tell the trace id only
+func (tcpConn *TCPConn) recordTraceHeader() *FrameHeader {
+	if tcpConn.rec == nil || carriesHeader(tcpConn.codec) {
+		return tcpConn.recordHeader(nil)
+	}
+	traceId, _ := trace.Ctx.GetCurGTrace(goid.Get())
+	return &FrameHeader{Flags: FlagTrace, TraceId: traceId}
+}
+
+// goroutine not safe, meta is nil if the codec carries no metadata
+func (tcpConn *TCPConn) ReadMsgWithMeta() ([]byte, FrameMeta, error) {
+	h, b, err := tcpConn.readFrame()
+	if err != nil || h == nil {
+		return b, nil, err
+	}
+	return b, h.Meta, nil
+}
+
+// meta is dropped silently if the codec carries no metadata, use VersionedCodec to keep it
+func (tcpConn *TCPConn) WriteMsgWithMeta(meta FrameMeta, args ...[]byte) error {
+	return tcpConn.WriteFrame(&FrameHeader{Meta: meta}, args...)
+}
+
+func (tcpConn *TCPConn) Stats() ConnStats {
+	tcpConn.Lock()
+	queueLen := tcpConn.writeQueue.len()
+	tcpConn.Unlock()
+	return tcpConn.stats.snapshot(queueLen)
+}
+
+func (tcpConn *TCPConn) setCloseReason(reason CloseReason) {
+	tcpConn.stats.setCloseReason(reason)
+}
+
+func (tcpConn *TCPConn) CompressionStats() (CompressionStats, bool) {
+	return compressionStats(tcpConn.codec)
+}
+
+func (tcpConn *TCPConn) packKey() interface{} {
+	if tcpConn.ordered {
+		return nil
+	}
+	return tcpConn.codec
+}
+
+func (tcpConn *TCPConn) packMsg(args ...[]byte) ([]byte, error) {
+	return tcpConn.codec.PackFrame(nil, args...)
+}
+
+func (tcpConn *TCPConn) writePacked(b []byte, args [][]byte) {
+	tcpConn.rec.out(tcpConn.recordHeader(nil), args...)
+	tcpConn.Write(b)
 }
 
 func (tcpConn *TCPConn) ReadMsgWithTrace() ([]byte, error) {
-	return tcpConn.msgParser.ReadWithTrace(tcpConn)
+	traceCodec, ok := tcpConn.codec.(TraceCodec)
+	if !ok {
+		return nil, ErrTraceUnsupported
+	}
+	if tr, ok := traceCodec.(traceFrameReader); ok {
+		_, b, err := tcpConn.readFrameWith(tr.readTraceFrame)
+		return b, err
+	}
+	for {
+		b, err := traceCodec.ReadWithTrace(tcpConn)
+		if err != nil {
+			return nil, err
+		}
+		deliver, err := tcpConn.limiter.check(tcpConn, len(b))
+		if err != nil {
+			return nil, err
+		}
+		if deliver {
+			tcpConn.stats.readMsg()
+			tcpConn.rec.in(nil, b)
+			return b, nil
+		}
+	}
 }
 
 func (tcpConn *TCPConn) WriteMsgWithTrace(args ...[]byte) error {
-	return tcpConn.msgParser.WriteWithTrace(tcpConn, args...)
+	traceCodec, ok := tcpConn.codec.(TraceCodec)
+	if !ok {
+		return ErrTraceUnsupported
+	}
+	buf, err := traceCodec.PackMsgWithTrace(args...)
+	if err != nil {
+		return err
+	}
+	tcpConn.rec.out(tcpConn.recordTraceHeader(), args...)
+	tcpConn.WritePooled(buf)
+	return nil
 }
@@ -0,0 +1,162 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBufferPool(t *testing.T) {
+	for _, n := range []int{0, 1, 64, 65, 1000, 64 * 1024} {
+		b := GetBuffer(n)
+		if len(b) != n || cap(b)&(cap(b)-1) != 0 {
+			t.Fatalf("GetBuffer(%d) len %d cap %d", n, len(b), cap(b))
+		}
+		PutBuffer(b)
+	}
+	if b := GetBuffer(64*1024 + 1); len(b) != 64*1024+1 {
+		t.Fatalf("large buffer len %d", len(b))
+	}
+}
+
+// connPair returns the two ends of a loopback tcp conn, or of a pipe if tcp is false
+func connPair(tb testing.TB, tcp bool) (net.Conn, net.Conn) {
+	if !tcp {
+		ln := NewPipeListener()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, _ := ln.Accept()
+			accepted <- conn
+		}()
+		c, err := ln.Dial()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return c, <-accepted
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s, err := ln.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return c, s
+}
+
+func TestTCPConn_WriteBatch(t *testing.T) {
+	for name, tcp := range map[string]bool{"writev": true, "coalesced": false} {
+		c, s := connPair(t, tcp)
+		conn := newTCPConn(c, (&connConfig{pendingWriteNum: 2000}).init(), NewMsgParser())
+		for i := 0; i < 1000; i++ {
+			if err := conn.WriteMsg([]byte(fmt.Sprint(i)), bytes.Repeat([]byte{'x'}, i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		conn.Close()
+
+		parser := NewMsgParser()
+		parser.SetMsgLen(2, 1, 4096)
+		for i := 0; i < 1000; i++ {
+			msg, err := parser.Read(s)
+			if err != nil {
+				t.Fatalf("%v: message %d: %v", name, i, err)
+			}
+			if want := fmt.Sprint(i) + string(bytes.Repeat([]byte{'x'}, i)); string(msg) != want {
+				t.Fatalf("%v: message %d is %q", name, i, msg)
+			}
+		}
+		if _, err := parser.Read(s); err != io.EOF {
+			t.Fatalf("%v: read after close %v", name, err)
+		}
+		s.Close()
+	}
+}
+
+// the before variants write a message per syscall and read unbuffered
+func BenchmarkTCPConn_Write(b *testing.B) {
+	b.Run("before", func(b *testing.B) {
+		benchmarkTCPConnWrite(b, 1, false)
+	})
+	b.Run("batched", func(b *testing.B) {
+		benchmarkTCPConnWrite(b, 0, true)
+	})
+}
+
+func benchmarkTCPConnWrite(b *testing.B, writeBatch int, pooled bool) {
+	c, s := connPair(b, true)
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, s)
+		close(done)
+	}()
+
+	cfg := (&connConfig{
+		pendingWriteNum: 1024,
+		overflowPolicy:  OverflowBlock,
+		overflowTimeout: time.Minute,
+		writeBatch:      writeBatch,
+	}).init()
+	conn := newTCPConn(c, cfg, NewMsgParser())
+	msg := make([]byte, 64)
+
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if pooled {
+			conn.WriteMsg(msg)
+		} else {
+			buf := make([]byte, 2+len(msg))
+			copy(buf[2:], msg)
+			conn.Write(buf)
+		}
+	}
+	conn.Close()
+	<-done
+}
+
+func BenchmarkTCPConn_Read(b *testing.B) {
+	b.Run("before", func(b *testing.B) {
+		benchmarkTCPConnRead(b, -1)
+	})
+	b.Run("buffered", func(b *testing.B) {
+		benchmarkTCPConnRead(b, 0)
+	})
+}
+
+func benchmarkTCPConnRead(b *testing.B, readBufferSize int) {
+	c, s := connPair(b, true)
+	defer s.Close()
+	frame, _ := NewMsgParser().PackMsg(make([]byte, 64))
+	go func() {
+		frames := bytes.Repeat(frame, 1024)
+		for n := 0; n < b.N; n += 1024 {
+			if _, err := s.Write(frames); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn := newTCPConn(c, (&connConfig{pendingWriteNum: 1, readBufferSize: readBufferSize}).init(), NewMsgParser())
+	defer conn.Destroy()
+
+	b.SetBytes(64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.ReadMsg(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
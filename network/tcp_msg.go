@@ -2,7 +2,6 @@ package network
 
 import (
 	"encoding/binary"
-	"errors"
 	"github.com/gzjjyz/trace"
 	"github.com/petermattis/goid"
 	"io"
@@ -16,11 +15,15 @@ import (
 // -------------------------------------
 // | len | trace id len |trace id|data |
 // -------------------------------------
+// len is of the data, the trace id is at most 255 bytes and maxMsgLen
+
+// a zero len without anything behind is a heartbeat once SetHeartbeat enabled it, a too short message otherwise
 type MsgParser struct {
 	lenMsgLen    int
 	minMsgLen    uint32
 	maxMsgLen    uint32
 	littleEndian bool
+	heartbeat    bool
 }
 
 func NewMsgParser() *MsgParser {
@@ -67,14 +70,18 @@ func (p *MsgParser) SetByteOrder(littleEndian bool) {
 	p.littleEndian = littleEndian
 }
 
-// goroutine safe
-func (p *MsgParser) Read(conn *TCPConn) ([]byte, error) {
+// It's dangerous to call the method on reading or writing
+func (p *MsgParser) SetHeartbeat(enabled bool) {
+	p.heartbeat = enabled
+}
+
+func (p *MsgParser) readLen(r io.Reader) (uint32, error) {
 	var b [4]byte
 	bufMsgLen := b[:p.lenMsgLen]
 
 	// read len
-	if _, err := io.ReadFull(conn, bufMsgLen); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(r, bufMsgLen); err != nil {
+		return 0, err
 	}
 
 	// parse len
@@ -96,16 +103,60 @@ func (p *MsgParser) Read(conn *TCPConn) ([]byte, error) {
 		}
 	}
 
-	// check len
+	return msgLen, nil
+}
+
+func (p *MsgParser) putLen(msg []byte, msgLen uint32) {
+	switch p.lenMsgLen {
+	case 1:
+		msg[0] = byte(msgLen)
+	case 2:
+		if p.littleEndian {
+			binary.LittleEndian.PutUint16(msg, uint16(msgLen))
+		} else {
+			binary.BigEndian.PutUint16(msg, uint16(msgLen))
+		}
+	case 4:
+		if p.littleEndian {
+			binary.LittleEndian.PutUint32(msg, msgLen)
+		} else {
+			binary.BigEndian.PutUint32(msg, msgLen)
+		}
+	}
+}
+
+func (p *MsgParser) checkLen(msgLen uint32) error {
 	if msgLen > p.maxMsgLen {
-		return nil, errors.New("message too long")
+		return ErrMsgTooLong
 	} else if msgLen < p.minMsgLen {
-		return nil, errors.New("message too short")
+		return ErrMsgTooShort
+	}
+	return nil
+}
+
+func argsLen(args [][]byte) uint32 {
+	var msgLen uint32
+	for i := 0; i < len(args); i++ {
+		msgLen += uint32(len(args[i]))
+	}
+	return msgLen
+}
+
+// goroutine safe
+func (p *MsgParser) Read(r io.Reader) ([]byte, error) {
+	msgLen, err := p.readLen(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// check len
+	if err := p.checkLen(msgLen); err != nil {
+		return nil, err
 	}
 
 	// data
 	msgData := make([]byte, msgLen)
-	if _, err := io.ReadFull(conn, msgData); err != nil {
+	if _, err := io.ReadFull(r, msgData); err != nil {
 		return nil, err
 	}
 
@@ -114,37 +165,17 @@ func (p *MsgParser) Read(conn *TCPConn) ([]byte, error) {
 
 func (p *MsgParser) PackMsg(args ...[]byte) ([]byte, error) {
 	// get len
-	var msgLen uint32
-	for i := 0; i < len(args); i++ {
-		msgLen += uint32(len(args[i]))
-	}
+	msgLen := argsLen(args)
 
 	// check len
-	if msgLen > p.maxMsgLen {
-		return nil, errors.New("message too long")
-	} else if msgLen < p.minMsgLen {
-		return nil, errors.New("message too short")
+	if err := p.checkLen(msgLen); err != nil {
+		return nil, err
 	}
 
-	msg := make([]byte, uint32(p.lenMsgLen)+msgLen)
+	msg := GetBuffer(p.lenMsgLen + int(msgLen))
 
 	// write len
-	switch p.lenMsgLen {
-	case 1:
-		msg[0] = byte(msgLen)
-	case 2:
-		if p.littleEndian {
-			binary.LittleEndian.PutUint16(msg, uint16(msgLen))
-		} else {
-			binary.BigEndian.PutUint16(msg, uint16(msgLen))
-		}
-	case 4:
-		if p.littleEndian {
-			binary.LittleEndian.PutUint32(msg, msgLen)
-		} else {
-			binary.BigEndian.PutUint32(msg, msgLen)
-		}
-	}
+	p.putLen(msg, msgLen)
 
 	// write data
 	l := p.lenMsgLen
@@ -162,80 +193,99 @@ func (p *MsgParser) Write(conn *TCPConn, args ...[]byte) error {
 	if err != nil {
 		return err
 	}
-	conn.Write(buf)
+	conn.WritePooled(buf)
 	return nil
 }
 
 // goroutine safe
-func (p *MsgParser) ReadWithTrace(conn *TCPConn) ([]byte, error) {
-	var b [4]byte
-	bufMsgLen := b[:p.lenMsgLen]
-	// read len
-	if _, err := io.ReadFull(conn, bufMsgLen); err != nil {
-		return nil, err
+func (p *MsgParser) ReadFrame(r io.Reader) (*FrameHeader, []byte, error) {
+	msgLen, err := p.readLen(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if msgLen == 0 && p.heartbeat {
+		return &FrameHeader{Flags: FlagHeartbeat}, nil, nil
+	}
+
+	// check len
+	if err := p.checkLen(msgLen); err != nil {
+		return nil, nil, err
+	}
+
+	// data
+	msgData := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, msgData); err != nil {
+		return nil, nil, err
+	}
+
+	return nil, msgData, nil
+}
+
+// goroutine safe, the header is ignored since the frame has no room for it
+func (p *MsgParser) PackFrame(_ *FrameHeader, args ...[]byte) ([]byte, error) {
+	return p.PackMsg(args...)
+}
+
+func (p *MsgParser) PackHeartbeat() ([]byte, error) {
+	return make([]byte, p.lenMsgLen), nil
+}
+
+// goroutine safe, heartbeats are skipped
+func (p *MsgParser) ReadWithTrace(r io.Reader) ([]byte, error) {
+	return readSkipHeartbeats(r, p.readTraceFrame)
+}
+
+// goroutine safe
+func (p *MsgParser) readTraceFrame(r io.Reader) (*FrameHeader, []byte, error) {
+	msgLen, err := p.readLen(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if msgLen == 0 && p.heartbeat {
+		return &FrameHeader{Flags: FlagHeartbeat}, nil, nil
+	}
+
+	// check len before reading on
+	if err := p.checkLen(msgLen); err != nil {
+		return nil, nil, err
 	}
 
 	var traceIdLenBytes [1]byte
-	if _, err := io.ReadFull(conn, traceIdLenBytes[:]); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(r, traceIdLenBytes[:]); err != nil {
+		return nil, nil, err
 	}
 
 	traceIdLen := traceIdLenBytes[0]
+	if uint32(traceIdLen) > p.maxMsgLen {
+		return nil, nil, ErrBadTraceHeader
+	}
+	// the header tells the frame is read as a trace frame, with or without a trace id
+	h := &FrameHeader{Flags: FlagTrace}
 	if traceIdLen > 0 {
 		traceIdBytes := make([]byte, traceIdLen)
-		if _, err := io.ReadFull(conn, traceIdBytes); err != nil {
-			return nil, err
+		if _, err := io.ReadFull(r, traceIdBytes); err != nil {
+			return nil, nil, err
 		}
-		trace.Ctx.SetCurGTrace(goid.Get(), string(traceIdBytes))
-	}
-
-	// parse len
-	var msgLen uint32
-	switch p.lenMsgLen {
-	case 1:
-		msgLen = uint32(bufMsgLen[0])
-	case 2:
-		if p.littleEndian {
-			msgLen = uint32(binary.LittleEndian.Uint16(bufMsgLen))
-		} else {
-			msgLen = uint32(binary.BigEndian.Uint16(bufMsgLen))
-		}
-	case 4:
-		if p.littleEndian {
-			msgLen = binary.LittleEndian.Uint32(bufMsgLen)
-		} else {
-			msgLen = binary.BigEndian.Uint32(bufMsgLen)
-		}
-	}
-
-	// check len
-	if msgLen > p.maxMsgLen {
-		return nil, errors.New("message too long")
-	} else if msgLen < p.minMsgLen {
-		return nil, errors.New("message too short")
+		h.TraceId = string(traceIdBytes)
+		trace.Ctx.SetCurGTrace(goid.Get(), h.TraceId)
 	}
 
 	// data
 	msgData := make([]byte, msgLen)
-	if _, err := io.ReadFull(conn, msgData); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(r, msgData); err != nil {
+		return nil, nil, err
 	}
 
-	return msgData, nil
+	return h, msgData, nil
 }
 
 func (p *MsgParser) PackMsgWithTrace(args ...[]byte) ([]byte, error) {
 	// get len
-	var msgLen uint32
-	for i := 0; i < len(args); i++ {
-		msgLen += uint32(len(args[i]))
-	}
+	msgLen := argsLen(args)
 
 	// check len
-	if msgLen > p.maxMsgLen {
-		return nil, errors.New("message too long")
-	} else if msgLen < p.minMsgLen {
-		return nil, errors.New("message too short")
+	if err := p.checkLen(msgLen); err != nil {
+		return nil, err
 	}
 
 	var traceIdLen int
@@ -243,27 +293,15 @@ func (p *MsgParser) PackMsgWithTrace(args ...[]byte) ([]byte, error) {
 	if ok {
 		traceIdLen = len(traceId)
 	}
+	if traceIdLen > math.MaxUint8 || uint32(traceIdLen) > p.maxMsgLen {
+		return nil, ErrBadTraceHeader
+	}
 
 	headerLen := p.lenMsgLen + 1 + traceIdLen
-	msg := make([]byte, uint32(headerLen)+msgLen)
+	msg := GetBuffer(headerLen + int(msgLen))
 
 	// write len
-	switch p.lenMsgLen {
-	case 1:
-		msg[0] = byte(msgLen)
-	case 2:
-		if p.littleEndian {
-			binary.LittleEndian.PutUint16(msg, uint16(msgLen))
-		} else {
-			binary.BigEndian.PutUint16(msg, uint16(msgLen))
-		}
-	case 4:
-		if p.littleEndian {
-			binary.LittleEndian.PutUint32(msg, msgLen)
-		} else {
-			binary.BigEndian.PutUint32(msg, msgLen)
-		}
-	}
+	p.putLen(msg, msgLen)
 
 	msg[p.lenMsgLen] = byte(traceIdLen)
 
@@ -287,6 +325,6 @@ func (p *MsgParser) WriteWithTrace(conn *TCPConn, args ...[]byte) error {
 	if err != nil {
 		return err
 	}
-	conn.Write(buf)
+	conn.WritePooled(buf)
 	return nil
 }
@@ -1,6 +1,17 @@
 package network
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/gzjjyz/trace"
+	"github.com/petermattis/goid"
+)
 
 func TestMsgParser_PackMsgWithMsg(t *testing.T) {
 	_, err := NewMsgParser().PackMsgWithTrace([]byte("123"))
@@ -9,3 +20,270 @@ func TestMsgParser_PackMsgWithMsg(t *testing.T) {
 		return
 	}
 }
+
+// msgParserCases are the parsers of every length size and byte order, maxMsgLen is the largest the size allows up to 64KB+
+func msgParserCases() map[string]*MsgParser {
+	cases := make(map[string]*MsgParser)
+	for _, lenMsgLen := range []int{1, 2, 4} {
+		for _, littleEndian := range []bool{false, true} {
+			p := NewMsgParser()
+			p.SetMsgLen(lenMsgLen, 1, 70000)
+			p.SetByteOrder(littleEndian)
+			p.SetHeartbeat(true)
+			cases[fmt.Sprintf("len%d/little=%v", lenMsgLen, littleEndian)] = p
+		}
+	}
+	return cases
+}
+
+// splitArgs cuts b into up to 3 args at random
+func splitArgs(rnd *rand.Rand, b []byte) [][]byte {
+	var args [][]byte
+	for i := 0; i < 2 && len(b) > 0; i++ {
+		n := rnd.Intn(len(b) + 1)
+		args = append(args, b[:n])
+		b = b[n:]
+	}
+	return append(args, b)
+}
+
+func TestMsgParser_RoundTrip(t *testing.T) {
+	gid := goid.Get()
+	defer trace.Ctx.RemoveGTrace(gid)
+
+	for name, p := range msgParserCases() {
+		rnd := rand.New(rand.NewSource(1))
+		lens := []int{1, 2, int(p.maxMsgLen) - 1, int(p.maxMsgLen)}
+		for i := 0; i < 50; i++ {
+			lens = append(lens, 1+rnd.Intn(int(p.maxMsgLen)))
+		}
+
+		for _, withTrace := range []bool{false, true} {
+			var stream bytes.Buffer
+			var msgs [][]byte
+			for i, n := range lens {
+				msg := make([]byte, n)
+				rnd.Read(msg)
+				msgs = append(msgs, msg)
+
+				var (
+					b   []byte
+					err error
+				)
+				if withTrace {
+					trace.Ctx.SetCurGTrace(gid, fmt.Sprintf("trace-%d", i))
+					b, err = p.PackMsgWithTrace(splitArgs(rnd, msg)...)
+				} else {
+					b, err = p.PackMsg(splitArgs(rnd, msg)...)
+				}
+				if err != nil {
+					t.Fatalf("%v: pack %d bytes: %v", name, n, err)
+				}
+				stream.Write(b)
+				if !withTrace && i%10 == 0 {
+					// heartbeats are skipped by ReadFrame
+					hb, _ := p.PackHeartbeat()
+					stream.Write(hb)
+				}
+			}
+
+			for i, want := range msgs {
+				var (
+					got []byte
+					err error
+				)
+				if withTrace {
+					trace.Ctx.RemoveGTrace(gid)
+					got, err = p.ReadWithTrace(&stream)
+					if id, _ := trace.Ctx.GetCurGTrace(gid); err == nil && id != fmt.Sprintf("trace-%d", i) {
+						t.Fatalf("%v: trace id %q of msg %d", name, id, i)
+					}
+				} else {
+					for {
+						var h *FrameHeader
+						h, got, err = p.ReadFrame(&stream)
+						if err != nil || h == nil {
+							break
+						}
+					}
+				}
+				if err != nil {
+					t.Fatalf("%v trace=%v: read msg %d: %v", name, withTrace, i, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("%v trace=%v: msg %d differs", name, withTrace, i)
+				}
+			}
+			if stream.Len() != 0 {
+				t.Fatalf("%v: %d bytes left", name, stream.Len())
+			}
+		}
+	}
+}
+
+func TestMsgParser_Errors(t *testing.T) {
+	gid := goid.Get()
+	defer trace.Ctx.RemoveGTrace(gid)
+
+	p := NewMsgParser()
+	p.SetMsgLen(2, 2, 16)
+	long := make([]byte, 17)
+
+	if _, err := p.PackMsg(long); !errors.Is(err, ErrMsgTooLong) {
+		t.Fatalf("pack long: %v", err)
+	}
+	if _, err := p.PackMsg([]byte{1}); !errors.Is(err, ErrMsgTooShort) {
+		t.Fatalf("pack short: %v", err)
+	}
+	if _, err := p.PackMsgWithTrace(long); !errors.Is(err, ErrMsgTooLong) {
+		t.Fatalf("pack long with trace: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		frame   []byte
+		trace   bool
+		wantErr error
+	}{
+		{"too long", []byte{0, 17}, false, ErrMsgTooLong},
+		{"too short", []byte{0, 1, 1}, false, ErrMsgTooShort},
+		{"zero len without heartbeats", []byte{0, 0}, false, ErrMsgTooShort},
+		{"zero len with trace without heartbeats", []byte{0, 0, 0}, true, ErrMsgTooShort},
+		{"truncated len", []byte{0}, false, io.ErrUnexpectedEOF},
+		{"truncated data", []byte{0, 4, 1, 2}, false, io.ErrUnexpectedEOF},
+		{"too long with trace", []byte{0, 17, 0}, true, ErrMsgTooLong},
+		{"trace over max", append([]byte{0, 2, 17}, make([]byte, 19)...), true, ErrBadTraceHeader},
+		{"truncated trace", []byte{0, 2, 8, 'a'}, true, io.ErrUnexpectedEOF},
+		{"trace without len byte", []byte{0, 2}, true, io.EOF},
+	} {
+		var err error
+		if tc.trace {
+			_, err = p.ReadWithTrace(bytes.NewReader(tc.frame))
+		} else {
+			_, err = p.Read(bytes.NewReader(tc.frame))
+		}
+		if !errors.Is(err, tc.wantErr) {
+			t.Fatalf("%v: %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+
+	// the trace id does not fit its length byte or is over maxMsgLen
+	trace.Ctx.SetCurGTrace(gid, strings.Repeat("t", 17))
+	if _, err := p.PackMsgWithTrace([]byte("hi")); !errors.Is(err, ErrBadTraceHeader) {
+		t.Fatalf("pack trace over max: %v", err)
+	}
+	p.SetMsgLen(2, 1, 1024)
+	trace.Ctx.SetCurGTrace(gid, strings.Repeat("t", 256))
+	if _, err := p.PackMsgWithTrace([]byte("hi")); !errors.Is(err, ErrBadTraceHeader) {
+		t.Fatalf("pack trace over 255: %v", err)
+	}
+	trace.Ctx.SetCurGTrace(gid, strings.Repeat("t", 255))
+	b, err := p.PackMsgWithTrace([]byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := p.ReadWithTrace(bytes.NewReader(b)); err != nil || string(msg) != "hi" {
+		t.Fatalf("read %q: %v", msg, err)
+	}
+}
+
+// fuzzMsgParser returns the parser a fuzz input picks
+func fuzzMsgParser(lenMsgLen uint8, littleEndian bool, maxMsgLen uint16) *MsgParser {
+	p := NewMsgParser()
+	p.SetMsgLen([]int{1, 2, 4}[lenMsgLen%3], 1, uint32(maxMsgLen)+1)
+	p.SetByteOrder(littleEndian)
+	return p
+}
+
+// checkFuzzRead reads the stream to the end, the messages read must pack back to the bytes consumed
+func checkFuzzRead(t *testing.T, data []byte, withTrace bool, read func(r io.Reader) ([]byte, error), pack func(args ...[]byte) ([]byte, error)) {
+	r := bytes.NewReader(data)
+	for {
+		before := r.Len()
+		msg, err := read(r)
+		if err != nil {
+			for _, want := range []error{io.EOF, io.ErrUnexpectedEOF, ErrMsgTooLong, ErrMsgTooShort, ErrBadTraceHeader} {
+				if errors.Is(err, want) {
+					return
+				}
+			}
+			t.Fatalf("untyped error: %v", err)
+		}
+		if withTrace {
+			// the trace header is not repacked
+			continue
+		}
+		b, err := pack(msg)
+		if err != nil {
+			t.Fatalf("repack: %v", err)
+		}
+		consumed := data[len(data)-before : len(data)-r.Len()]
+		if !bytes.Equal(b, consumed) {
+			t.Fatalf("repacked %x, consumed %x", b, consumed)
+		}
+	}
+}
+
+func FuzzMsgParser_Read(f *testing.F) {
+	f.Add([]byte{0, 3, 'a', 'b', 'c'}, uint8(1), false, uint16(4096))
+	f.Add([]byte{3, 0, 'a', 'b', 'c', 0, 0}, uint8(1), true, uint16(2))
+	f.Add([]byte{0, 0, 0, 1, 'x'}, uint8(2), false, uint16(10))
+	f.Add([]byte{255, 1}, uint8(0), false, uint16(100))
+	f.Fuzz(func(t *testing.T, data []byte, lenMsgLen uint8, littleEndian bool, maxMsgLen uint16) {
+		p := fuzzMsgParser(lenMsgLen, littleEndian, maxMsgLen)
+		checkFuzzRead(t, data, false, p.Read, p.PackMsg)
+	})
+}
+
+func FuzzMsgParser_ReadWithTrace(f *testing.F) {
+	f.Add([]byte{0, 2, 3, 'a', 'b', 'c', 'h', 'i'}, uint8(1), false, uint16(4096))
+	f.Add([]byte{0, 2, 255, 'a'}, uint8(1), false, uint16(16))
+	f.Add([]byte{2, 0, 0, 'h', 'i', 0, 0}, uint8(1), true, uint16(16))
+	f.Fuzz(func(t *testing.T, data []byte, lenMsgLen uint8, littleEndian bool, maxMsgLen uint16) {
+		defer trace.Ctx.RemoveGTrace(goid.Get())
+		p := fuzzMsgParser(lenMsgLen, littleEndian, maxMsgLen)
+		checkFuzzRead(t, data, true, p.ReadWithTrace, p.PackMsgWithTrace)
+	})
+}
+
+func FuzzMsgParser_RoundTrip(f *testing.F) {
+	f.Add([]byte("hello"), "", uint8(1), false)
+	f.Add([]byte{0}, "trace", uint8(0), true)
+	f.Add(bytes.Repeat([]byte{7}, 300), "trace", uint8(2), false)
+	f.Fuzz(func(t *testing.T, msg []byte, traceId string, lenMsgLen uint8, littleEndian bool) {
+		gid := goid.Get()
+		defer trace.Ctx.RemoveGTrace(gid)
+		p := fuzzMsgParser(lenMsgLen, littleEndian, 1024)
+
+		b, err := p.PackMsg(msg)
+		if err != nil {
+			if !errors.Is(err, ErrMsgTooLong) && !errors.Is(err, ErrMsgTooShort) {
+				t.Fatalf("untyped error: %v", err)
+			}
+			return
+		}
+		got, err := p.Read(bytes.NewReader(b))
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("read %x: %v, want %x", got, err, msg)
+		}
+
+		if traceId != "" {
+			trace.Ctx.SetCurGTrace(gid, traceId)
+		}
+		b, err = p.PackMsgWithTrace(msg)
+		if err != nil {
+			if !errors.Is(err, ErrBadTraceHeader) {
+				t.Fatalf("pack with trace: %v", err)
+			}
+			return
+		}
+		trace.Ctx.RemoveGTrace(gid)
+		got, err = p.ReadWithTrace(bytes.NewReader(b))
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("read with trace %x: %v, want %x", got, err, msg)
+		}
+		if id, _ := trace.Ctx.GetCurGTrace(gid); traceId != "" && id != traceId {
+			t.Fatalf("trace id %q, want %q", id, traceId)
+		}
+	})
+}
@@ -1,6 +1,10 @@
 package network
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -13,31 +17,114 @@ type TCPServer struct {
 	MaxConnNum      int
 	PendingWriteNum int
 	NewAgent        func(*TCPConn) Agent
-	ln              net.Listener
+	Sessions        *SessionManager
+	Metrics         *Metrics     // nil creates one named by Addr
+	Listener        net.Listener // nil listens on Addr, a PipeListener serves in memory
+	lns             []net.Listener
+	rawLns          []net.Listener
 	conns           ConnSet
 	mutexConns      sync.Mutex
 	wgLn            sync.WaitGroup
 	wgConns         sync.WaitGroup
+	connCfg         *connConfig
+	agents          map[net.Conn]agentConn
+	ctx             context.Context
+	cancel          context.CancelFunc
 
 	// msg parser
 	LenMsgLen    int
 	MinMsgLen    uint32
 	MaxMsgLen    uint32
 	LittleEndian bool
-	msgParser    *MsgParser
+	// Codec takes precedence over the msg parser options above
+	Codec FrameCodec
+	codec FrameCodec
+
+	// handshake
+	Handshaker       Handshaker
+	HandshakeTimeout time.Duration
+
+	// write queue overflow
+	OverflowPolicy  OverflowPolicy
+	OverflowTimeout time.Duration
+	CoalesceBytes   int
+	OnOverflow      func(conn Conn, policy OverflowPolicy)
+
+	// idle
+	ReadIdleTimeout  time.Duration
+	WriteIdleTimeout time.Duration
+	IdleTimeout      time.Duration
+	// HeartbeatInterval also lets the default msg parser take a zero len as a heartbeat, set it on both sides
+	HeartbeatInterval time.Duration
+	// OnIdle returns whether to destroy the conn, nil destroys on read and total idle
+	OnIdle func(conn Conn, kind IdleKind) bool
+
+	// record, Record returns where the messages of a conn are recorded, nil or a nil writer records nothing, see RecordToDir
+	Record func(conn Conn) io.WriteCloser
+
+	// tls, enabled if CertFile or ConfigTLS is set, ClientCAFile requires and verifies the client certificate
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	ConfigTLS    func(config *tls.Config)
+
+	// limits, the unset ones are unlimited
+	// the ip filter, the accept rate and MaxConnPerIP admit the accepted conns,
+	// MsgRate and ByteRate limit the messages per second a conn reads, the bursts default to the rates
+	IPFilter        *IPFilter
+	MaxConnPerIP    int
+	AcceptRate      float64
+	AcceptBurst     int
+	MsgRate         float64
+	MsgBurst        int
+	ByteRate        float64
+	ByteBurst       int
+	RateLimitAction RateLimitAction
+	OnRateLimit     func(conn Conn, action RateLimitAction)
+	connLimiter     *connLimiter
+
+	// proxy protocol, the conns from TrustedProxies must start with a PROXY protocol v1 or v2 header,
+	// from all the peers if TrustedProxies is empty, RemoteAddr is then the client address the header tells
+	ProxyProtocol  bool
+	TrustedProxies []string
+
+	// listen, Network is tcp, tcp4, tcp6 or unix, for which Addr is the socket path,
+	// AcceptLoops accept in parallel, each on its own listener bound with SO_REUSEPORT if ReusePort is set,
+	// InheritFd serves the listener of an fd the process inherits instead, see ListenerFile
+	Network     string
+	ReusePort   bool
+	AcceptLoops int
+	InheritFd   int
 }
 
-func (server *TCPServer) Start() {
-	server.init()
-	go server.run()
+// Start returns the error of opening the listeners, the conns are served in other goroutines
+func (server *TCPServer) Start() error {
+	if err := server.init(); err != nil {
+		return err
+	}
+	server.wgLn.Add(len(server.lns))
+	for _, ln := range server.lns {
+		go server.run(ln)
+	}
+	return nil
 }
 
-func (server *TCPServer) init() {
-	ln, err := net.Listen("tcp", server.Addr)
+func (server *TCPServer) init() error {
+	lns, err := server.listen()
 	if err != nil {
-		logger.LogFatal("%v", err)
+		return err
 	}
+	if err := server.setup(lns); err != nil {
+		if server.Listener == nil {
+			closeListeners(lns)
+		}
+		return err
+	}
+	return nil
+}
 
+// setup prepares to serve the conns accepted from lns, an accept loop for each
+func (server *TCPServer) setup(lns []net.Listener) error {
 	if server.MaxConnNum <= 0 {
 		server.MaxConnNum = 100
 		logger.LogInfo("invalid MaxConnNum, reset to %v", server.MaxConnNum)
@@ -46,27 +133,94 @@ func (server *TCPServer) init() {
 		server.PendingWriteNum = 100
 		logger.LogInfo("invalid PendingWriteNum, reset to %v", server.PendingWriteNum)
 	}
+	if server.HandshakeTimeout <= 0 {
+		server.HandshakeTimeout = 10 * time.Second
+	}
 	if server.NewAgent == nil {
-		logger.LogFatal("NewAgent must not be nil")
+		return errors.New("NewAgent must not be nil")
+	}
+
+	var config *tls.Config
+	if server.CertFile != "" || server.ConfigTLS != nil {
+		var err error
+		config, err = newServerTLSConfig(server.CertFile, server.KeyFile, server.ClientCAFile, server.ConfigTLS)
+		if err != nil {
+			return err
+		}
+	}
+	var trusted []*net.IPNet
+	if server.ProxyProtocol {
+		var err error
+		trusted, err = parseCIDRs(server.TrustedProxies)
+		if err != nil {
+			return err
+		}
+	}
+
+	server.rawLns = lns
+	server.lns = make([]net.Listener, len(lns))
+	for i, ln := range lns {
+		if i > 0 && ln == lns[i-1] {
+			server.lns[i] = server.lns[i-1]
+			continue
+		}
+		if server.ProxyProtocol {
+			ln = newProxyListener(ln, trusted, server.HandshakeTimeout)
+		}
+		if config != nil {
+			ln = tls.NewListener(ln, config)
+		}
+		server.lns[i] = ln
 	}
 
-	server.ln = ln
 	server.conns = make(ConnSet)
+	if server.Metrics == nil {
+		server.Metrics = NewMetrics(server.Addr)
+	}
+	server.agents = make(map[net.Conn]agentConn)
+	server.ctx, server.cancel = context.WithCancel(context.Background())
+	server.connCfg = (&connConfig{
+		isServer:          true,
+		pendingWriteNum:   server.PendingWriteNum,
+		overflowPolicy:    server.OverflowPolicy,
+		overflowTimeout:   server.OverflowTimeout,
+		coalesceBytes:     server.CoalesceBytes,
+		onOverflow:        server.OnOverflow,
+		readIdleTimeout:   server.ReadIdleTimeout,
+		writeIdleTimeout:  server.WriteIdleTimeout,
+		idleTimeout:       server.IdleTimeout,
+		heartbeatInterval: server.HeartbeatInterval,
+		onIdle:            server.OnIdle,
+		record:            server.Record,
+		msgRate:           server.MsgRate,
+		msgBurst:          server.MsgBurst,
+		byteRate:          server.ByteRate,
+		byteBurst:         server.ByteBurst,
+		rateLimitAction:   server.RateLimitAction,
+		onRateLimit:       server.OnRateLimit,
+		metrics:           server.Metrics,
+	}).init()
+	server.connLimiter = newConnLimiter(server.IPFilter, server.MaxConnPerIP, server.AcceptRate, server.AcceptBurst)
 
 	// msg parser
-	msgParser := NewMsgParser()
-	msgParser.SetMsgLen(server.LenMsgLen, server.MinMsgLen, server.MaxMsgLen)
-	msgParser.SetByteOrder(server.LittleEndian)
-	server.msgParser = msgParser
+	if server.Codec != nil {
+		server.codec = server.Codec
+	} else {
+		msgParser := NewMsgParser()
+		msgParser.SetMsgLen(server.LenMsgLen, server.MinMsgLen, server.MaxMsgLen)
+		msgParser.SetByteOrder(server.LittleEndian)
+		msgParser.SetHeartbeat(server.HeartbeatInterval > 0)
+		server.codec = msgParser
+	}
+	return nil
 }
 
-func (server *TCPServer) run() {
-	server.wgLn.Add(1)
+func (server *TCPServer) run(ln net.Listener) {
 	defer server.wgLn.Done()
 
 	var tempDelay time.Duration
 	for {
-		conn, err := server.ln.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
@@ -84,11 +238,21 @@ func (server *TCPServer) run() {
 			return
 		}
 		tempDelay = 0
+		server.Metrics.accept()
+
+		if err := server.connLimiter.admit(conn.RemoteAddr().String()); err != nil {
+			conn.Close()
+			server.Metrics.reject(limitRejectReason(err))
+			logger.LogDebug("refuse %v: %v", conn.RemoteAddr(), err)
+			continue
+		}
 
 		server.mutexConns.Lock()
 		if len(server.conns) >= server.MaxConnNum {
 			server.mutexConns.Unlock()
 			conn.Close()
+			server.connLimiter.release(conn.RemoteAddr().String())
+			server.Metrics.reject(rejectMaxConn)
 			logger.LogDebug("too many connections")
 			continue
 		}
@@ -97,17 +261,45 @@ func (server *TCPServer) run() {
 
 		server.wgConns.Add(1)
 
-		tcpConn := newTCPConn(conn, server.PendingWriteNum, server.msgParser)
-		agent := server.NewAgent(tcpConn)
 		go func() {
-			agent.Run()
+			codec, err := handshake(conn, server.Handshaker, server.codec, true, server.HandshakeTimeout)
+			if err != nil {
+				logger.LogDebug("handshake with %v error: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				server.Metrics.reject(rejectHandshake)
+				server.mutexConns.Lock()
+				delete(server.conns, conn)
+				server.mutexConns.Unlock()
+				server.connLimiter.release(conn.RemoteAddr().String())
+				server.wgConns.Done()
+				return
+			}
+
+			tcpConn := newTCPConn(conn, server.connCfg, codec)
+			server.Metrics.open()
+			var session *Session
+			if server.Sessions != nil {
+				session = server.Sessions.Add(tcpConn)
+			}
+			agent := server.NewAgent(tcpConn)
+			server.mutexConns.Lock()
+			server.agents[conn] = agentConn{conn: tcpConn, agent: agent}
+			server.mutexConns.Unlock()
+			runAgent(server.ctx, agent, tcpConn.done)
 
 			// cleanup
 			tcpConn.Close()
+			reason := tcpConn.stats.closeReason()
+			server.Metrics.close(reason)
 			server.mutexConns.Lock()
 			delete(server.conns, conn)
+			delete(server.agents, conn)
 			server.mutexConns.Unlock()
-			agent.OnClose()
+			server.connLimiter.release(conn.RemoteAddr().String())
+			closeAgent(agent, reason)
+			if session != nil {
+				server.Sessions.Remove(session.Id())
+			}
 
 			server.wgConns.Done()
 		}()
@@ -115,7 +307,8 @@ func (server *TCPServer) run() {
 }
 
 func (server *TCPServer) Close() {
-	server.ln.Close()
+	server.cancel()
+	closeListeners(server.lns)
 	server.wgLn.Wait()
 
 	server.mutexConns.Lock()
@@ -126,3 +319,26 @@ func (server *TCPServer) Close() {
 	server.mutexConns.Unlock()
 	server.wgConns.Wait()
 }
+
+// Shutdown stops accepting, tells the agents implementing ShutdownAgent and closes their conns after the write queues are flushed,
+// the conns left when ctx is done are destroyed, Close waits for their agents
+func (server *TCPServer) Shutdown(ctx context.Context) error {
+	closeListeners(server.lns)
+	server.wgLn.Wait()
+
+	server.mutexConns.Lock()
+	agents := make([]agentConn, 0, len(server.agents))
+	for conn := range server.conns {
+		if ac, ok := server.agents[conn]; ok {
+			agents = append(agents, ac)
+		} else {
+			// not served yet
+			conn.Close()
+		}
+	}
+	server.mutexConns.Unlock()
+
+	shutdownAgents(ctx, agents)
+	server.cancel()
+	return waitDrained(ctx, &server.wgConns, agents)
+}
@@ -0,0 +1,100 @@
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate in " + file)
+	}
+	return pool, nil
+}
+
+// newServerTLSConfig requires the client certificate if clientCAFile is set, hook adjusts the config at last
+func newServerTLSConfig(certFile, keyFile, clientCAFile string, hook func(config *tls.Config)) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if hook != nil {
+		hook(config)
+	}
+	return config, nil
+}
+
+// newClientTLSConfig presents the certificate if certFile is set, the server name defaults to the host of addr
+func newClientTLSConfig(addr, certFile, keyFile, rootCAFile, serverName string, hook func(config *tls.Config)) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			config.ServerName = host
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if rootCAFile != "" {
+		pool, err := loadCertPool(rootCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if hook != nil {
+		hook(config)
+	}
+	return config, nil
+}
+
+func tlsClientHandshake(conn net.Conn, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// setLinger0 makes Close drop the unsent data, it sees through the tls and other wrapping conns
+func setLinger0(conn net.Conn) {
+	for conn != nil {
+		if l, ok := conn.(interface{ SetLinger(sec int) error }); ok {
+			l.SetLinger(0)
+			return
+		}
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return
+		}
+		conn = u.NetConn()
+	}
+}
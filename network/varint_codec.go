@@ -0,0 +1,118 @@
+package network
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// ---------------------
+// | uvarint len | data |
+// ---------------------
+// a zero len without anything behind is a heartbeat once SetHeartbeat enabled it, a too short message otherwise
+type VarintCodec struct {
+	minMsgLen uint32
+	maxMsgLen uint32
+	heartbeat bool
+}
+
+func NewVarintCodec() *VarintCodec {
+	c := new(VarintCodec)
+	c.minMsgLen = 1
+	c.maxMsgLen = 4096
+
+	return c
+}
+
+// It's dangerous to call the method on reading or writing
+func (c *VarintCodec) SetMsgLen(minMsgLen uint32, maxMsgLen uint32) {
+	if minMsgLen != 0 {
+		c.minMsgLen = minMsgLen
+	}
+	if maxMsgLen != 0 {
+		c.maxMsgLen = maxMsgLen
+	}
+}
+
+// It's dangerous to call the method on reading or writing
+func (c *VarintCodec) SetHeartbeat(enabled bool) {
+	c.heartbeat = enabled
+}
+
+func (c *VarintCodec) checkLen(msgLen uint64) error {
+	if msgLen > uint64(c.maxMsgLen) {
+		return ErrMsgTooLong
+	} else if msgLen < uint64(c.minMsgLen) {
+		return ErrMsgTooShort
+	}
+	return nil
+}
+
+// goroutine safe
+func (c *VarintCodec) ReadFrame(r io.Reader) (*FrameHeader, []byte, error) {
+	// read len byte by byte, the reader is not buffered
+	var (
+		b      [1]byte
+		msgLen uint64
+		shift  uint
+	)
+	for i := 0; ; i++ {
+		if i == binary.MaxVarintLen32 {
+			return nil, nil, ErrMsgTooLong
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, nil, err
+		}
+		msgLen |= uint64(b[0]&0x7f) << shift
+		if b[0] < 0x80 {
+			break
+		}
+		shift += 7
+	}
+
+	if msgLen == 0 && c.heartbeat {
+		return &FrameHeader{Flags: FlagHeartbeat}, nil, nil
+	}
+
+	// check len
+	if err := c.checkLen(msgLen); err != nil {
+		return nil, nil, err
+	}
+
+	// data
+	msgData := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, msgData); err != nil {
+		return nil, nil, err
+	}
+
+	return nil, msgData, nil
+}
+
+// goroutine safe, the header is ignored since the frame has no room for it
+func (c *VarintCodec) PackFrame(_ *FrameHeader, args ...[]byte) ([]byte, error) {
+	// get len
+	msgLen := argsLen(args)
+
+	// check len
+	if err := c.checkLen(uint64(msgLen)); err != nil {
+		return nil, err
+	}
+
+	var bufMsgLen [binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(bufMsgLen[:], uint64(msgLen))
+
+	msg := GetBuffer(n + int(msgLen))
+	copy(msg, bufMsgLen[:n])
+
+	// write data
+	l := n
+	for i := 0; i < len(args); i++ {
+		copy(msg[l:], args[i])
+		l += len(args[i])
+	}
+
+	return msg, nil
+}
+
+func (c *VarintCodec) PackHeartbeat() ([]byte, error) {
+	return []byte{0}, nil
+}
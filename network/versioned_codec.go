@@ -0,0 +1,211 @@
+package network
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/gzjjyz/trace"
+	"github.com/petermattis/goid"
+)
+
+const (
+	FrameVersion1      uint8 = 1
+	FrameVersionLatest       = FrameVersion1
+)
+
+// -----------------------------------------------------------------------------------------
+// | len | version(1) | flags(2) | [trace id len(1) | trace id] | [meta len(2) | meta] | data |
+// -----------------------------------------------------------------------------------------
+// len counts everything behind itself, the trace part exists if FlagTrace is set and the
+// meta part exists if FlagMeta is set, meta is a sequence of | type(1) | len(2) | value |
+type VersionedCodec struct {
+	parser       *MsgParser
+	littleEndian bool
+	version      uint8
+}
+
+func NewVersionedCodec() *VersionedCodec {
+	c := new(VersionedCodec)
+	c.parser = NewMsgParser()
+	c.parser.SetMsgLen(4, 3, 4096)
+	c.version = FrameVersionLatest
+
+	return c
+}
+
+// It's dangerous to call the method on reading or writing, the len counts the whole header
+func (c *VersionedCodec) SetMsgLen(lenMsgLen int, maxMsgLen uint32) {
+	c.parser.SetMsgLen(lenMsgLen, 0, maxMsgLen)
+}
+
+// It's dangerous to call the method on reading or writing
+func (c *VersionedCodec) SetByteOrder(littleEndian bool) {
+	c.parser.SetByteOrder(littleEndian)
+	c.littleEndian = littleEndian
+}
+
+// Version returns the version stamped on packed frames
+func (c *VersionedCodec) Version() uint8 {
+	return c.version
+}
+
+// WithVersion returns a copy of the codec that packs frames of the version
+func (c *VersionedCodec) WithVersion(version uint8) *VersionedCodec {
+	n := *c
+	n.version = version
+	return &n
+}
+
+func (c *VersionedCodec) byteOrder() binary.ByteOrder {
+	if c.littleEndian {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// goroutine safe
+func (c *VersionedCodec) ReadFrame(r io.Reader) (*FrameHeader, []byte, error) {
+	msg, err := c.parser.Read(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the parser keeps the min len at 3 at least
+	order := c.byteOrder()
+	h := &FrameHeader{
+		Version: msg[0],
+		Flags:   order.Uint16(msg[1:]),
+	}
+	if h.Version == 0 || h.Version > FrameVersionLatest {
+		return nil, nil, ErrUnsupportedVersion
+	}
+	msg = msg[3:]
+
+	if h.Flags&FlagTrace != 0 {
+		if len(msg) < 1 || len(msg) < 1+int(msg[0]) {
+			return nil, nil, ErrBadTraceHeader
+		}
+		h.TraceId = string(msg[1 : 1+msg[0]])
+		msg = msg[1+msg[0]:]
+		trace.Ctx.SetCurGTrace(goid.Get(), h.TraceId)
+	}
+
+	if h.Flags&FlagMeta != 0 {
+		if len(msg) < 2 || len(msg) < 2+int(order.Uint16(msg)) {
+			return nil, nil, ErrBadMetaHeader
+		}
+		metaLen := int(order.Uint16(msg))
+		h.Meta, err = c.parseMeta(msg[2 : 2+metaLen])
+		if err != nil {
+			return nil, nil, err
+		}
+		msg = msg[2+metaLen:]
+	}
+
+	return h, msg, nil
+}
+
+func (c *VersionedCodec) parseMeta(b []byte) (FrameMeta, error) {
+	order := c.byteOrder()
+	meta := make(FrameMeta)
+	for len(b) > 0 {
+		if len(b) < 3 || len(b) < 3+int(order.Uint16(b[1:])) {
+			return nil, ErrBadMetaHeader
+		}
+		l := int(order.Uint16(b[1:]))
+		meta[b[0]] = b[3 : 3+l]
+		b = b[3+l:]
+	}
+	return meta, nil
+}
+
+func (c *VersionedCodec) packMeta(meta FrameMeta) ([]byte, error) {
+	types := make([]int, 0, len(meta))
+	metaLen := 2
+	for t, v := range meta {
+		if len(v) > 0xffff {
+			return nil, ErrMetaTooLong
+		}
+		types = append(types, int(t))
+		metaLen += 3 + len(v)
+	}
+	if metaLen-2 > 0xffff {
+		return nil, ErrMetaTooLong
+	}
+	sort.Ints(types)
+
+	order := c.byteOrder()
+	b := make([]byte, metaLen)
+	order.PutUint16(b, uint16(metaLen-2))
+	l := 2
+	for _, t := range types {
+		v := meta[uint8(t)]
+		b[l] = uint8(t)
+		order.PutUint16(b[l+1:], uint16(len(v)))
+		copy(b[l+3:], v)
+		l += 3 + len(v)
+	}
+	return b, nil
+}
+
+// goroutine safe, the trace id of the current goroutine is carried if h has none
+func (c *VersionedCodec) PackFrame(h *FrameHeader, args ...[]byte) ([]byte, error) {
+	var (
+		flags   uint16
+		traceId string
+		meta    FrameMeta
+	)
+	if h != nil {
+		flags = h.Flags &^ (FlagTrace | FlagMeta)
+		traceId = h.TraceId
+		meta = h.Meta
+	}
+	if traceId == "" {
+		traceId, _ = trace.Ctx.GetCurGTrace(goid.Get())
+	}
+
+	header := make([]byte, 3, 4+len(traceId))
+	header[0] = c.version
+	if traceId != "" {
+		if len(traceId) > 0xff {
+			return nil, ErrBadTraceHeader
+		}
+		flags |= FlagTrace
+		header = append(header, byte(len(traceId)))
+		header = append(header, traceId...)
+	}
+	if len(meta) > 0 {
+		flags |= FlagMeta
+		metaBytes, err := c.packMeta(meta)
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, metaBytes...)
+	}
+	c.byteOrder().PutUint16(header[1:], flags)
+
+	return c.parser.PackMsg(append([][]byte{header}, args...)...)
+}
+
+// goroutine safe, heartbeats are skipped
+func (c *VersionedCodec) ReadWithTrace(r io.Reader) ([]byte, error) {
+	return readSkipHeartbeats(r, c.ReadFrame)
+}
+
+// goroutine safe, the trace id rides in the header
+func (c *VersionedCodec) readTraceFrame(r io.Reader) (*FrameHeader, []byte, error) {
+	return c.ReadFrame(r)
+}
+
+// goroutine safe
+func (c *VersionedCodec) PackMsgWithTrace(args ...[]byte) ([]byte, error) {
+	return c.PackFrame(nil, args...)
+}
+
+func (c *VersionedCodec) PackHeartbeat() ([]byte, error) {
+	return c.PackFrame(&FrameHeader{Flags: FlagHeartbeat})
+}
+
+func (c *VersionedCodec) CarriesHeader() bool {
+	return true
+}
@@ -0,0 +1,132 @@
+package network
+
+import (
+	"time"
+)
+
+// OverflowPolicy decides what happens to a message written while the write queue of a conn is full
+type OverflowPolicy int
+
+const (
+	// OverflowDestroy destroys the conn, it's the default
+	OverflowDestroy OverflowPolicy = iota
+	// OverflowBlock waits up to OverflowTimeout for room then destroys the conn
+	OverflowBlock
+	// OverflowDropNewest drops the message being written
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest queued message to make room
+	OverflowDropOldest
+	// OverflowCoalesce keeps the messages in a buffer up to CoalesceBytes then destroys the conn
+	OverflowCoalesce
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDestroy:
+		return "destroy"
+	case OverflowBlock:
+		return "block"
+	case OverflowDropNewest:
+		return "drop newest"
+	case OverflowDropOldest:
+		return "drop oldest"
+	case OverflowCoalesce:
+		return "coalesce"
+	}
+	return "unknown"
+}
+
+// queuedMsg is a message in the write queue, the pooled ones are put back to the buffer pool once written
+type queuedMsg struct {
+	b      []byte
+	pooled bool
+}
+
+// writeQueue must be used with the owner conn locked, a nil message asks the writer goroutine to close the conn
+type writeQueue struct {
+	ch           chan queuedMsg
+	cfg          *connConfig
+	pending      []queuedMsg
+	pendingBytes int
+}
+
+func newWriteQueue(cfg *connConfig) *writeQueue {
+	return &writeQueue{
+		ch:  make(chan queuedMsg, cfg.pendingWriteNum),
+		cfg: cfg,
+	}
+}
+
+// push reports whether the queue overflowed and whether the conn has to be destroyed
+func (q *writeQueue) push(m queuedMsg) (overflow bool, destroy bool) {
+	b := m.b
+	// messages queue up behind the coalesced ones to keep the order,
+	// the writer goroutine takes them once the queue is drained
+	if len(q.pending) > 0 && b != nil {
+		return len(q.ch) == cap(q.ch), !q.coalesce(m)
+	}
+
+	select {
+	case q.ch <- m:
+		return false, false
+	default:
+	}
+
+	switch q.cfg.overflowPolicy {
+	case OverflowBlock:
+		t := time.NewTimer(q.cfg.overflowTimeout)
+		defer t.Stop()
+		select {
+		case q.ch <- m:
+			return true, false
+		case <-t.C:
+			return true, true
+		}
+	case OverflowDropNewest:
+		return true, b == nil
+	case OverflowDropOldest:
+		select {
+		case <-q.ch:
+		default:
+		}
+		select {
+		case q.ch <- m:
+			return true, false
+		default:
+			return true, true
+		}
+	case OverflowCoalesce:
+		if b == nil {
+			return true, true
+		}
+		return true, !q.coalesce(m)
+	}
+
+	return true, true
+}
+
+func (q *writeQueue) coalesce(m queuedMsg) bool {
+	if q.pendingBytes+len(m.b) > q.cfg.coalesceBytes {
+		return false
+	}
+	q.pending = append(q.pending, m)
+	q.pendingBytes += len(m.b)
+	return true
+}
+
+// len counts the messages queued
+func (q *writeQueue) len() int {
+	return len(q.ch) + len(q.pending)
+}
+
+// takePending hands the coalesced messages to the writer goroutine once the queue is drained,
+// force takes them at once
+func (q *writeQueue) takePending(force bool) []queuedMsg {
+	if len(q.pending) == 0 || (!force && len(q.ch) > 0) {
+		return nil
+	}
+	pending := q.pending
+	q.pending = nil
+	q.pendingBytes = 0
+	return pending
+}
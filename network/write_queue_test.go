@@ -0,0 +1,80 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteQueue_Overflow(t *testing.T) {
+	q := newWriteQueue((&connConfig{pendingWriteNum: 2, overflowPolicy: OverflowDropOldest}).init())
+	q.push(queuedMsg{b: []byte("1")})
+	q.push(queuedMsg{b: []byte("2")})
+	if overflow, destroy := q.push(queuedMsg{b: []byte("3")}); !overflow || destroy {
+		t.Fatalf("unexpected overflow %v destroy %v", overflow, destroy)
+	}
+	if m := <-q.ch; string(m.b) != "2" {
+		t.Fatalf("unexpected oldest %q", m.b)
+	}
+
+	q = newWriteQueue((&connConfig{pendingWriteNum: 1, overflowPolicy: OverflowCoalesce, coalesceBytes: 3}).init())
+	q.push(queuedMsg{b: []byte("1")})
+	if _, destroy := q.push(queuedMsg{b: []byte("22")}); destroy {
+		t.Fatal("unexpected destroy")
+	}
+	<-q.ch
+	// queued behind the coalesced message although there is room
+	if overflow, destroy := q.push(queuedMsg{b: []byte("3")}); overflow || destroy {
+		t.Fatalf("unexpected overflow %v destroy %v", overflow, destroy)
+	}
+	if pending := q.takePending(false); len(pending) != 2 {
+		t.Fatalf("unexpected pending %v", pending)
+	}
+	q.push(queuedMsg{b: []byte("1")})
+	q.push(queuedMsg{b: []byte("22")})
+	if _, destroy := q.push(queuedMsg{b: []byte("33")}); !destroy {
+		t.Fatal("coalesce cap exceeded but not destroyed")
+	}
+}
+
+func TestWriteQueue_BlockDrains(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// enough to fill the socket buffers, the writer blocks until the peer reads
+	const n, size = 2000, 4000
+	conn := newTCPConn(c, (&connConfig{pendingWriteNum: 1, overflowPolicy: OverflowBlock, overflowTimeout: 2 * time.Second}).init(), NewMsgParser())
+	defer conn.Destroy()
+	start := time.Now()
+	go func() {
+		msg := make([]byte, size)
+		for i := 0; i < n; i++ {
+			if err := conn.WriteMsg(msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	parser := NewMsgParser()
+	for i := 0; i < n; i++ {
+		if _, err := parser.Read(peer); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("blocked writer drained in %v", d)
+	}
+}
@@ -1,6 +1,10 @@
 package network
 
 import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,22 +22,75 @@ type WSClient struct {
 	HandshakeTimeout time.Duration
 	AutoReconnect    bool
 	NewAgent         func(*WSConn) Agent
+	Metrics          *Metrics // nil creates one named by Addr
 	dialer           websocket.Dialer
 	conns            WebsocketConnSet
 	wg               sync.WaitGroup
+	connCfg          *connConfig
 	closeFlag        bool
+	retry            *reconnector
+
+	// reconnect, see TCPClient
+	MaxConnectInterval time.Duration
+	ConnectJitter      float64
+	MaxAttempts        int
+	OnConnected        func(conn Conn)
+	OnDisconnected     func(conn Conn, reason CloseReason)
+	OnGiveUp           func(err error)
+
+	// compression, the names are offered in order of preference
+	Compressors       []string
+	CompressThreshold int
+	// EnableCompression offers permessage-deflate
+	EnableCompression bool
+
+	// Subprotocols are offered in order of preference, the chosen one is WSConn.Subprotocol
+	Subprotocols []string
+
+	// write queue overflow
+	OverflowPolicy  OverflowPolicy
+	OverflowTimeout time.Duration
+	CoalesceBytes   int
+	OnOverflow      func(conn Conn, policy OverflowPolicy)
+
+	// idle
+	ReadIdleTimeout   time.Duration
+	WriteIdleTimeout  time.Duration
+	IdleTimeout       time.Duration
+	HeartbeatInterval time.Duration
+	// OnIdle returns whether to destroy the conn, nil destroys on read and total idle
+	OnIdle func(conn Conn, kind IdleKind) bool
+
+	// record, Record returns where the messages of a conn are recorded, nil or a nil writer records nothing, see RecordToDir
+	Record func(conn Conn) io.WriteCloser
 }
 
 func (client *WSClient) Start() {
-	client.init()
+	client.StartContext(context.Background())
+}
+
+// StartContext starts the client, the pending dials are canceled and the conns are closed when ctx is done
+func (client *WSClient) StartContext(ctx context.Context) {
+	client.init(ctx)
 
+	client.wg.Add(1)
+	go func() {
+		defer client.wg.Done()
+		<-client.retry.ctx.Done()
+		client.closeConns()
+	}()
 	for i := 0; i < client.ConnNum; i++ {
 		client.wg.Add(1)
 		go client.connect()
 	}
 }
 
-func (client *WSClient) init() {
+// Ready waits until a conn is connected, it fails if ctx is done, the client is closed or all the conns give up
+func (client *WSClient) Ready(ctx context.Context) error {
+	return client.retry.wait(ctx)
+}
+
+func (client *WSClient) init(ctx context.Context) {
 	client.Lock()
 	defer client.Unlock()
 
@@ -65,69 +122,139 @@ func (client *WSClient) init() {
 	}
 
 	client.conns = make(WebsocketConnSet)
+	if client.Metrics == nil {
+		client.Metrics = NewMetrics(client.Addr)
+	}
 	client.closeFlag = false
+	client.retry = newReconnector(ctx, client.ConnNum)
+	client.retry.interval = client.ConnectInterval
+	client.retry.maxInterval = client.MaxConnectInterval
+	client.retry.jitter = client.ConnectJitter
+	client.retry.maxAttempts = client.MaxAttempts
+	client.retry.onGiveUp = client.OnGiveUp
+	client.connCfg = (&connConfig{
+		isServer:          false,
+		pendingWriteNum:   client.PendingWriteNum,
+		overflowPolicy:    client.OverflowPolicy,
+		overflowTimeout:   client.OverflowTimeout,
+		coalesceBytes:     client.CoalesceBytes,
+		onOverflow:        client.OnOverflow,
+		readIdleTimeout:   client.ReadIdleTimeout,
+		writeIdleTimeout:  client.WriteIdleTimeout,
+		idleTimeout:       client.IdleTimeout,
+		heartbeatInterval: client.HeartbeatInterval,
+		onIdle:            client.OnIdle,
+		record:            client.Record,
+		metrics:           client.Metrics,
+	}).init()
 	client.dialer = websocket.Dialer{
-		HandshakeTimeout: client.HandshakeTimeout,
+		HandshakeTimeout:  client.HandshakeTimeout,
+		Subprotocols:      client.Subprotocols,
+		EnableCompression: client.EnableCompression,
 	}
 }
 
-func (client *WSClient) dial() *websocket.Conn {
-	for {
-		conn, _, err := client.dialer.Dial(client.Addr, nil)
-		if err == nil || client.closeFlag {
-			return conn
-		}
+func (client *WSClient) dial() (*websocket.Conn, *frameCompressor, error) {
+	var header http.Header
+	if len(client.Compressors) > 0 {
+		header = http.Header{}
+		header.Set(wsCompressionHeader, strings.Join(client.Compressors, ","))
+	}
 
-		logger.LogError("connect to %v error: %v", client.Addr, err)
-		time.Sleep(client.ConnectInterval)
-		continue
+	conn, resp, err := client.dialer.DialContext(client.retry.ctx, client.Addr, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	var fc *frameCompressor
+	if comp, ok := negotiateCompressor([]string{resp.Header.Get(wsCompressionHeader)}, client.Compressors); ok {
+		fc = newFrameCompressor(comp, client.CompressThreshold, int(client.MaxMsgLen))
 	}
+	return conn, fc, nil
 }
 
 func (client *WSClient) connect() {
 	defer client.wg.Done()
+	defer client.retry.exit()
 
-reconnect:
-	conn := client.dial()
-	if conn == nil {
-		return
-	}
-	conn.SetReadLimit(int64(client.MaxMsgLen))
+	failures := 0
+	for {
+		conn, fc, err := client.dial()
+		if err != nil {
+			if client.retry.closed() {
+				return
+			}
+			client.Metrics.reject(rejectDial)
+			logger.LogError("connect to %v error: %v", client.Addr, err)
+			failures++
+			if !client.retry.backoff(failures, err) {
+				return
+			}
+			continue
+		}
+		conn.SetReadLimit(int64(client.MaxMsgLen))
+		if fc != nil {
+			conn.SetReadLimit(int64(client.MaxMsgLen) + 1)
+		}
 
-	client.Lock()
-	if client.closeFlag {
+		client.Lock()
+		if client.closeFlag {
+			client.Unlock()
+			conn.Close()
+			return
+		}
+		client.conns[conn] = struct{}{}
 		client.Unlock()
-		conn.Close()
-		return
+		client.Metrics.accept()
+
+		failures = 0
+		client.serve(conn, fc)
+		if !client.AutoReconnect || !client.retry.sleep(client.retry.delay(0)) {
+			return
+		}
 	}
-	client.conns[conn] = struct{}{}
-	client.Unlock()
+}
 
-	wsConn := newWSConn(conn, client.PendingWriteNum, client.MaxMsgLen)
+func (client *WSClient) serve(conn *websocket.Conn, fc *frameCompressor) {
+	wsConn := newWSConn(conn, client.connCfg, client.MaxMsgLen)
+	wsConn.compress = fc
+	client.Metrics.open()
+	client.retry.connected()
 	agent := client.NewAgent(wsConn)
-	agent.Run()
+	if client.OnConnected != nil {
+		client.OnConnected(wsConn)
+	}
+	runAgent(client.retry.ctx, agent, wsConn.done)
 
 	// cleanup
 	wsConn.Close()
+	reason := wsConn.stats.closeReason()
+	client.Metrics.close(reason)
 	client.Lock()
 	delete(client.conns, conn)
 	client.Unlock()
-	agent.OnClose()
-
-	if client.AutoReconnect {
-		time.Sleep(client.ConnectInterval)
-		goto reconnect
+	closeAgent(agent, reason)
+	if client.OnDisconnected != nil {
+		client.OnDisconnected(wsConn, reason)
 	}
 }
 
-func (client *WSClient) Close() {
+func (client *WSClient) closeConns() {
 	client.Lock()
 	client.closeFlag = true
 	for conn := range client.conns {
 		conn.Close()
 	}
-	client.conns = nil
 	client.Unlock()
+}
 
+func (client *WSClient) Close() {
+	if client.retry != nil {
+		client.retry.cancel()
+	}
+	client.closeConns()
 	client.wg.Wait()
+
+	client.Lock()
+	client.conns = nil
+	client.Unlock()
 }
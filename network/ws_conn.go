@@ -4,7 +4,9 @@ import (
 	"errors"
 	"github.com/gzjjyz/srvlib/utils"
 	"net"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/gzjjyz/logger"
@@ -15,26 +17,86 @@ type WebsocketConnSet map[*websocket.Conn]struct{}
 type WSConn struct {
 	sync.Mutex
 	conn       *websocket.Conn
-	writeChan  chan []byte
+	writeQueue *writeQueue
 	maxMsgLen  uint32
 	closeFlag  bool
 	remoteAddr string
+	cfg        *connConfig
+	idle       *idleWatcher
+	limiter    *msgLimiter
+	compress   *frameCompressor
+	stats      *connStats
+	msgType    int
+	request    *http.Request
+	rec        *recorder
+	done       chan struct{}
 }
 
-func newWSConn(conn *websocket.Conn, pendingWriteNum int, maxMsgLen uint32) *WSConn {
+// the client offers the compressors by the header of the upgrade request and the server answers the chosen one,
+// every message then starts with a flag byte telling whether it's compressed
+const wsCompressionHeader = "X-Frame-Compression"
+
+func newWSConn(conn *websocket.Conn, cfg *connConfig, maxMsgLen uint32) *WSConn {
 	wsConn := new(WSConn)
 	wsConn.conn = conn
-	wsConn.writeChan = make(chan []byte, pendingWriteNum)
+	wsConn.writeQueue = newWriteQueue(cfg)
 	wsConn.maxMsgLen = maxMsgLen
+	wsConn.cfg = cfg
+	wsConn.idle = newIdleWatcher(cfg)
+	wsConn.limiter = newMsgLimiter(cfg)
+	wsConn.stats = newConnStats(cfg.metrics)
+	wsConn.msgType = websocket.BinaryMessage
+	if cfg.textMessage {
+		wsConn.msgType = websocket.TextMessage
+	}
+	wsConn.rec = newRecorder(cfg, wsConn)
+	wsConn.done = make(chan struct{})
+
+	conn.SetPingHandler(func(appData string) error {
+		wsConn.idle.touchRead()
+		err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		} else if e, ok := err.(net.Error); ok && e.Temporary() {
+			return nil
+		}
+		return err
+	})
+	conn.SetPongHandler(func(string) error {
+		wsConn.idle.touchRead()
+		return nil
+	})
 
 	go func() {
-		for b := range wsConn.writeChan {
-			if b == nil {
-				break
+	loop:
+		for m := range wsConn.writeQueue.ch {
+			b := m.b
+			if b != nil {
+				err := conn.WriteMessage(wsConn.msgType, b)
+				if err != nil {
+					wsConn.stats.setCloseReason(CloseError)
+					break
+				}
+				wsConn.stats.wrote(len(b))
+				wsConn.idle.touchWrite()
+			}
+
+			var pending []queuedMsg
+			if wsConn.cfg.overflowPolicy == OverflowCoalesce {
+				wsConn.Lock()
+				pending = wsConn.writeQueue.takePending(b == nil)
+				wsConn.Unlock()
+			}
+			for _, p := range pending {
+				if err := conn.WriteMessage(wsConn.msgType, p.b); err != nil {
+					wsConn.stats.setCloseReason(CloseError)
+					break loop
+				}
+				wsConn.stats.wrote(len(p.b))
+				wsConn.idle.touchWrite()
 			}
 
-			err := conn.WriteMessage(websocket.BinaryMessage, b)
-			if err != nil {
+			if b == nil {
 				break
 			}
 		}
@@ -43,17 +105,22 @@ func newWSConn(conn *websocket.Conn, pendingWriteNum int, maxMsgLen uint32) *WSC
 		wsConn.Lock()
 		wsConn.closeFlag = true
 		wsConn.Unlock()
+		wsConn.idle.stop()
+		wsConn.rec.close()
+		close(wsConn.done)
 	}()
 
+	go wsConn.idle.run(wsConn, wsConn.ping)
+
 	return wsConn
 }
 
 func (wsConn *WSConn) doDestroy() {
-	wsConn.conn.UnderlyingConn().(*net.TCPConn).SetLinger(0)
+	setLinger0(wsConn.conn.UnderlyingConn())
 	wsConn.conn.Close()
 
 	if !wsConn.closeFlag {
-		close(wsConn.writeChan)
+		close(wsConn.writeQueue.ch)
 		wsConn.closeFlag = true
 	}
 }
@@ -62,6 +129,7 @@ func (wsConn *WSConn) Destroy() {
 	wsConn.Lock()
 	defer wsConn.Unlock()
 
+	wsConn.stats.setCloseReason(CloseDestroy)
 	wsConn.doDestroy()
 }
 
@@ -72,18 +140,21 @@ func (wsConn *WSConn) Close() {
 		return
 	}
 
+	wsConn.stats.setCloseReason(CloseLocal)
 	wsConn.doWrite(nil)
 	wsConn.closeFlag = true
 }
 
-func (wsConn *WSConn) doWrite(b []byte) {
-	if len(wsConn.writeChan) == cap(wsConn.writeChan) {
+// doWrite reports whether the write queue overflowed
+func (wsConn *WSConn) doWrite(b []byte) bool {
+	overflow, destroy := wsConn.writeQueue.push(queuedMsg{b: b})
+	wsConn.stats.queued(wsConn.writeQueue.len())
+	if destroy {
 		logger.LogError("close conn: channel full")
+		wsConn.stats.setCloseReason(CloseChannelFull)
 		wsConn.doDestroy()
-		return
 	}
-
-	wsConn.writeChan <- b
+	return overflow
 }
 
 func (wsConn *WSConn) LocalAddr() net.Addr {
@@ -94,6 +165,16 @@ func (wsConn *WSConn) RemoteAddr() net.Addr {
 	return wsConn.conn.RemoteAddr()
 }
 
+// Request returns the upgrade request of a server side conn, its headers and query for example, nil on the client side
+func (wsConn *WSConn) Request() *http.Request {
+	return wsConn.request
+}
+
+// Subprotocol returns the subprotocol negotiated by the upgrade, empty if none
+func (wsConn *WSConn) Subprotocol() string {
+	return wsConn.conn.Subprotocol()
+}
+
 func (wsConn *WSConn) SetRemoteAddr(addr string) {
 	wsConn.remoteAddr = addr
 }
@@ -107,20 +188,80 @@ func (wsConn *WSConn) RemoteAddrWithoutPort() string {
 	return wsConn.remoteAddr
 }
 
+func (wsConn *WSConn) ping() {
+	err := wsConn.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+	if err == nil {
+		wsConn.idle.touchWrite()
+	}
+}
+
 // goroutine not safe
 func (wsConn *WSConn) ReadMsg() ([]byte, error) {
+	for {
+		b, err := wsConn.readMsg()
+		if err != nil {
+			return nil, err
+		}
+		deliver, err := wsConn.limiter.check(wsConn, len(b))
+		if err != nil {
+			return nil, err
+		}
+		if deliver {
+			wsConn.stats.readMsg()
+			wsConn.rec.in(nil, b)
+			return b, nil
+		}
+	}
+}
+
+func (wsConn *WSConn) readMsg() ([]byte, error) {
 	_, b, err := wsConn.conn.ReadMessage()
-	return b, err
+	if err != nil {
+		wsConn.stats.setCloseReason(readCloseReason(err))
+		return nil, err
+	}
+	wsConn.idle.touchRead()
+	wsConn.stats.read(len(b))
+
+	if wsConn.compress != nil {
+		if len(b) < 1 {
+			return nil, errors.New("compress flag missing")
+		}
+		return wsConn.compress.decompress(b[1:], b[0] != 0)
+	}
+	return b, nil
+}
+
+func (wsConn *WSConn) Stats() ConnStats {
+	wsConn.Lock()
+	queueLen := wsConn.writeQueue.len()
+	wsConn.Unlock()
+	return wsConn.stats.snapshot(queueLen)
+}
+
+func (wsConn *WSConn) setCloseReason(reason CloseReason) {
+	wsConn.stats.setCloseReason(reason)
+}
+
+func (wsConn *WSConn) CompressionStats() (CompressionStats, bool) {
+	if wsConn.compress == nil {
+		return CompressionStats{}, false
+	}
+	return wsConn.compress.stats(), true
 }
 
 // args must not be modified by the others goroutines
 func (wsConn *WSConn) WriteMsg(args ...[]byte) error {
-	wsConn.Lock()
-	defer wsConn.Unlock()
-	if wsConn.closeFlag {
-		return nil
+	msg, err := wsConn.packMsg(args...)
+	if err != nil {
+		return err
 	}
 
+	wsConn.writePacked(msg, args)
+	return nil
+}
+
+func (wsConn *WSConn) packMsg(args ...[]byte) ([]byte, error) {
 	// get len
 	var msgLen uint32
 	for i := 0; i < len(args); i++ {
@@ -129,15 +270,25 @@ func (wsConn *WSConn) WriteMsg(args ...[]byte) error {
 
 	// check len
 	if msgLen > wsConn.maxMsgLen {
-		return errors.New("message too long")
+		return nil, ErrMsgTooLong
 	} else if msgLen < 1 {
-		return errors.New("message too short")
+		return nil, ErrMsgTooShort
+	}
+
+	if wsConn.compress != nil {
+		var compressed bool
+		args, compressed = wsConn.compress.compress(args)
+		flag := []byte{0}
+		if compressed {
+			flag[0] = 1
+		}
+		args = append([][]byte{flag}, args...)
+		msgLen = argsLen(args)
 	}
 
 	// don't copy
 	if len(args) == 1 {
-		wsConn.doWrite(args[0])
-		return nil
+		return args[0], nil
 	}
 
 	// merge the args
@@ -148,7 +299,33 @@ func (wsConn *WSConn) WriteMsg(args ...[]byte) error {
 		l += len(args[i])
 	}
 
-	wsConn.doWrite(msg)
+	return msg, nil
+}
 
-	return nil
+// wsPackKey tells the conns which pack the same args into the same bytes or the same error
+type wsPackKey struct {
+	compress  *frameCompressor
+	maxMsgLen uint32
+}
+
+func (wsConn *WSConn) packKey() interface{} {
+	return wsPackKey{wsConn.compress, wsConn.maxMsgLen}
+}
+
+func (wsConn *WSConn) writePacked(b []byte, args [][]byte) {
+	wsConn.rec.out(nil, args...)
+	if wsConn.write(b) {
+		wsConn.cfg.overflow(wsConn)
+	}
+}
+
+func (wsConn *WSConn) write(b []byte) bool {
+	wsConn.Lock()
+	defer wsConn.Unlock()
+	if wsConn.closeFlag {
+		return false
+	}
+
+	wsConn.stats.wroteMsg()
+	return wsConn.doWrite(b)
 }
@@ -1,9 +1,12 @@
 package network
 
 import (
+	"context"
 	"crypto/tls"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -21,19 +24,90 @@ type WSServer struct {
 	CertFile        string
 	KeyFile         string
 	NewAgent        func(*WSConn) Agent
+	Sessions        *SessionManager
+	Metrics         *Metrics // nil creates one named by Addr
 	ln              net.Listener
 	handler         *WSHandler
+	httpServer      *http.Server
+
+	// compression, the names are accepted in order of the client's preference
+	Compressors       []string
+	CompressThreshold int
+
+	// write queue overflow
+	OverflowPolicy  OverflowPolicy
+	OverflowTimeout time.Duration
+	CoalesceBytes   int
+	OnOverflow      func(conn Conn, policy OverflowPolicy)
+
+	// idle
+	ReadIdleTimeout   time.Duration
+	WriteIdleTimeout  time.Duration
+	IdleTimeout       time.Duration
+	HeartbeatInterval time.Duration
+	// OnIdle returns whether to destroy the conn, nil destroys on read and total idle
+	OnIdle func(conn Conn, kind IdleKind) bool
+
+	// record, Record returns where the messages of a conn are recorded, nil or a nil writer records nothing, see RecordToDir
+	Record func(conn Conn) io.WriteCloser
+
+	// limits, the unset ones are unlimited
+	// the ip filter, the accept rate and MaxConnPerIP admit the accepted conns,
+	// MsgRate and ByteRate limit the messages per second a conn reads, the bursts default to the rates
+	IPFilter        *IPFilter
+	MaxConnPerIP    int
+	AcceptRate      float64
+	AcceptBurst     int
+	MsgRate         float64
+	MsgBurst        int
+	ByteRate        float64
+	ByteBurst       int
+	RateLimitAction RateLimitAction
+	OnRateLimit     func(conn Conn, action RateLimitAction)
+
+	// proxy protocol, the conns from TrustedProxies must start with a PROXY protocol v1 or v2 header,
+	// from all the peers if TrustedProxies is empty
+	ProxyProtocol bool
+	// X-Forwarded-For and X-Real-IP are honored only from TrustedProxies
+	TrustedProxies []string
+
+	// upgrade
+	// AllowedOrigins are the Origin headers accepted, full origins or hosts, "*.example.com" matches the subdomains,
+	// the requests without Origin are accepted and empty AllowedOrigins accepts all, CheckOrigin takes precedence
+	AllowedOrigins []string
+	CheckOrigin    func(r *http.Request) bool
+	// Subprotocols are accepted in order of preference, the chosen one is WSConn.Subprotocol
+	Subprotocols []string
+	// EnableCompression negotiates permessage-deflate, CompressionLevel 0 is the flate default
+	EnableCompression bool
+	CompressionLevel  int
+	// TextMessage writes text frames for the json clients, the Compressors above break it
+	TextMessage bool
+	// MaxHeaderBytes 0 is http.DefaultMaxHeaderBytes
+	MaxHeaderBytes int
 }
 
 type WSHandler struct {
-	maxConnNum      int
-	pendingWriteNum int
-	maxMsgLen       uint32
-	newAgent        func(*WSConn) Agent
-	upgrader        websocket.Upgrader
-	conns           WebsocketConnSet
-	mutexConns      sync.Mutex
-	wg              sync.WaitGroup
+	maxConnNum int
+	connCfg    *connConfig
+	maxMsgLen  uint32
+	newAgent   func(*WSConn) Agent
+	sessions   *SessionManager
+	metrics    *Metrics
+	limiter    *connLimiter
+	trusted    []*net.IPNet
+
+	compressors       []string
+	compressThreshold int
+	compressionLevel  int
+	upgrader          websocket.Upgrader
+	conns             WebsocketConnSet
+	agents            map[*websocket.Conn]agentConn
+	closing           bool
+	mutexConns        sync.Mutex
+	wg                sync.WaitGroup
+	ctx               context.Context
+	cancel            context.CancelFunc
 }
 
 func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -41,18 +115,51 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
-	conn, err := handler.upgrader.Upgrade(w, r, nil)
+	// counted before admitted as TCPServer does, the rejected ones too
+	handler.metrics.accept()
+	remoteIP := handler.remoteIP(r)
+	if err := handler.limiter.admit(remoteIP); err != nil {
+		logger.LogDebug("refuse %v: %v", remoteIP, err)
+		handler.metrics.reject(limitRejectReason(err))
+		if err == errIPDenied {
+			http.Error(w, "Forbidden", 403)
+		} else {
+			http.Error(w, "Too many requests", 429)
+		}
+		return
+	}
+	defer handler.limiter.release(remoteIP)
+	var (
+		responseHeader http.Header
+		fc             *frameCompressor
+	)
+	if offered := r.Header.Get(wsCompressionHeader); offered != "" {
+		if comp, ok := negotiateCompressor(strings.Split(offered, ","), handler.compressors); ok {
+			responseHeader = http.Header{}
+			responseHeader.Set(wsCompressionHeader, comp.Name())
+			fc = newFrameCompressor(comp, handler.compressThreshold, int(handler.maxMsgLen))
+		}
+	}
+
+	conn, err := handler.upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		logger.LogDebug("upgrade error: %v", err)
+		handler.metrics.reject(rejectUpgrade)
 		return
 	}
 	conn.SetReadLimit(int64(handler.maxMsgLen))
+	if fc != nil {
+		conn.SetReadLimit(int64(handler.maxMsgLen) + 1)
+	}
+	if handler.compressionLevel != 0 {
+		conn.SetCompressionLevel(handler.compressionLevel)
+	}
 
 	handler.wg.Add(1)
 	defer handler.wg.Done()
 
 	handler.mutexConns.Lock()
-	if handler.conns == nil {
+	if handler.conns == nil || handler.closing {
 		handler.mutexConns.Unlock()
 		conn.Close()
 		return
@@ -60,24 +167,44 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if len(handler.conns) >= handler.maxConnNum {
 		handler.mutexConns.Unlock()
 		conn.Close()
+		handler.metrics.reject(rejectMaxConn)
 		logger.LogDebug("too many connections")
 		return
 	}
 	handler.conns[conn] = struct{}{}
 	handler.mutexConns.Unlock()
 
-	wsConn := newWSConn(conn, handler.pendingWriteNum, handler.maxMsgLen)
-	wsConn.SetRemoteAddr(GetWebsocketConnRemoteIP(r))
+	wsConn := newWSConn(conn, handler.connCfg, handler.maxMsgLen)
+	wsConn.compress = fc
+	wsConn.request = r
+	wsConn.SetRemoteAddr(remoteIP)
+	handler.metrics.open()
 
+	var session *Session
+	if handler.sessions != nil {
+		session = handler.sessions.Add(wsConn)
+	}
 	agent := handler.newAgent(wsConn)
-	agent.Run()
+	handler.mutexConns.Lock()
+	if handler.agents == nil {
+		handler.agents = make(map[*websocket.Conn]agentConn)
+	}
+	handler.agents[conn] = agentConn{conn: wsConn, agent: agent}
+	handler.mutexConns.Unlock()
+	runAgent(handler.ctx, agent, wsConn.done)
 
 	// cleanup
 	wsConn.Close()
+	reason := wsConn.stats.closeReason()
+	handler.metrics.close(reason)
 	handler.mutexConns.Lock()
 	delete(handler.conns, conn)
+	delete(handler.agents, conn)
 	handler.mutexConns.Unlock()
-	agent.OnClose()
+	closeAgent(agent, reason)
+	if session != nil {
+		handler.sessions.Remove(session.Id())
+	}
 }
 
 func (server *WSServer) Start() {
@@ -85,6 +212,44 @@ func (server *WSServer) Start() {
 	if err != nil {
 		logger.LogFatal("%v", err)
 	}
+	handler := server.Handler()
+
+	if server.ProxyProtocol {
+		ln = newProxyListener(ln, handler.trusted, server.HTTPTimeout)
+	}
+
+	if server.CertFile != "" || server.KeyFile != "" {
+		config := &tls.Config{}
+		config.NextProtos = []string{"http/1.1"}
+
+		var err error
+		config.Certificates = make([]tls.Certificate, 1)
+		config.Certificates[0], err = tls.LoadX509KeyPair(server.CertFile, server.KeyFile)
+		if err != nil {
+			logger.LogFatal("%v", err)
+		}
+
+		ln = tls.NewListener(ln, config)
+	}
+
+	server.ln = ln
+	server.httpServer = &http.Server{
+		Addr:           server.Addr,
+		Handler:        handler,
+		ReadTimeout:    server.HTTPTimeout,
+		WriteTimeout:   server.HTTPTimeout,
+		MaxHeaderBytes: server.MaxHeaderBytes,
+	}
+
+	go server.httpServer.Serve(ln)
+}
+
+// Handler returns the handler upgrading the requests, it is mounted on an existing http.ServeMux instead of calling Start,
+// Close and Shutdown then close the conns it serves
+func (server *WSServer) Handler() *WSHandler {
+	if server.handler != nil {
+		return server.handler
+	}
 
 	if server.MaxConnNum <= 0 {
 		server.MaxConnNum = 100
@@ -106,47 +271,98 @@ func (server *WSServer) Start() {
 		logger.LogFatal("NewAgent must not be nil")
 	}
 
-	if server.CertFile != "" || server.KeyFile != "" {
-		config := &tls.Config{}
-		config.NextProtos = []string{"http/1.1"}
+	trusted, err := parseCIDRs(server.TrustedProxies)
+	if err != nil {
+		logger.LogFatal("%v", err)
+	}
 
-		var err error
-		config.Certificates = make([]tls.Certificate, 1)
-		config.Certificates[0], err = tls.LoadX509KeyPair(server.CertFile, server.KeyFile)
-		if err != nil {
-			logger.LogFatal("%v", err)
-		}
+	if server.Metrics == nil {
+		server.Metrics = NewMetrics(server.Addr)
+	}
 
-		ln = tls.NewListener(ln, config)
+	checkOrigin := server.CheckOrigin
+	if checkOrigin == nil {
+		allowed := server.AllowedOrigins
+		checkOrigin = func(r *http.Request) bool {
+			return originAllowed(r.Header.Get("Origin"), allowed)
+		}
 	}
 
-	server.ln = ln
 	server.handler = &WSHandler{
-		maxConnNum:      server.MaxConnNum,
-		pendingWriteNum: server.PendingWriteNum,
-		maxMsgLen:       server.MaxMsgLen,
-		newAgent:        server.NewAgent,
-		conns:           make(WebsocketConnSet),
+		maxConnNum: server.MaxConnNum,
+		connCfg: (&connConfig{
+			isServer:          true,
+			pendingWriteNum:   server.PendingWriteNum,
+			overflowPolicy:    server.OverflowPolicy,
+			overflowTimeout:   server.OverflowTimeout,
+			coalesceBytes:     server.CoalesceBytes,
+			onOverflow:        server.OnOverflow,
+			textMessage:       server.TextMessage,
+			readIdleTimeout:   server.ReadIdleTimeout,
+			writeIdleTimeout:  server.WriteIdleTimeout,
+			idleTimeout:       server.IdleTimeout,
+			heartbeatInterval: server.HeartbeatInterval,
+			onIdle:            server.OnIdle,
+			record:            server.Record,
+			msgRate:           server.MsgRate,
+			msgBurst:          server.MsgBurst,
+			byteRate:          server.ByteRate,
+			byteBurst:         server.ByteBurst,
+			rateLimitAction:   server.RateLimitAction,
+			onRateLimit:       server.OnRateLimit,
+			metrics:           server.Metrics,
+		}).init(),
+		trusted:           trusted,
+		limiter:           newConnLimiter(server.IPFilter, server.MaxConnPerIP, server.AcceptRate, server.AcceptBurst),
+		maxMsgLen:         server.MaxMsgLen,
+		newAgent:          server.NewAgent,
+		sessions:          server.Sessions,
+		metrics:           server.Metrics,
+		compressors:       server.Compressors,
+		compressThreshold: server.CompressThreshold,
+		compressionLevel:  server.CompressionLevel,
+		conns:             make(WebsocketConnSet),
 		upgrader: websocket.Upgrader{
-			HandshakeTimeout: server.HTTPTimeout,
-			CheckOrigin:      func(_ *http.Request) bool { return true },
+			HandshakeTimeout:  server.HTTPTimeout,
+			CheckOrigin:       checkOrigin,
+			Subprotocols:      server.Subprotocols,
+			EnableCompression: server.EnableCompression,
 		},
 	}
+	server.handler.ctx, server.handler.cancel = context.WithCancel(context.Background())
+	return server.handler
+}
 
-	httpServer := &http.Server{
-		Addr:           server.Addr,
-		Handler:        server.handler,
-		ReadTimeout:    server.HTTPTimeout,
-		WriteTimeout:   server.HTTPTimeout,
-		MaxHeaderBytes: 1024,
+// originAllowed matches origin by the full origin or its host, "*" allows all and "*.example.com" the subdomains
+func originAllowed(origin string, allowed []string) bool {
+	if origin == "" || len(allowed) == 0 {
+		return true
 	}
-
-	go httpServer.Serve(ln)
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range allowed {
+		switch {
+		case pattern == "*":
+			return true
+		case strings.EqualFold(pattern, origin), strings.EqualFold(pattern, u.Host), strings.EqualFold(pattern, host):
+			return true
+		case strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, strings.ToLower(pattern[1:])):
+			return true
+		}
+	}
+	return false
 }
 
 func (server *WSServer) Close() {
-	server.ln.Close()
+	if server.httpServer != nil {
+		server.ln.Close()
+		server.httpServer.Close()
+	}
 
+	server.handler.cancel()
 	server.handler.mutexConns.Lock()
 	for conn := range server.handler.conns {
 		conn.Close()
@@ -157,6 +373,75 @@ func (server *WSServer) Close() {
 	server.handler.wg.Wait()
 }
 
+// Shutdown stops the http server, tells the agents implementing ShutdownAgent and closes their conns after the write queues are flushed,
+// the conns left when ctx is done are destroyed, Close waits for their agents
+func (server *WSServer) Shutdown(ctx context.Context) error {
+	// the upgraded conns are hijacked and not waited by the http server
+	var err error
+	if server.httpServer != nil {
+		err = server.httpServer.Shutdown(ctx)
+	}
+
+	agents := server.handler.shutdown()
+	shutdownAgents(ctx, agents)
+	server.handler.cancel()
+	if drainErr := waitDrained(ctx, &server.handler.wg, agents); drainErr != nil {
+		err = drainErr
+	}
+	return err
+}
+
+// shutdown refuses the new conns and returns the served ones
+func (handler *WSHandler) shutdown() []agentConn {
+	handler.mutexConns.Lock()
+	defer handler.mutexConns.Unlock()
+
+	handler.closing = true
+	agents := make([]agentConn, 0, len(handler.agents))
+	for conn := range handler.conns {
+		if ac, ok := handler.agents[conn]; ok {
+			agents = append(agents, ac)
+		} else {
+			// not served yet
+			conn.Close()
+		}
+	}
+	return agents
+}
+
+// remoteIP returns the client ip, the forwarded headers are honored only from the trusted proxies,
+// the client is the right most address of X-Forwarded-For which is not a trusted proxy
+func (handler *WSHandler) remoteIP(r *http.Request) string {
+	peer := addrHost(r.RemoteAddr)
+	if !containsIP(handler.trusted, net.ParseIP(peer)) {
+		return peer
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !containsIP(handler.trusted, ip) {
+			return client
+		}
+	}
+	if client != "" {
+		return client
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return peer
+}
+
+// Deprecated: GetWebsocketConnRemoteIP trusts the headers from any peer, WSServer honors them only from TrustedProxies
 func GetWebsocketConnRemoteIP(r *http.Request) string {
 	ip := r.Header.Get("X-Forwarded-For")
 	if strings.Contains(ip, "127.0.0.1") || ip == "" {
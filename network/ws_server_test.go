@@ -0,0 +1,165 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+type wsEchoAgent struct {
+	conn *WSConn
+}
+
+func (a *wsEchoAgent) Run() {
+	token := a.conn.Request().URL.Query().Get("token")
+	a.conn.WriteMsg([]byte(token + " " + a.conn.Subprotocol()))
+	for {
+		msg, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		a.conn.WriteMsg(msg)
+	}
+}
+
+func (a *wsEchoAgent) OnClose() {}
+
+func TestWSServer_Handler(t *testing.T) {
+	server := &WSServer{
+		NewAgent:          func(conn *WSConn) Agent { return &wsEchoAgent{conn: conn} },
+		AllowedOrigins:    []string{"*.example.com"},
+		Subprotocols:      []string{"json.v2", "json.v1"},
+		EnableCompression: true,
+		TextMessage:       true,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/ws", server.Handler())
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?token=abc"
+	dialer := websocket.Dialer{Subprotocols: []string{"json.v1"}, EnableCompression: true}
+
+	header := http.Header{"Origin": {"https://evil.com"}}
+	if _, resp, err := dialer.Dial(url, header); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("foreign origin accepted: %v", err)
+	}
+
+	header = http.Header{"Origin": {"https://game.example.com"}}
+	conn, resp, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ext := resp.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("compression not negotiated: %q", ext)
+	}
+
+	typ, msg, err := conn.ReadMessage()
+	if err != nil || typ != websocket.TextMessage || string(msg) != "abc json.v1" {
+		t.Fatalf("read %v %q, error %v", typ, msg, err)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"hello":1}`))
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != `{"hello":1}` {
+		t.Fatalf("read %q, error %v", msg, err)
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	allowed := []string{"https://a.com", "b.com:8080", "*.c.com"}
+	for origin, want := range map[string]bool{
+		"":                    true,
+		"https://a.com":       true,
+		"http://a.com":        false,
+		"http://b.com:8080":   true,
+		"https://x.c.com":     true,
+		"https://x.y.C.com:1": true,
+		"https://c.com":       false,
+		"https://evilc.com":   false,
+	} {
+		if got := originAllowed(origin, allowed); got != want {
+			t.Errorf("originAllowed(%q) = %v, want %v", origin, got, want)
+		}
+	}
+	if !originAllowed("https://any.com", nil) {
+		t.Error("empty allow list refused")
+	}
+}
+
+type wsCompressAgent struct {
+	conn *WSConn
+	done chan<- error
+}
+
+func (a *wsCompressAgent) Run() {
+	a.done <- a.roundtrip()
+}
+
+func (a *wsCompressAgent) roundtrip() error {
+	// the token line of wsEchoAgent
+	if _, err := a.conn.ReadMsg(); err != nil {
+		return err
+	}
+	// a small message and one of MaxMsgLen, which the flag byte must not push over the limit
+	for _, msg := range [][]byte{[]byte("hi"), bytes.Repeat([]byte("srvlib"), 4096)[:4096]} {
+		if err := a.conn.WriteMsg(msg); err != nil {
+			return err
+		}
+		got, err := a.conn.ReadMsg()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, msg) {
+			return fmt.Errorf("echo %d bytes, want %d", len(got), len(msg))
+		}
+	}
+
+	stats, ok := a.conn.CompressionStats()
+	if !ok || stats.Compressor != "zstd" || stats.CompressedFramesOut != 1 || stats.CompressedFramesIn != 1 {
+		return fmt.Errorf("unexpected compression stats %+v", stats)
+	}
+	return nil
+}
+
+func (a *wsCompressAgent) OnClose() {}
+
+func TestWSServer_Compression(t *testing.T) {
+	server := &WSServer{
+		NewAgent:    func(conn *WSConn) Agent { return &wsEchoAgent{conn: conn} },
+		MaxMsgLen:   4096,
+		Compressors: []string{"snappy", "zstd"},
+	}
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+	defer server.Close()
+
+	done := make(chan error, 1)
+	client := &WSClient{
+		Addr:        "ws" + strings.TrimPrefix(ts.URL, "http"),
+		MaxMsgLen:   4096,
+		Compressors: []string{"zstd", "gzip"},
+		NewAgent:    func(conn *WSConn) Agent { return &wsCompressAgent{conn: conn, done: done} },
+	}
+	client.Start()
+	defer client.Close()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWSConn_PackKey(t *testing.T) {
+	small, large := &WSConn{maxMsgLen: 4}, &WSConn{maxMsgLen: 4096}
+	if small.packKey() == large.packKey() {
+		t.Fatal("conns of different max msg len share the packed msg")
+	}
+	if small.packKey() != (&WSConn{maxMsgLen: 4}).packKey() {
+		t.Fatal("conns of the same max msg len don't share the packed msg")
+	}
+}
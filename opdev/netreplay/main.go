@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gzjjyz/srvlib/network"
+)
+
+// netreplay replays a session recorded by the Record option of the network servers against a server
+// and prints the responses differing from the recording
+func main() {
+	file := flag.String("f", "", "recording file")
+	addr := flag.String("addr", "", "server address, empty prints the recording")
+	speed := flag.Float64("speed", 1, "timing scale, 1 is the original, 0 sends without waiting")
+	timeout := flag.Duration("timeout", 3*time.Second, "waiting for the responses after the last frame")
+	swap := flag.Bool("swap", false, "the recording is of a client")
+	lenMsgLen := flag.Int("lenmsglen", 2, "msg parser length bytes, 1, 2 or 4")
+	maxMsgLen := flag.Uint("maxmsglen", 4096, "msg parser max message length")
+	littleEndian := flag.Bool("le", false, "msg parser little endian")
+	flag.Parse()
+
+	if *file == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	rec, err := network.LoadRecording(*file)
+	if err != nil {
+		fmt.Printf("err:%v\n", err)
+		os.Exit(1)
+	}
+	if *swap {
+		rec = rec.Swapped()
+	}
+
+	if *addr == "" {
+		fmt.Printf("%v from %v, %d frames\n", rec.Start.Format(time.RFC3339Nano), rec.RemoteAddr, len(rec.Frames))
+		for _, f := range rec.Frames {
+			fmt.Printf("%12v %-3v %v\n", f.At, f.Dir, &f)
+		}
+		return
+	}
+
+	replayer := &network.Replayer{
+		Client: &network.TCPClient{
+			Addr:         *addr,
+			LenMsgLen:    *lenMsgLen,
+			MaxMsgLen:    uint32(*maxMsgLen),
+			LittleEndian: *littleEndian,
+		},
+		Speed:   *speed,
+		Timeout: *timeout,
+	}
+	report, err := replayer.Replay(context.Background(), rec)
+	if err != nil {
+		fmt.Printf("err:%v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("sent %d, received %d\n", report.Sent, len(report.Responses))
+	for _, d := range report.Diffs {
+		fmt.Println(d)
+	}
+	if !report.OK() {
+		os.Exit(1)
+	}
+}